@@ -2,10 +2,26 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"main/internal/app/server"
 )
 
+var commands = map[string]func(args []string) error{
+	"migrate-data": migrateData,
+	"snapshot":     writeSnapshot,
+	"restore":      restoreSnapshot,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(os.Args[1], ": ", err)
+			}
+			return
+		}
+	}
+
 	log.Println(server.StartSever())
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+
+	"main/internal/app/migrate"
+)
+
+// migrateData переносит ссылки между хранилищами:
+//
+//	shortener migrate-data --from file:/data/links.json --to postgres:postgres://...
+func migrateData(args []string) error {
+	fs := flag.NewFlagSet("migrate-data", flag.ExitOnError)
+	from := fs.String("from", "", "source storage, backend:address")
+	to := fs.String("to", "", "destination storage, backend:address")
+	batch := fs.Int("batch", 1000, "links copied per batch")
+	checkpoint := fs.String("checkpoint", "migrate-data.checkpoint", "file to resume an interrupted migration from, empty to disable")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *from == "" || *to == "" {
+		return errors.New("both --from and --to are required")
+	}
+
+	fromConf, err := migrate.ParseTarget(*from)
+	if err != nil {
+		return err
+	}
+
+	toConf, err := migrate.ParseTarget(*to)
+	if err != nil {
+		return err
+	}
+
+	src, dst, err := migrate.Open(fromConf, toConf)
+	if err != nil {
+		return err
+	}
+
+	defer closeStorage(src)
+	defer closeStorage(dst)
+
+	res, err := migrate.Run(src, dst, migrate.Options{
+		BatchSize:  *batch,
+		Checkpoint: *checkpoint,
+		Progress: func(copied int) {
+			log.Printf("migrate-data: copied %d links", copied)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("migrate-data: done, copied %d links in this run, %d links verified, checksum %s", res.Copied, res.Count, res.Checksum)
+
+	return nil
+}
@@ -2,26 +2,90 @@ package config
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/caarlos0/env/v6"
+	mod "main/internal/app/storage/model"
 )
 
 var Conf Config
 
 type Config struct {
-	ServerAddress   string `env:"SERVER_ADDRESS"`
-	BaseURL         string `env:"BASE_URL"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	DataBaseDSN     string `end:"DATABASE_DSN"`
+	ServerAddress       string        `env:"SERVER_ADDRESS"`
+	BaseURL             string        `env:"BASE_URL"`
+	FileStoragePath     string        `env:"FILE_STORAGE_PATH"`
+	DataBaseDSN         string        `end:"DATABASE_DSN"`
+	RedisAddr           string        `env:"REDIS_ADDR"`
+	StorageBackend      string        `env:"STORAGE_BACKEND"`
+	EmbeddedPath        string        `env:"EMBEDDED_PATH"`
+	MemorySnapshotPath  string        `env:"MEMORY_SNAPSHOT_PATH"`
+	SnapshotInterval    time.Duration `env:"MEMORY_SNAPSHOT_INTERVAL"`
+	MaxBodySize         int64         `env:"MAX_BODY_SIZE"`
+	MaxDecompressedSize int64         `env:"MAX_DECOMPRESSED_SIZE"`
+	MaxURLLength        int           `env:"MAX_URL_LENGTH"`
+	MaxBatchSize        int           `env:"MAX_BATCH_SIZE"`
+	MaxStreamBodySize   int64         `env:"MAX_STREAM_BODY_SIZE"`
+	// MaxStreamDecompressedSize - предел распакованного gzip тела потоковых
+	// запросов, отдельный от предела сжатого тела.
+	MaxStreamDecompressedSize int64         `env:"MAX_STREAM_DECOMPRESSED_SIZE"`
+	TrashRetention            time.Duration `env:"TRASH_RETENTION"`
+	PurgeInterval             time.Duration `env:"PURGE_INTERVAL"`
+	CodeGenerator             string        `env:"CODE_GENERATOR"`
+	CodeLength                int           `env:"CODE_LENGTH"`
+	CodeKey                   string        `env:"CODE_KEY"`
+	CodeNamespace             string        `env:"CODE_NAMESPACE"`
+	CacheSize                 int           `env:"CACHE_SIZE"`
+	CacheTTL                  time.Duration `env:"CACHE_TTL"`
+	CacheNegativeTTL          time.Duration `env:"CACHE_NEGATIVE_TTL"`
+	CacheRedisAddr            string        `env:"CACHE_REDIS_ADDR"`
+	AdminToken                string        `env:"ADMIN_TOKEN"`
+	QRLevel                   string        `env:"QR_LEVEL"`
+	QRMargin                  int           `env:"QR_MARGIN"`
+	RedirectStatus            int           `env:"REDIRECT_STATUS"`
+	PasswordAttempts          int           `env:"PASSWORD_ATTEMPTS"`
+	PasswordLockout           time.Duration `env:"PASSWORD_LOCKOUT"`
+	GeoIPPath                 string        `env:"GEOIP_PATH"`
+	PreviewKey                string        `env:"PREVIEW_KEY"`
 }
 
 var f flagConfig
 
 type flagConfig struct {
-	ServerAddress   *string
-	BaseURL         *string
-	FileStoragePath *string
-	DataBaseDSN     *string
+	ServerAddress             *string
+	BaseURL                   *string
+	FileStoragePath           *string
+	DataBaseDSN               *string
+	RedisAddr                 *string
+	StorageBackend            *string
+	EmbeddedPath              *string
+	MemorySnapshotPath        *string
+	SnapshotInterval          *time.Duration
+	MaxBodySize               *int64
+	MaxDecompressedSize       *int64
+	MaxURLLength              *int
+	MaxBatchSize              *int
+	MaxStreamBodySize         *int64
+	MaxStreamDecompressedSize *int64
+	TrashRetention            *time.Duration
+	PurgeInterval             *time.Duration
+	CodeGenerator             *string
+	CodeLength                *int
+	CodeKey                   *string
+	CodeNamespace             *string
+	CacheSize                 *int
+	CacheTTL                  *time.Duration
+	CacheNegativeTTL          *time.Duration
+	CacheRedisAddr            *string
+	AdminToken                *string
+	QRLevel                   *string
+	QRMargin                  *int
+	RedirectStatus            *int
+	PasswordAttempts          *int
+	PasswordLockout           *time.Duration
+	GeoIPPath                 *string
+	PreviewKey                *string
 }
 
 func init() {
@@ -29,6 +93,35 @@ func init() {
 	f.BaseURL = flag.String("b", "", "base url")
 	f.FileStoragePath = flag.String("f", "", "file storage path")
 	f.DataBaseDSN = flag.String("d", "", "database address")
+	f.RedisAddr = flag.String("r", "", "redis storage address")
+	f.StorageBackend = flag.String("storage", "", "storage backend: memory, file, postgres, redis or embedded; empty to choose by the other flags")
+	f.EmbeddedPath = flag.String("embedded-path", "shortener.db", "embedded storage file path")
+	f.MemorySnapshotPath = flag.String("memory-snapshot-path", "", "snapshot file of the memory storage, empty keeps links only in memory")
+	f.SnapshotInterval = flag.Duration("memory-snapshot-interval", 5*time.Minute, "how often the memory storage is snapshotted, 0 only on purge and shutdown")
+	f.MaxBodySize = flag.Int64("max-body-size", 1<<20, "max request body size in bytes")
+	f.MaxDecompressedSize = flag.Int64("max-decompressed-size", 10<<20, "max decompressed gzip request body size in bytes")
+	f.MaxURLLength = flag.Int("max-url-length", 2048, "max length of a shortened url")
+	f.MaxBatchSize = flag.Int("max-batch-size", 1000, "max number of entries in a batch request")
+	f.MaxStreamBodySize = flag.Int64("max-stream-body-size", 1<<30, "max streaming batch request body size in bytes")
+	f.MaxStreamDecompressedSize = flag.Int64("max-stream-decompressed-size", 2<<30, "max decompressed gzip streaming request body size in bytes")
+	f.TrashRetention = flag.Duration("trash-retention", 30*24*time.Hour, "how long deleted links can be restored")
+	f.PurgeInterval = flag.Duration("purge-interval", time.Hour, "how often deleted links past retention are purged")
+	f.CodeGenerator = flag.String("code-generator", "counter", "short code generator: counter, random, obfuscated or hash")
+	f.CodeLength = flag.Int("code-length", 7, "length of random and hash short codes")
+	f.CodeKey = flag.String("code-key", "", "secret key of the obfuscated code generator")
+	f.CodeNamespace = flag.String("code-namespace", "", "namespace mixed into hash short codes")
+	f.CacheSize = flag.Int("cache-size", 0, "max number of cached redirects, 0 disables the in-process cache")
+	f.CacheTTL = flag.Duration("cache-ttl", time.Minute, "how long found redirects are cached")
+	f.CacheNegativeTTL = flag.Duration("cache-negative-ttl", 10*time.Second, "how long missing short codes are cached")
+	f.CacheRedisAddr = flag.String("cache-redis-addr", "", "redis address of the shared redirect cache")
+	f.AdminToken = flag.String("admin-token", "", "bearer token of the admin api, empty disables it")
+	f.QRLevel = flag.String("qr-level", "M", "default error correction level of qr codes: L, M, Q or H")
+	f.QRMargin = flag.Int("qr-margin", 4, "default margin of qr codes in modules")
+	f.RedirectStatus = flag.Int("redirect-status", http.StatusTemporaryRedirect, "default redirect status: 301, 302, 307 or 308")
+	f.PasswordAttempts = flag.Int("password-attempts", 5, "wrong passwords before a protected link is locked, 0 disables the lockout")
+	f.PasswordLockout = flag.Duration("password-lockout", 15*time.Minute, "how long a protected link stays locked after too many wrong passwords")
+	f.GeoIPPath = flag.String("geoip-path", "", "csv file of ip ranges and countries for country redirect rules, empty disables them")
+	f.PreviewKey = flag.String("preview-key", "", "secret key signing the continue links of preview pages, empty uses a random key per start")
 }
 
 func ParseConfig() (Config, error) {
@@ -37,12 +130,45 @@ func ParseConfig() (Config, error) {
 	Conf.FileStoragePath = *f.FileStoragePath
 	Conf.BaseURL = *f.BaseURL
 	Conf.DataBaseDSN = *f.DataBaseDSN
+	Conf.RedisAddr = *f.RedisAddr
+	Conf.StorageBackend = *f.StorageBackend
+	Conf.EmbeddedPath = *f.EmbeddedPath
+	Conf.MemorySnapshotPath = *f.MemorySnapshotPath
+	Conf.SnapshotInterval = *f.SnapshotInterval
+	Conf.MaxBodySize = *f.MaxBodySize
+	Conf.MaxDecompressedSize = *f.MaxDecompressedSize
+	Conf.MaxURLLength = *f.MaxURLLength
+	Conf.MaxBatchSize = *f.MaxBatchSize
+	Conf.MaxStreamBodySize = *f.MaxStreamBodySize
+	Conf.MaxStreamDecompressedSize = *f.MaxStreamDecompressedSize
+	Conf.TrashRetention = *f.TrashRetention
+	Conf.PurgeInterval = *f.PurgeInterval
+	Conf.CodeGenerator = *f.CodeGenerator
+	Conf.CodeLength = *f.CodeLength
+	Conf.CodeKey = *f.CodeKey
+	Conf.CodeNamespace = *f.CodeNamespace
+	Conf.CacheSize = *f.CacheSize
+	Conf.CacheTTL = *f.CacheTTL
+	Conf.CacheNegativeTTL = *f.CacheNegativeTTL
+	Conf.CacheRedisAddr = *f.CacheRedisAddr
+	Conf.AdminToken = *f.AdminToken
+	Conf.QRLevel = *f.QRLevel
+	Conf.QRMargin = *f.QRMargin
+	Conf.RedirectStatus = *f.RedirectStatus
+	Conf.PasswordAttempts = *f.PasswordAttempts
+	Conf.PasswordLockout = *f.PasswordLockout
+	Conf.GeoIPPath = *f.GeoIPPath
+	Conf.PreviewKey = *f.PreviewKey
 
 	err := env.Parse(&Conf)
 	if err != nil {
 		return Config{}, err
 	}
 
+	if !mod.ValidRedirect(Conf.RedirectStatus) {
+		return Config{}, fmt.Errorf("unsupported redirect status %d, use 301, 302, 307 or 308", Conf.RedirectStatus)
+	}
+
 	if Conf.ServerAddress == "" {
 		Conf.ServerAddress = "localhost:8080"
 	}
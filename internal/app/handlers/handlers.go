@@ -1,33 +1,54 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"database/sql"
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
 	"main/internal/app/config"
+	"main/internal/app/qr"
+	"main/internal/app/rules"
+	"main/internal/app/snapshot"
 	"main/internal/app/storage"
+	mod "main/internal/app/storage/model"
 )
 
 type (
 	short struct {
 		Result string `json:"result"`
+		QRURL  string `json:"qr_url"`
 	}
 
 	original struct {
 		URL string `json:"url"`
+		// Параметры ссылки, nil оставляет параметр без изменений.
+		Title    *string `json:"title,omitempty"`
+		Preview  *bool   `json:"preview,omitempty"`
+		Redirect *int    `json:"redirect,omitempty"`
+		// Password - пароль ссылки, пустая строка снимает пароль.
+		Password *string `json:"password,omitempty"`
+		// MaxClicks - число переходов по ссылке, 0 снимает ограничение.
+		MaxClicks *int `json:"max_clicks,omitempty"`
 	}
 )
 
@@ -37,19 +58,42 @@ type (
 		URL string `json:"original_url"`
 	}
 	BatchShort struct {
-		ID  string `json:"correlation_id"`
-		URL string `json:"short_url"`
+		ID     string `json:"correlation_id"`
+		URL    string `json:"short_url,omitempty"`
+		QRURL  string `json:"qr_url,omitempty"`
+		Status string `json:"status,omitempty"`
+		Error  string `json:"error,omitempty"`
 	}
 )
 
+// Статусы элементов пакетного сокращения.
+const (
+	BatchCreated = "created" // ссылка сокращена
+	BatchExists  = "exists"  // ссылка уже была сокращена, отдан ее код
+	BatchInvalid = "invalid" // ссылка не принята, причина в Error
+	BatchSkipped = "skipped" // ссылка верна, но пакет с atomic=true отклонен
+)
+
 type Controller struct {
 	sConf   config.Config
 	storage storage.Storage
-	db      *sql.DB
+	lockout *lockout
+	passes  *passes
+	geo     *rules.GeoIP
+}
+
+func NewController(c storage.Storage, s config.Config) *Controller {
+	return &Controller{
+		storage: c,
+		sConf:   s,
+		lockout: newLockout(s.PasswordAttempts, s.PasswordLockout),
+		passes:  newPasses(s.PreviewKey, passTTL),
+	}
 }
 
-func NewController(c storage.Storage, s config.Config, db *sql.DB) *Controller {
-	return &Controller{storage: c, sConf: s, db: db}
+// UseGeoIP задает базу GeoIP для правил переадресации по стране.
+func (c *Controller) UseGeoIP(geo *rules.GeoIP) {
+	c.geo = geo
 }
 
 type Middleware func(http.Handler) http.Handler
@@ -71,21 +115,48 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+func (w gzipWriter) Flush() {
+	if f, ok := w.Writer.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// gzipBody распаковывает тело запроса при первом чтении, чтобы ограничения
+// размера можно было наложить и на сжатое, и на распакованное тело.
+type gzipBody struct {
+	body io.ReadCloser
+	gz   *gzip.Reader
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.gz == nil {
+		gz, err := gzip.NewReader(b.body)
+		if err != nil {
+			return 0, err
+		}
+
+		b.gz = gz
+	}
+
+	return b.gz.Read(p)
+}
+
+func (b *gzipBody) Close() error {
+	if b.gz != nil {
+		_ = b.gz.Close()
+	}
+
+	return b.body.Close()
+}
+
 func gzipMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
-			gz, err := gzip.NewReader(r.Body)
-			if err != nil {
-				log.Print("GZIP: new reader err: ", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-			defer func() {
-				_ = gz.Close()
-			}()
-
-			r.Body = gz
+			r.Body = &gzipBody{body: r.Body}
 		}
 
 		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
@@ -109,6 +180,89 @@ func gzipMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// limitBody ограничивает размер тела запроса. Для gzip запросов maxBody
+// ограничивает сжатое тело, а maxDecompressed - распакованное.
+func limitBody(w http.ResponseWriter, r *http.Request, maxBody, maxDecompressed int64) {
+	if gb, ok := r.Body.(*gzipBody); ok {
+		if maxBody > 0 {
+			gb.body = http.MaxBytesReader(w, gb.body, maxBody)
+		}
+
+		if maxDecompressed > 0 {
+			r.Body = http.MaxBytesReader(w, gb, maxDecompressed)
+		}
+
+		return
+	}
+
+	if maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Limit int64  `json:"limit,omitempty"`
+}
+
+func writeTooLarge(w http.ResponseWriter, msg string, limit int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+
+	marshal, err := json.Marshal(errorResponse{Error: msg, Limit: limit})
+	if err != nil {
+		log.Print("TOO LARGE: json marshal err: ", err)
+		return
+	}
+
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Print("TOO LARGE: write err: ", err)
+	}
+}
+
+// readBody читает тело запроса с учетом ограничений из конфигурации.
+// При превышении ограничения отвечает 413 и возвращает false.
+func (c *Controller) readBody(w http.ResponseWriter, r *http.Request, name string) ([]byte, bool) {
+	limitBody(w, r, c.sConf.MaxBodySize, c.sConf.MaxDecompressedSize)
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeTooLarge(w, "request body too large", maxErr.Limit)
+			return nil, false
+		}
+
+		log.Print(name+": read all err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return b, true
+}
+
+// checkURL проверяет длину ссылки. При превышении отвечает 413 и возвращает false.
+func (c *Controller) checkURL(w http.ResponseWriter, url string) bool {
+	if c.sConf.MaxURLLength > 0 && len(url) > c.sConf.MaxURLLength {
+		writeTooLarge(w, "url too long", int64(c.sConf.MaxURLLength))
+		return false
+	}
+
+	return true
+}
+
+// checkBatch проверяет количество элементов в пакетном запросе.
+// При превышении отвечает 413 и возвращает false.
+func (c *Controller) checkBatch(w http.ResponseWriter, n int) bool {
+	if c.sConf.MaxBatchSize > 0 && n > c.sConf.MaxBatchSize {
+		writeTooLarge(w, "too many batch entries", int64(c.sConf.MaxBatchSize))
+		return false
+	}
+
+	return true
+}
+
 func generateRandom(size int) ([]byte, error) {
 	b := make([]byte, size)
 	_, err := rand.Read(b)
@@ -190,10 +344,76 @@ func cookieMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// previewPage - страница предпросмотра ссылки.
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{if .Title}}{{.Title}}{{else}}Link preview{{end}}</title>
+</head>
+<body>
+{{if .Title}}<h1>{{.Title}}</h1>
+{{end}}<p>This short link leads to:</p>
+<p><code>{{.URL}}</code></p>
+<p>Created {{.Created.UTC.Format "2006-01-02"}}, followed {{.Clicks}} times.</p>
+<p><a href="{{.Continue}}" rel="noreferrer">Continue to the site</a></p>
+</body>
+</html>
+`))
+
+type preview struct {
+	Title    string
+	URL      string
+	Created  time.Time
+	Clicks   int
+	Continue string
+}
+
+// passwordPage - форма ввода пароля ссылки. Адрес ссылки на ней не
+// показывается.
+var passwordPage = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{if .Title}}{{.Title}}{{else}}Protected link{{end}}</title>
+</head>
+<body>
+{{if .Title}}<h1>{{.Title}}</h1>
+{{end}}<p>This short link is protected by a password.</p>
+{{if .Wrong}}<p>Wrong password, try again.</p>
+{{end}}<form method="post">
+<input type="password" name="password" autofocus required>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+type passwordForm struct {
+	Title string
+	Wrong bool
+}
+
+// Get переадресует по короткой ссылке. Код с "+" в конце, параметр
+// preview=true или флаг ссылки показывают вместо переадресации страницу
+// предпросмотра. Флаг ссылки пропускает только подписанный пропуск pass,
+// выданный страницей предпросмотра, preview=false его не отменяет.
+// Ссылка с паролем открывается только с верным паролем из заголовка
+// X-Link-Password, из формы, отправленной POST запросом, или с пропуском
+// со страницы предпросмотра, показанной после ввода пароля. На ссылку с
+// исчерпанными переходами отвечает 410. Правила ссылки могут заменить адрес
+// перехода в зависимости от платформы, языка, страны и времени.
 func (c *Controller) Get(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
-	url, del, err := c.storage.Get(chi.URLParam(r, "id"))
+	id := chi.URLParam(r, "id")
+
+	show := strings.HasSuffix(id, "+")
+	id = strings.TrimSuffix(id, "+")
+
+	link, err := c.storage.Link(id)
 	if err != nil {
 		if strings.Contains(err.Error(), "the storage is empty or the element is missing") {
 			w.WriteHeader(http.StatusBadRequest)
@@ -204,18 +424,334 @@ func (c *Controller) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if del {
+	if link.Del || link.Exhausted() {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	if link.URL == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	pass := r.URL.Query().Get("pass")
+	passed := pass != "" && c.passes.valid(pass, link)
+
+	if link.PasswordHash != "" {
+		if !passed && !c.unlock(w, r, id, link) {
+			return
+		}
+
+		// Переадресация не должна оседать в кеше браузера в обход пароля.
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	if len(link.Rules) > 0 {
+		// Адрес зависит от заголовков запроса, кеши должны это учитывать.
+		w.Header().Set("Vary", "User-Agent, Accept-Language")
+
+		if target, ok := rules.Select(link.Rules, rules.NewRequest(r, c.geo, time.Now())); ok {
+			link.URL = target
+		}
+	}
+
+	if !show {
+		show = link.Preview && !passed
+		if v := r.URL.Query().Get("preview"); v != "" {
+			asked, err := strconv.ParseBool(v)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			show = show || asked
+		}
+	}
+
+	if show {
+		c.preview(w, id, link)
+		return
+	}
+
+	// Для ссылки с ограничением переход разрешает только учтенный клик:
+	// счетчик мог исчерпаться после чтения ссылки.
+	if err = c.storage.Click(id); errors.Is(err, mod.ErrExhausted) {
 		w.WriteHeader(http.StatusGone)
 		return
+	} else if err != nil {
+		log.Print("GET: click err: ", err)
+		if link.MaxClicks > 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	status := c.redirectStatus(link)
+	if r.Method == http.MethodPost {
+		// После отправки формы браузер должен перейти по ссылке GET запросом.
+		status = http.StatusSeeOther
+	}
+
+	w.Header().Set("Location", link.URL)
+	w.WriteHeader(status)
+}
+
+// unlock проверяет пароль ссылки. Без пароля отвечает формой ввода, на
+// неверный пароль - формой с ошибкой, на заблокированную ссылку - 429.
+func (c *Controller) unlock(w http.ResponseWriter, r *http.Request, id string, link mod.Event) bool {
+	password := r.Header.Get("X-Link-Password")
+	if password == "" && r.Method == http.MethodPost {
+		limitBody(w, r, c.sConf.MaxBodySize, c.sConf.MaxDecompressedSize)
+		password = r.PostFormValue("password")
+	}
+
+	if password == "" {
+		c.passwordForm(w, link, false)
+		return false
+	}
+
+	if wait := c.lockout.attempt(id); wait > 0 {
+		log.Printf("get: locked, id: %s, wait: %s", id, wait)
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)); err != nil {
+		log.Printf("get: wrong password, id: %s", id)
+		c.passwordForm(w, link, true)
+		return false
+	}
+
+	c.lockout.reset(id)
+
+	return true
+}
+
+// passwordForm отдает форму ввода пароля ссылки с кодом 401.
+func (c *Controller) passwordForm(w http.ResponseWriter, link mod.Event, wrong bool) {
+	var buf bytes.Buffer
+
+	if err := passwordPage.Execute(&buf, passwordForm{Title: link.Title, Wrong: wrong}); err != nil {
+		log.Print("PASSWORD: execute err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Print("PASSWORD: write err: ", err)
+	}
+}
+
+// redirectStatus возвращает код переадресации ссылки: заданный владельцем,
+// иначе из конфигурации, иначе 307.
+func (c *Controller) redirectStatus(link mod.Event) int {
+	switch {
+	case link.Redirect != 0:
+		return link.Redirect
+	case c.sConf.RedirectStatus != 0:
+		return c.sConf.RedirectStatus
+	default:
+		return http.StatusTemporaryRedirect
+	}
+}
+
+// preview отдает страницу предпросмотра ссылки. Переход с нее идет через
+// короткую ссылку с пропуском, чтобы он был учтен в переходах и не требовал
+// снова пароля.
+func (c *Controller) preview(w http.ResponseWriter, id string, link mod.Event) {
+	var buf bytes.Buffer
+
+	err := previewPage.Execute(&buf, preview{
+		Title:    link.Title,
+		URL:      link.URL,
+		Created:  link.Created,
+		Clicks:   link.Clicks,
+		Continue: "/" + c.sConf.BaseURL + id + "?pass=" + c.passes.issue(link),
+	})
+	if err != nil {
+		log.Print("PREVIEW: execute err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		log.Print("PREVIEW: write err: ", err)
 	}
+}
 
-	if url == "" {
+// QR отдает QR код короткой ссылки. Параметры size, format, level и margin
+// задают размер в пикселях, формат png или svg, уровень коррекции ошибок и
+// ширину поля в модулях. Изображение определяется параметрами, поэтому
+// отдается с ETag и на повторный запрос с If-None-Match отвечает 304.
+func (c *Controller) QR(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	o, err := c.qrOptions(r)
+	if err != nil {
+		log.Print("QR: options err: ", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Location", url)
-	w.WriteHeader(http.StatusTemporaryRedirect)
+	_, del, err := c.storage.Get(id)
+	if err != nil {
+		writeStorageError(w, "QR", err)
+		return
+	}
+
+	if del {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	link := "http://" + c.sConf.ServerAddress + c.sConf.BaseURL + id
+	etag := o.ETag(link)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err = qr.Encode(&buf, link, o); err != nil {
+		w.Header().Del("ETag")
+		w.Header().Del("Cache-Control")
+
+		if errors.Is(err, qr.ErrSize) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		log.Print("QR: encode err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", o.ContentType())
+
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		log.Print("QR: write err: ", err)
+	}
+}
+
+// qrOptions читает параметры QR кода из запроса. Не заданные параметры
+// берутся из конфигурации.
+func (c *Controller) qrOptions(r *http.Request) (qr.Options, error) {
+	o := qr.Options{
+		Size:   256,
+		Format: qr.PNG,
+		Level:  c.sConf.QRLevel,
+		Margin: c.sConf.QRMargin,
+	}
+
+	if o.Level == "" {
+		o.Level = "M"
+	}
+
+	query := r.URL.Query()
+
+	if v := query.Get("format"); v != "" {
+		o.Format = v
+	}
+
+	if v := query.Get("level"); v != "" {
+		o.Level = v
+	}
+
+	var err error
+	if v := query.Get("size"); v != "" {
+		if o.Size, err = strconv.Atoi(v); err != nil {
+			return o, err
+		}
+	}
+
+	if v := query.Get("margin"); v != "" {
+		if o.Margin, err = strconv.Atoi(v); err != nil {
+			return o, err
+		}
+	}
+
+	return o, o.Validate()
+}
+
+// configures сообщает, задает ли запрос параметры ссылки.
+func (o original) configures() bool {
+	return o.Title != nil || o.Preview != nil || o.Redirect != nil || o.Password != nil || o.MaxClicks != nil
+}
+
+// validSettings проверяет параметры ссылки из запроса. Код переадресации 0
+// возвращает код по умолчанию. Bcrypt не принимает пароли длиннее 72 байт.
+func (o original) validSettings() bool {
+	if o.Password != nil && len(*o.Password) > 72 {
+		return false
+	}
+
+	if o.MaxClicks != nil && *o.MaxClicks < 0 {
+		return false
+	}
+
+	return o.Redirect == nil || *o.Redirect == 0 || mod.ValidRedirect(*o.Redirect)
+}
+
+// settings возвращает параметры s, измененные запросом. Пароль хранится
+// только в виде bcrypt хеша.
+func (o original) settings(s mod.Settings) (mod.Settings, error) {
+	hash, err := o.passwordHash()
+
+	return o.apply(s, hash), err
+}
+
+// passwordHash возвращает bcrypt хеш пароля из запроса, пустой для пустого
+// или не заданного пароля.
+func (o original) passwordHash() (string, error) {
+	if o.Password == nil || *o.Password == "" {
+		return "", nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(*o.Password), bcrypt.DefaultCost)
+
+	return string(hash), err
+}
+
+// apply возвращает параметры s, измененные запросом, с хешем пароля hash.
+// Хеш считается заранее: apply вызывается внутри изменения хранилища.
+func (o original) apply(s mod.Settings, hash string) mod.Settings {
+	if o.Title != nil {
+		s.Title = *o.Title
+	}
+
+	if o.Preview != nil {
+		s.Preview = *o.Preview
+	}
+
+	if o.Redirect != nil {
+		s.Redirect = *o.Redirect
+	}
+
+	if o.MaxClicks != nil {
+		s.MaxClicks = *o.MaxClicks
+	}
+
+	if o.Password != nil {
+		s.PasswordHash = hash
+	}
+
+	return s
+}
+
+// qrURL возвращает адрес QR кода короткой ссылки.
+func (c *Controller) qrURL(id string) string {
+	return "http://" + c.sConf.ServerAddress + c.sConf.BaseURL + id + "/qr"
 }
 
 func (c *Controller) Post(w http.ResponseWriter, r *http.Request) {
@@ -223,10 +759,8 @@ func (c *Controller) Post(w http.ResponseWriter, r *http.Request) {
 
 	uid := fmt.Sprintf("%v", r.Context().Value(identification))
 
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Print("POST: read all err: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	b, ok := c.readBody(w, r, "POST")
+	if !ok {
 		return
 	}
 
@@ -235,9 +769,13 @@ func (c *Controller) Post(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !c.checkURL(w, string(b)) {
+		return
+	}
+
 	var status = http.StatusCreated
 
-	id, err := c.storage.Add(string(b), uid)
+	id, err := c.storage.Add(string(b), uid, mod.Settings{})
 
 	if err != nil {
 		if !strings.Contains(err.Error(), "url conflict") {
@@ -265,10 +803,8 @@ func (c *Controller) Shorten(w http.ResponseWriter, r *http.Request) {
 
 	uid := fmt.Sprintf("%v", r.Context().Value(identification))
 
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Print("SHORTEN: read all err: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	b, ok := c.readBody(w, r, "SHORTEN")
+	if !ok {
 		return
 	}
 
@@ -279,16 +815,34 @@ func (c *Controller) Shorten(w http.ResponseWriter, r *http.Request) {
 
 	url := original{}
 
-	err = json.Unmarshal(b, &url)
+	err := json.Unmarshal(b, &url)
 	if err != nil {
 		log.Print("SHORTEN: json unmarshal err: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if !c.checkURL(w, url.URL) {
+		return
+	}
+
+	if !url.validSettings() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	settings, err := url.settings(mod.Settings{})
+	if err != nil {
+		log.Print("SHORTEN: settings err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	var status = http.StatusCreated
 
-	id, err := c.storage.Add(url.URL, uid)
+	// Параметры задаются только новой ссылке вместе с ее созданием,
+	// существующая могла быть сокращена другим пользователем.
+	id, err := c.storage.Add(url.URL, uid, settings)
 	if err != nil {
 		if !strings.Contains(err.Error(), "url conflict") {
 			log.Printf("add: %s, user: %s, id: %s, url: %s", err, uid, id, url.URL)
@@ -299,11 +853,30 @@ func (c *Controller) Shorten(w http.ResponseWriter, r *http.Request) {
 		status = http.StatusConflict
 	}
 
+	// Существующую ссылку нельзя отдать вместо ссылки с паролем: она
+	// открывается без него.
+	if status == http.StatusConflict && settings.PasswordHash != "" {
+		log.Printf("add: %d, user: %s, id: %s, url: %s, protected", status, uid, id, url.URL)
+		w.WriteHeader(status)
+
+		marshal, err := json.Marshal(errorResponse{Error: "url is already shortened without this password"})
+		if err != nil {
+			log.Print("SHORTEN: json marshal err: ", err)
+			return
+		}
+
+		if _, err = w.Write(marshal); err != nil {
+			log.Print("SHORTEN: write err: ", err)
+		}
+		return
+	}
+
 	log.Printf("add: %d, user: %s, id: %s, url: %s", status, uid, id, url.URL)
 	w.WriteHeader(status)
 
 	marshal, err := json.Marshal(short{
 		Result: "http://" + c.sConf.ServerAddress + c.sConf.BaseURL + id,
+		QRURL:  c.qrURL(id),
 	})
 	if err != nil {
 		log.Print("SHORTEN: json marshal err: ", err)
@@ -324,10 +897,8 @@ func (c *Controller) BatchAdd(w http.ResponseWriter, r *http.Request) {
 
 	uid := fmt.Sprintf("%v", r.Context().Value(identification))
 
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Print("BATCH ADD: read all err: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	b, ok := c.readBody(w, r, "BATCH ADD")
+	if !ok {
 		return
 	}
 
@@ -338,22 +909,60 @@ func (c *Controller) BatchAdd(w http.ResponseWriter, r *http.Request) {
 
 	var bOriginal []BatchOriginal
 
-	err = json.Unmarshal(b, &bOriginal)
+	err := json.Unmarshal(b, &bOriginal)
 	if err != nil {
 		log.Print("BATCH ADD: json unmarshal err: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	var urls []string
-
-	for _, i := range bOriginal {
-		urls = append(urls, i.URL)
+	if !c.checkBatch(w, len(bOriginal)) {
+		return
 	}
 
-	id, err := c.storage.BatchAdd(urls, uid)
+	// При atomic=true пакет с хотя бы одной неверной ссылкой отклоняется целиком.
+	atomic, err := parseBool(r, "atomic")
 	if err != nil {
-		if strings.Contains(err.Error(), "the storage is empty or the element is missing") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	bShort := make([]BatchShort, len(bOriginal))
+	var urls []string
+	var valid []int
+	var invalid int
+
+	for i, item := range bOriginal {
+		bShort[i].ID = item.ID
+
+		if reason := c.invalidURL(item.URL); reason != "" {
+			bShort[i].Status, bShort[i].Error = BatchInvalid, reason
+			invalid++
+			continue
+		}
+
+		urls = append(urls, item.URL)
+		valid = append(valid, i)
+	}
+
+	if atomic && invalid > 0 {
+		for _, i := range valid {
+			bShort[i].Status = BatchSkipped
+		}
+
+		log.Printf("batchAdd: %d, user: %s, invalid: %d, urls: %s", http.StatusBadRequest, uid, invalid, urls)
+		writeBatch(w, http.StatusBadRequest, bShort)
+		return
+	}
+
+	var id []string
+	if len(urls) > 0 {
+		id, err = c.storage.BatchAdd(urls, uid)
+	}
+
+	var conflict *mod.BatchConflictError
+	if err != nil && !errors.As(err, &conflict) {
+		if errors.Is(err, mod.ErrStorageIsNil) {
 			log.Printf("batchAdd: %d, user: %s, ids: %s, urls: %s", http.StatusBadRequest, uid, id, urls)
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -364,17 +973,68 @@ func (c *Controller) BatchAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("batchAdd: true, user: %s, ids: %s, urls: %s", uid, id, urls)
-
-	bShort := make([]BatchShort, len(id))
+	exists := make(map[int]bool)
+	if conflict != nil {
+		for _, i := range conflict.Exists {
+			exists[i] = true
+		}
+	}
 
-	for i := 0; i < len(id); i++ {
-		bShort[i] = BatchShort{
-			ID:  bOriginal[i].ID,
-			URL: "http://" + c.sConf.ServerAddress + c.sConf.BaseURL + id[i],
+	var created int
+	for j, i := range valid {
+		bShort[i].URL = "http://" + c.sConf.ServerAddress + c.sConf.BaseURL + id[j]
+		bShort[i].QRURL = c.qrURL(id[j])
+		bShort[i].Status = BatchCreated
+		if exists[j] {
+			bShort[i].Status = BatchExists
+		} else {
+			created++
 		}
 	}
 
+	// 201, если сокращена хоть одна ссылка, иначе 409, если ссылки уже были
+	// сокращены, иначе 400.
+	status := http.StatusCreated
+	switch {
+	case created > 0:
+	case len(valid) > 0:
+		status = http.StatusConflict
+	default:
+		status = http.StatusBadRequest
+	}
+
+	log.Printf("batchAdd: %d, user: %s, ids: %s, urls: %s, created: %d, exists: %d, invalid: %d", status, uid, id, urls, created, len(exists), invalid)
+	writeBatch(w, status, bShort)
+}
+
+// parseBool читает логический параметр запроса, по умолчанию false.
+func parseBool(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(v)
+}
+
+// invalidURL возвращает причину, по которой ссылка не может быть сокращена,
+// или пустую строку. Ссылка должна быть абсолютной, со схемой и хостом.
+func (c *Controller) invalidURL(rawURL string) string {
+	switch {
+	case rawURL == "":
+		return "empty url"
+	case c.sConf.MaxURLLength > 0 && len(rawURL) > c.sConf.MaxURLLength:
+		return "url too long"
+	}
+
+	if u, err := url.Parse(rawURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return "invalid url"
+	}
+
+	return ""
+}
+
+func writeBatch(w http.ResponseWriter, status int, bShort []BatchShort) {
 	marshal, err := json.Marshal(bShort)
 	if err != nil {
 		log.Print("BATCH ADD: json marshal err: ", err)
@@ -382,14 +1042,262 @@ func (c *Controller) BatchAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(status)
 
 	_, err = w.Write(marshal)
 	if err != nil {
 		log.Print("BATCH ADD: write err: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// batchDecoder последовательно читает элементы пакета из JSON массива или NDJSON,
+// не загружая весь пакет в память.
+type batchDecoder struct {
+	dec   *json.Decoder
+	array bool
+}
+
+func newBatchDecoder(r io.Reader) (*batchDecoder, error) {
+	br := bufio.NewReader(r)
+
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return &batchDecoder{dec: json.NewDecoder(br)}, nil
+			}
+			return nil, err
+		}
+
+		if unicode.IsSpace(rune(b[0])) {
+			_, _ = br.ReadByte()
+			continue
+		}
+
+		d := &batchDecoder{dec: json.NewDecoder(br), array: b[0] == '['}
+		if d.array {
+			if _, err = d.dec.Token(); err != nil {
+				return nil, err
+			}
+		}
+
+		return d, nil
+	}
+}
+
+// Next возвращает следующий элемент пакета или io.EOF, когда элементы закончились.
+func (d *batchDecoder) Next() (BatchOriginal, error) {
+	var item BatchOriginal
+
+	if d.array && !d.dec.More() {
+		if _, err := d.dec.Token(); err != nil {
+			return item, err
+		}
+		return item, io.EOF
+	}
+
+	err := d.dec.Decode(&item)
+	return item, err
+}
+
+// BatchStream сокращает ссылки из потока (JSON массив или NDJSON) частями по
+// MaxBatchSize и сразу отдает результаты в формате NDJSON в порядке элементов.
+func (c *Controller) BatchStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	uid := fmt.Sprintf("%v", r.Context().Value(identification))
+
+	limitBody(w, r, c.sConf.MaxStreamBodySize, c.sConf.MaxStreamDecompressedSize)
+
+	dec, err := newBatchDecoder(r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeTooLarge(w, "request body too large", maxErr.Limit)
+			return
+		}
+
+		log.Print("BATCH STREAM: new decoder err: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	chunkSize := c.sConf.MaxBatchSize
+	if chunkSize <= 0 {
+		chunkSize = 1000
+	}
+
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	// chunk - элементы текущей части, results - их результаты в том же
+	// порядке. Неверные ссылки получают результат сразу.
+	chunk := make([]BatchOriginal, 0, chunkSize)
+	results := make([]BatchShort, 0, chunkSize)
+	var started bool
+	var total int
+
+	flush := func() bool {
+		var urls []string
+		var pos []int
+		for i := range results {
+			if results[i].Status == "" {
+				urls = append(urls, chunk[i].URL)
+				pos = append(pos, i)
+			}
+		}
+
+		var ids []string
+		if len(urls) > 0 {
+			ids, err = c.storage.BatchAdd(urls, uid)
+
+			var conflict *mod.BatchConflictError
+			if err != nil && !errors.As(err, &conflict) {
+				log.Printf("batchStream: %s, user: %s, urls: %d", err, uid, len(urls))
+				if !started {
+					w.WriteHeader(http.StatusInternalServerError)
+				} else {
+					_ = enc.Encode(BatchShort{Error: "storage error"})
+				}
+				return false
+			}
+
+			exists := make(map[int]bool)
+			if conflict != nil {
+				for _, j := range conflict.Exists {
+					exists[j] = true
+				}
+			}
+
+			for j, i := range pos {
+				results[i].URL = "http://" + c.sConf.ServerAddress + c.sConf.BaseURL + ids[j]
+				results[i].QRURL = c.qrURL(ids[j])
+				results[i].Status = BatchCreated
+				if exists[j] {
+					results[i].Status = BatchExists
+				}
+			}
+		}
+
+		if !started {
+			w.WriteHeader(http.StatusCreated)
+			started = true
+		}
+
+		for _, res := range results {
+			if err = enc.Encode(res); err != nil {
+				log.Print("BATCH STREAM: write err: ", err)
+				return false
+			}
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		total += len(ids)
+		chunk = chunk[:0]
+		results = results[:0]
+		return true
+	}
+
+	for {
+		item, err := dec.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if !started && errors.As(err, &maxErr) {
+				writeTooLarge(w, "request body too large", maxErr.Limit)
+				return
+			}
+
+			log.Print("BATCH STREAM: decode err: ", err)
+			if !started && len(chunk) == 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if !flush() {
+				return
+			}
+			_ = enc.Encode(BatchShort{Status: BatchInvalid, Error: "invalid batch entry: " + err.Error()})
+			return
+		}
+
+		res := BatchShort{ID: item.ID}
+		if reason := c.invalidURL(item.URL); reason != "" {
+			res.Status, res.Error = BatchInvalid, reason
+		}
+
+		chunk = append(chunk, item)
+		results = append(results, res)
+		if len(chunk) == chunkSize && !flush() {
+			return
+		}
+	}
+
+	if !flush() {
 		return
 	}
+
+	log.Printf("batchStream: true, user: %s, urls: %d", uid, total)
+}
+
+// parseQuery разбирает параметры выборки ссылок: limit, cursor, q, host,
+// created_from, created_to (RFC3339) и sort (created, clicks, с "-" по убыванию).
+func parseQuery(values url.Values) (mod.Query, error) {
+	var q mod.Query
+	var err error
+
+	if v := values.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit: %s", v)
+		}
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		q.After, err = mod.ParseCursor(v)
+		if err != nil {
+			return q, err
+		}
+	}
+
+	q.Contains = values.Get("q")
+	q.Host = values.Get("host")
+
+	if v := values.Get("created_from"); v != "" {
+		q.CreatedFrom, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid created_from: %s", v)
+		}
+	}
+
+	if v := values.Get("created_to"); v != "" {
+		q.CreatedTo, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid created_to: %s", v)
+		}
+	}
+
+	sort := values.Get("sort")
+	if strings.HasPrefix(sort, "-") {
+		q.Desc = true
+		sort = sort[1:]
+	}
+
+	switch sort {
+	case "", mod.SortCreated:
+		q.Sort = mod.SortCreated
+	case mod.SortClicks:
+		q.Sort = mod.SortClicks
+	default:
+		return q, fmt.Errorf("invalid sort: %s", values.Get("sort"))
+	}
+
+	return q, nil
 }
 
 func (c *Controller) UserURLs(w http.ResponseWriter, r *http.Request) {
@@ -397,13 +1305,28 @@ func (c *Controller) UserURLs(w http.ResponseWriter, r *http.Request) {
 
 	uid := fmt.Sprintf("%v", r.Context().Value(identification))
 
-	URLs, err := c.storage.GetAll(uid)
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		marshal, _ := json.Marshal(errorResponse{Error: err.Error()})
+		_, _ = w.Write(marshal)
+		return
+	}
+
+	URLs, next, err := c.storage.Find(uid, q)
 	if err != nil {
-		log.Print("UserURLs: GetAll err: ", err)
+		log.Print("UserURLs: Find err: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if next != nil {
+		values := r.URL.Query()
+		values.Set("cursor", next.String())
+		link := "http://" + strings.TrimSuffix(c.sConf.ServerAddress, "/") + r.URL.Path + "?" + values.Encode()
+		w.Header().Set("Link", "<"+link+`>; rel="next"`)
+	}
+
 	if len(URLs) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -424,51 +1347,897 @@ func (c *Controller) UserURLs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (c *Controller) Ping(w http.ResponseWriter, r *http.Request) {
+// writeStorageError отвечает статусом, соответствующим ошибке хранилища
+// при работе со ссылкой пользователя.
+func writeStorageError(w http.ResponseWriter, name string, err error) {
+	switch {
+	case errors.Is(err, mod.ErrStorageIsNil):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, mod.ErrForbidden):
+		w.WriteHeader(http.StatusForbidden)
+	case errors.Is(err, mod.ErrURLConflict):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		log.Print(name+": storage err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+type updatedURL struct {
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+	Title       string `json:"title,omitempty"`
+	Preview     bool   `json:"preview,omitempty"`
+	Redirect    int    `json:"redirect,omitempty"`
+	Protected   bool   `json:"protected,omitempty"`
+	MaxClicks   int    `json:"max_clicks,omitempty"`
+}
+
+// UpdateURL меняет ссылку, на которую ведет короткий код пользователя, или ее
+// параметры. Не заданные в запросе параметры не меняются. Адрес и параметры
+// меняются разными запросами: вместе они не применяются атомарно.
+func (c *Controller) UpdateURL(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	if c.db == nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	uid := fmt.Sprintf("%v", r.Context().Value(identification))
+	id := chi.URLParam(r, "id")
+
+	b, ok := c.readBody(w, r, "UPDATE")
+	if !ok {
+		return
+	}
+
+	var u original
+	// Запрос меняет либо адрес, либо параметры.
+	if err := json.Unmarshal(b, &u); err != nil || (u.URL == "") != u.configures() || !u.validSettings() {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err := c.storage.PingDB(r.Context())
+	res := updatedURL{
+		ShortURL:    "http://" + c.sConf.ServerAddress + c.sConf.BaseURL + id,
+		OriginalURL: u.URL,
+	}
+
+	if u.URL != "" {
+		if !c.checkURL(w, u.URL) {
+			return
+		}
+
+		if err := c.storage.Update(id, u.URL, uid); err != nil {
+			writeStorageError(w, "UPDATE", err)
+			return
+		}
+
+		log.Printf("update: user: %s, id: %s, url: %s", uid, id, u.URL)
+	}
+
+	if u.configures() {
+		hash, err := u.passwordHash()
+		if err != nil {
+			log.Print("UPDATE: password hash err: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var settings mod.Settings
+		err = c.storage.Configure(id, func(s *mod.Settings) error {
+			*s = u.apply(*s, hash)
+			settings = *s
+
+			return nil
+		}, uid)
+		if err != nil {
+			writeStorageError(w, "UPDATE", err)
+			return
+		}
+
+		// Адрес для ответа читается из хранилища мимо кеша.
+		link, err := storage.Base(c.storage).Link(id)
+		if err != nil {
+			writeStorageError(w, "UPDATE", err)
+			return
+		}
+
+		protected := settings.PasswordHash != ""
+		log.Printf("configure: user: %s, id: %s, title: %q, preview: %t, redirect: %d, protected: %t, max clicks: %d",
+			uid, id, settings.Title, settings.Preview, settings.Redirect, protected, settings.MaxClicks)
+
+		res.OriginalURL, res.Title, res.Preview, res.Redirect, res.Protected = link.URL, settings.Title, settings.Preview, settings.Redirect, protected
+		res.MaxClicks = settings.MaxClicks
+	}
+
+	marshal, err := json.Marshal(res)
 	if err != nil {
-		log.Print("PING: ping db err: ", err)
+		log.Print("UPDATE: json marshal err: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Print("UPDATE: write err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
-func (c *Controller) BatchUpdate(w http.ResponseWriter, r *http.Request) {
+// History отдает предыдущие ссылки короткого кода пользователя.
+func (c *Controller) History(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	uid := fmt.Sprintf("%v", r.Context().Value(identification))
 
-	b, err := io.ReadAll(r.Body)
+	history, err := c.storage.History(chi.URLParam(r, "id"), uid)
+	if err != nil {
+		writeStorageError(w, "HISTORY", err)
+		return
+	}
+
+	if history == nil {
+		history = []mod.Version{}
+	}
+
+	marshal, err := json.Marshal(history)
 	if err != nil {
-		log.Print("BATCH UPDATE: read all err: ", err)
+		log.Print("HISTORY: json marshal err: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if string(b) == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Print("HISTORY: write err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+}
 
-	var ids []string
+// ruleLink возвращает ссылку пользователя для работы с ее правилами. Ссылка
+// читается мимо кеша: в кеше нет владельца.
+func (c *Controller) ruleLink(w http.ResponseWriter, r *http.Request, name string) (mod.Event, bool) {
+	uid := fmt.Sprintf("%v", r.Context().Value(identification))
+
+	link, err := storage.Base(c.storage).Link(chi.URLParam(r, "id"))
+	switch {
+	case err != nil:
+	case link.Del:
+		err = mod.ErrStorageIsNil
+	case link.UserID != uid:
+		err = mod.ErrForbidden
+	}
 
-	err = json.Unmarshal(b, &ids)
 	if err != nil {
-		log.Print("BATCH UPDATE: json unmarshal err: ", err)
+		writeStorageError(w, name, err)
+		return mod.Event{}, false
+	}
+
+	return link, true
+}
+
+// Ошибки изменения правил внутри Configure.
+var (
+	errNoRule       = errors.New("rule not found")
+	errInvalidRules = errors.New("invalid rules")
+)
+
+// checkRules проверяет адреса правил из запроса. Ответ на ошибку уже
+// отправлен, если вернулось false.
+func (c *Controller) checkRules(w http.ResponseWriter, list []mod.Rule) bool {
+	for _, rule := range list {
+		if rule.URL == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+
+		if !c.checkURL(w, rule.URL) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// saveRules меняет правила ссылки функцией edit и сохраняет их, остальные
+// параметры ссылки не меняются. Правила читаются и сохраняются одним
+// изменением хранилища, поэтому одновременные правки не теряются. edit
+// может вызываться повторно и собирает список заново, а не меняет его на
+// месте: правила могут разделять память с хранилищем. Ответ на ошибку уже
+// отправлен, если вернулось false.
+func (c *Controller) saveRules(w http.ResponseWriter, r *http.Request, name string, edit func([]mod.Rule) ([]mod.Rule, error)) bool {
+	uid := fmt.Sprintf("%v", r.Context().Value(identification))
+	id := chi.URLParam(r, "id")
+
+	var n int
+	err := c.storage.Configure(id, func(s *mod.Settings) error {
+		list, err := edit(s.Rules)
+		if err != nil {
+			return err
+		}
+
+		if err = rules.Validate(list); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidRules, err)
+		}
+
+		if len(list) == 0 {
+			list = nil
+		}
+
+		s.Rules, n = list, len(list)
+
+		return nil
+	}, uid)
+
+	switch {
+	case errors.Is(err, errNoRule):
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	case errors.Is(err, errInvalidRules):
+		log.Print(name+": rules err: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	case err != nil:
+		writeStorageError(w, name, err)
+		return false
+	}
+
+	log.Printf("rules: user: %s, id: %s, rules: %d", uid, id, n)
+
+	return true
+}
+
+// ruleIndex возвращает индекс правила из пути запроса или -1.
+func ruleIndex(r *http.Request, list []mod.Rule) int {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "rule"))
+	if err != nil {
+		return -1
+	}
+
+	for i, rule := range list {
+		if rule.ID == ruleID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func writeRules(w http.ResponseWriter, name string, status int, v any) {
+	marshal, err := json.Marshal(v)
+	if err != nil {
+		log.Print(name+": json marshal err: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	c.storage.BatchUpdate(ids, uid)
+	w.WriteHeader(status)
+
+	if _, err = w.Write(marshal); err != nil {
+		log.Print(name+": write err: ", err)
+	}
+}
+
+// Rules отдает правила переадресации ссылки пользователя.
+func (c *Controller) Rules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	link, ok := c.ruleLink(w, r, "RULES")
+	if !ok {
+		return
+	}
+
+	if link.Rules == nil {
+		link.Rules = []mod.Rule{}
+	}
+
+	writeRules(w, "RULES", http.StatusOK, link.Rules)
+}
+
+// SetRules заменяет все правила ссылки пользователя. Правила получают ID по
+// порядку, пустой список удаляет правила.
+func (c *Controller) SetRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	b, ok := c.readBody(w, r, "SET RULES")
+	if !ok {
+		return
+	}
+
+	var list []mod.Rule
+	if err := json.Unmarshal(b, &list); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for i := range list {
+		list[i].ID = i + 1
+		rules.Normalize(&list[i])
+	}
+
+	if !c.checkRules(w, list) {
+		return
+	}
+
+	ok = c.saveRules(w, r, "SET RULES", func([]mod.Rule) ([]mod.Rule, error) {
+		return list, nil
+	})
+	if !ok {
+		return
+	}
+
+	if list == nil {
+		list = []mod.Rule{}
+	}
+
+	writeRules(w, "SET RULES", http.StatusOK, list)
+}
+
+// AddRule добавляет правило в конец правил ссылки пользователя.
+func (c *Controller) AddRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	b, ok := c.readBody(w, r, "ADD RULE")
+	if !ok {
+		return
+	}
+
+	var rule mod.Rule
+	if err := json.Unmarshal(b, &rule); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rules.Normalize(&rule)
+	if !c.checkRules(w, []mod.Rule{rule}) {
+		return
+	}
+
+	ok = c.saveRules(w, r, "ADD RULE", func(list []mod.Rule) ([]mod.Rule, error) {
+		rule.ID = 1
+		for _, v := range list {
+			if v.ID >= rule.ID {
+				rule.ID = v.ID + 1
+			}
+		}
+
+		return append(append([]mod.Rule(nil), list...), rule), nil
+	})
+	if !ok {
+		return
+	}
+
+	writeRules(w, "ADD RULE", http.StatusCreated, rule)
+}
+
+// UpdateRule заменяет правило ссылки пользователя, ID правила сохраняется.
+func (c *Controller) UpdateRule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	b, ok := c.readBody(w, r, "UPDATE RULE")
+	if !ok {
+		return
+	}
+
+	var rule mod.Rule
+	if err := json.Unmarshal(b, &rule); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rules.Normalize(&rule)
+	if !c.checkRules(w, []mod.Rule{rule}) {
+		return
+	}
+
+	ok = c.saveRules(w, r, "UPDATE RULE", func(list []mod.Rule) ([]mod.Rule, error) {
+		i := ruleIndex(r, list)
+		if i < 0 {
+			return nil, errNoRule
+		}
+
+		rule.ID = list[i].ID
+		list = append([]mod.Rule(nil), list...)
+		list[i] = rule
+
+		return list, nil
+	})
+	if !ok {
+		return
+	}
+
+	writeRules(w, "UPDATE RULE", http.StatusOK, rule)
+}
+
+// DeleteRule удаляет правило ссылки пользователя.
+func (c *Controller) DeleteRule(w http.ResponseWriter, r *http.Request) {
+	ok := c.saveRules(w, r, "DELETE RULE", func(list []mod.Rule) ([]mod.Rule, error) {
+		i := ruleIndex(r, list)
+		if i < 0 {
+			return nil, errNoRule
+		}
+
+		return append(append([]mod.Rule(nil), list[:i]...), list[i+1:]...), nil
+	})
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type trashURL struct {
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	DeletedAt   time.Time `json:"deleted_at"`
+	PurgeAt     time.Time `json:"purge_at"`
+}
+
+// Trash отдает удаленные ссылки пользователя, которые еще можно восстановить.
+func (c *Controller) Trash(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	uid := fmt.Sprintf("%v", r.Context().Value(identification))
+
+	URLs, err := c.storage.Trash(uid, time.Now().Add(-c.sConf.TrashRetention))
+	if err != nil {
+		log.Print("TRASH: storage err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(URLs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	trash := make([]trashURL, 0, len(URLs))
+	for _, u := range URLs {
+		trash = append(trash, trashURL{
+			ShortURL:    u.ShortURL,
+			OriginalURL: u.OriginalURL,
+			DeletedAt:   u.DeletedAt,
+			PurgeAt:     u.DeletedAt.Add(c.sConf.TrashRetention),
+		})
+	}
+
+	marshal, err := json.Marshal(trash)
+	if err != nil {
+		log.Print("TRASH: json marshal err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Print("TRASH: write err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// Restore восстанавливает удаленные ссылки пользователя, если они еще в
+// корзине, и отдает коды восстановленных ссылок.
+func (c *Controller) Restore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	uid := fmt.Sprintf("%v", r.Context().Value(identification))
+
+	b, ok := c.readBody(w, r, "RESTORE")
+	if !ok {
+		return
+	}
+
+	var ids []string
+	if err := json.Unmarshal(b, &ids); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !c.checkBatch(w, len(ids)) {
+		return
+	}
+
+	restored, err := c.storage.Restore(ids, uid, time.Now().Add(-c.sConf.TrashRetention))
+	if err != nil {
+		log.Print("RESTORE: storage err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("restore: user: %s, ids: %s, restored: %s", uid, ids, restored)
+
+	if restored == nil {
+		restored = []string{}
+	}
+
+	marshal, err := json.Marshal(restored)
+	if err != nil {
+		log.Print("RESTORE: json marshal err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Print("RESTORE: write err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+type (
+	importResult struct {
+		Line   int    `json:"line"`
+		ID     string `json:"correlation_id,omitempty"`
+		URL    string `json:"short_url,omitempty"`
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	exportURL struct {
+		ShortURL    string `json:"short_url"`
+		OriginalURL string `json:"original_url"`
+		Created     string `json:"created,omitempty"`
+		Deleted     bool   `json:"deleted"`
+	}
+)
+
+// ImportCSV добавляет ссылки пользователя из CSV со строками
+// original_url[,alias][,correlation_id]. Строка заголовка необязательна.
+func (c *Controller) ImportCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	uid := fmt.Sprintf("%v", r.Context().Value(identification))
+
+	limitBody(w, r, c.sConf.MaxStreamBodySize, c.sConf.MaxStreamDecompressedSize)
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var results []importResult
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				writeTooLarge(w, "request body too large", maxErr.Limit)
+				return
+			}
+
+			results = append(results, importResult{Line: line, Status: "invalid", Error: err.Error()})
+			break
+		}
+
+		if line == 1 && strings.EqualFold(record[0], "original_url") {
+			continue
+		}
 
-	w.WriteHeader(http.StatusAccepted)
+		res := importResult{Line: line}
+		if len(record) > 2 {
+			res.ID = record[2]
+		}
+
+		res.URL, res.Status, res.Error = c.importRecord(record, uid)
+		results = append(results, res)
+	}
+
+	log.Printf("import: user: %s, lines: %d", uid, len(results))
+
+	marshal, err := json.Marshal(results)
+	if err != nil {
+		log.Print("IMPORT: json marshal err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Print("IMPORT: write err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// importRecord добавляет одну строку импорта и возвращает короткую ссылку,
+// статус и текст ошибки.
+func (c *Controller) importRecord(record []string, uid string) (string, string, string) {
+	url := strings.TrimSpace(record[0])
+	if reason := c.invalidURL(url); reason != "" {
+		return "", "invalid", reason
+	}
+
+	var id string
+	var err error
+
+	if len(record) > 1 && record[1] != "" {
+		id, err = c.storage.AddAlias(url, record[1], uid)
+	} else {
+		id, err = c.storage.Add(url, uid, mod.Settings{})
+	}
+
+	switch {
+	case err == nil:
+		return "http://" + c.sConf.ServerAddress + c.sConf.BaseURL + id, "created", ""
+	case errors.Is(err, mod.ErrURLConflict):
+		return "http://" + c.sConf.ServerAddress + c.sConf.BaseURL + id, "exists", ""
+	case errors.Is(err, mod.ErrAliasConflict), errors.Is(err, mod.ErrInvalidAlias):
+		return "", "invalid", err.Error()
+	default:
+		log.Print("IMPORT: add err: ", err)
+		return "", "error", "storage error"
+	}
+}
+
+// Export отдает все ссылки пользователя, включая удаленные, в формате
+// csv, json или ndjson (параметр format, по умолчанию csv).
+func (c *Controller) Export(w http.ResponseWriter, r *http.Request) {
+	uid := fmt.Sprintf("%v", r.Context().Value(identification))
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	var write func(u exportURL) error
+	var finish func() error
+	start := func() error {
+		return nil
+	}
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		write = func(u exportURL) error {
+			return cw.Write([]string{u.ShortURL, u.OriginalURL, u.Created, strconv.FormatBool(u.Deleted)})
+		}
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+		start = func() error {
+			return cw.Write([]string{"short_url", "original_url", "created", "deleted"})
+		}
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		var n int
+		write = func(u exportURL) error {
+			sep := ","
+			if n == 0 {
+				sep = "["
+			}
+			n++
+
+			marshal, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+
+			_, err = w.Write(append([]byte(sep), marshal...))
+			return err
+		}
+		finish = func() error {
+			end := "]"
+			if n == 0 {
+				end = "[]"
+			}
+
+			_, err := w.Write([]byte(end))
+			return err
+		}
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(u exportURL) error {
+			return enc.Encode(u)
+		}
+		finish = func() error {
+			return nil
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	URLs, err := c.storage.GetAll(uid)
+	if err != nil {
+		log.Print("EXPORT: GetAll err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="urls.`+format+`"`)
+
+	if err = start(); err != nil {
+		log.Print("EXPORT: write err: ", err)
+		return
+	}
+
+	for _, u := range URLs {
+		e := exportURL{ShortURL: u.ShortURL, OriginalURL: u.OriginalURL, Deleted: u.Deleted}
+		if !u.Created.IsZero() {
+			e.Created = u.Created.UTC().Format(time.RFC3339)
+		}
+
+		if err = write(e); err != nil {
+			log.Print("EXPORT: write err: ", err)
+			return
+		}
+	}
+
+	if err = finish(); err != nil {
+		log.Print("EXPORT: write err: ", err)
+	}
+}
+
+// admin проверяет токен администратора. Без заданного токена админский API
+// выключен.
+func (c *Controller) admin(w http.ResponseWriter, r *http.Request) bool {
+	if c.sConf.AdminToken == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.sConf.AdminToken)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// Snapshot отдает снимок всех ссылок хранилища.
+func (c *Controller) Snapshot(w http.ResponseWriter, r *http.Request) {
+	if !c.admin(w, r) {
+		return
+	}
+
+	if _, ok := storage.As[storage.Exporter](c.storage); !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="snapshot-`+time.Now().UTC().Format("20060102T150405Z")+`.ndjson.gz"`)
+
+	t, err := snapshot.Write(w, c.storage)
+	if err != nil {
+		// Заголовки уже отправлены, клиент увидит оборванный снимок без
+		// итоговой записи.
+		log.Print("SNAPSHOT: write err: ", err)
+		return
+	}
+
+	log.Printf("snapshot: links: %d, checksum: %s", t.Count, t.Checksum)
+}
+
+type cacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// CacheStats отдает счетчики попаданий и промахов кеша ссылок.
+func (c *Controller) CacheStats(w http.ResponseWriter, r *http.Request) {
+	if !c.admin(w, r) {
+		return
+	}
+
+	reporter, ok := storage.As[storage.CacheReporter](c.storage)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	var stats cacheStats
+	stats.Hits, stats.Misses = reporter.Stats()
+
+	marshal, err := json.Marshal(stats)
+	if err != nil {
+		log.Print("CACHE STATS: json marshal err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err = w.Write(marshal); err != nil {
+		log.Print("CACHE STATS: write err: ", err)
+	}
+}
+
+func (c *Controller) Ping(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	pinger, ok := storage.As[storage.Pinger](c.storage)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err := pinger.PingDB(r.Context())
+	if err != nil {
+		log.Print("PING: ping db err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *Controller) BatchUpdate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	uid := fmt.Sprintf("%v", r.Context().Value(identification))
+
+	b, ok := c.readBody(w, r, "BATCH UPDATE")
+	if !ok {
+		return
+	}
+
+	if string(b) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var ids []string
+
+	err := json.Unmarshal(b, &ids)
+	if err != nil {
+		log.Print("BATCH UPDATE: json unmarshal err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !c.checkBatch(w, len(ids)) {
+		return
+	}
+
+	deleter, ok := storage.As[storage.Deleter](c.storage)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	wait, err := parseBool(r, "wait")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !wait {
+		deleter.BatchUpdate(ids, uid)
+
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// С wait=true ссылки удаляются сразу, а в ответе результат для каждого
+	// кода: deleted, not_found, forbidden или already_deleted.
+	res, err := deleter.Delete(ids, uid)
+	if err != nil {
+		log.Print("BATCH UPDATE: delete err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	marshal, err := json.Marshal(res)
+	if err != nil {
+		log.Print("BATCH UPDATE: json marshal err: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Print("BATCH UPDATE: write err: ", err)
+	}
 }
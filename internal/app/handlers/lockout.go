@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// lockout блокирует подбор паролей: после attempts неверных паролей подряд
+// ссылка закрывается на duration. Счетчики хранятся в памяти процесса и
+// заводятся только для ссылок с паролем.
+type lockout struct {
+	mu       sync.Mutex
+	attempts int
+	duration time.Duration
+	links    map[string]*failures
+}
+
+type failures struct {
+	count int
+	until time.Time // время снятия блокировки
+}
+
+// newLockout возвращает блокировку, attempts <= 0 ее отключает.
+func newLockout(attempts int, duration time.Duration) *lockout {
+	return &lockout{attempts: attempts, duration: duration, links: make(map[string]*failures)}
+}
+
+// attempt учитывает попытку ввода пароля ссылки id до его проверки, чтобы
+// одновременные запросы не превысили число попыток. Возвращает время до
+// снятия блокировки или 0, если пароль можно проверять.
+func (l *lockout) attempt(id string) time.Duration {
+	if l.attempts <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.links[id]
+	if !ok {
+		f = &failures{}
+		l.links[id] = f
+	}
+
+	if wait := time.Until(f.until); wait > 0 {
+		return wait
+	}
+
+	f.count++
+	if f.count >= l.attempts {
+		f.count, f.until = 0, time.Now().Add(l.duration)
+	}
+
+	return 0
+}
+
+// reset сбрасывает счетчик ссылки id после верного пароля.
+func (l *lockout) reset(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.links, id)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	mod "main/internal/app/storage/model"
+)
+
+// passTTL - сколько действует пропуск со страницы предпросмотра.
+const passTTL = 10 * time.Minute
+
+// passes подписывает пропуски для перехода со страницы предпросмотра.
+// Пропуск вида "срок.подпись" действует для одной ссылки до срока и
+// привязан к ее паролю: после смены пароля выданные пропуски не
+// принимаются.
+type passes struct {
+	key []byte
+	ttl time.Duration
+}
+
+// newPasses возвращает подпись пропусков ключом key. Пустой ключ заменяется
+// случайным, пропуски тогда не переживают перезапуск.
+func newPasses(key string, ttl time.Duration) *passes {
+	k := []byte(key)
+	if len(k) == 0 {
+		var err error
+		if k, err = generateRandom(sha256.Size); err != nil {
+			panic("passes: random key: " + err.Error())
+		}
+	}
+
+	return &passes{key: k, ttl: ttl}
+}
+
+// issue выдает пропуск для ссылки link.
+func (p *passes) issue(link mod.Event) string {
+	exp := strconv.FormatInt(time.Now().Add(p.ttl).Unix(), 36)
+
+	return exp + "." + p.sign(link, exp)
+}
+
+// valid проверяет пропуск для ссылки link.
+func (p *passes) valid(pass string, link mod.Event) bool {
+	exp, sig, ok := strings.Cut(pass, ".")
+	if !ok {
+		return false
+	}
+
+	unix, err := strconv.ParseInt(exp, 36, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(p.sign(link, exp)))
+}
+
+func (p *passes) sign(link mod.Event, exp string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(link.ShortID() + "\n" + link.PasswordHash + "\n" + exp))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
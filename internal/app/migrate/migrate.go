@@ -0,0 +1,298 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+
+	"main/internal/app/config"
+	"main/internal/app/storage"
+	mod "main/internal/app/storage/model"
+)
+
+var (
+	ErrNotEmpty    = errors.New("destination storage is not empty")
+	ErrUnsupported = errors.New("storage does not support export or import")
+	ErrMismatch    = errors.New("verification failed")
+)
+
+// Options - параметры переноса.
+type Options struct {
+	// BatchSize - количество ссылок, переносимых за раз.
+	BatchSize int
+	// Checkpoint - файл с ID последней перенесенной ссылки. Если файл есть,
+	// перенос продолжается с него. Пустая строка отключает продолжение.
+	Checkpoint string
+	// Progress вызывается после каждой порции с числом перенесенных ссылок.
+	Progress func(copied int)
+}
+
+// Result - итог переноса.
+type Result struct {
+	// Copied - ссылки, перенесенные в этом запуске.
+	Copied int
+	// Count и Checksum - число и контрольная сумма ссылок в обоих хранилищах.
+	Count    int
+	Checksum string
+}
+
+// ParseTarget разбирает хранилище вида backend:адрес, например
+// file:/tmp/links.json или postgres:postgres://user@host/db.
+func ParseTarget(spec string) (config.Config, error) {
+	name, addr, _ := strings.Cut(spec, ":")
+
+	conf := config.Config{StorageBackend: name}
+	switch name {
+	case storage.Memory:
+	case storage.File:
+		conf.FileStoragePath = addr
+	case storage.Postgres:
+		conf.DataBaseDSN = addr
+	case storage.Redis:
+		conf.RedisAddr = addr
+	case storage.Embedded:
+		conf.EmbeddedPath = addr
+	default:
+		return conf, fmt.Errorf("unknown storage backend %q, available: %s", name, strings.Join(storage.Backends(), ", "))
+	}
+
+	if name != storage.Memory && addr == "" {
+		return conf, fmt.Errorf("storage %q requires an address: %s:<address>", name, name)
+	}
+
+	return conf, nil
+}
+
+// Open открывает исходное и целевое хранилища. Хранилища в общем состоянии
+// процесса открываются последними, чтобы их не сбросило открытие другого.
+func Open(from, to config.Config) (storage.Storage, storage.Storage, error) {
+	fromShared, toShared := storage.Shared(storage.Backend(from)), storage.Shared(storage.Backend(to))
+	if fromShared && toShared {
+		return nil, nil, errors.New("memory and file storages cannot be migrated into each other in one process")
+	}
+
+	var src, dst storage.Storage
+	var err error
+
+	if toShared {
+		if src, err = storage.Open(from); err != nil {
+			return nil, nil, fmt.Errorf("open source: %w", err)
+		}
+		if dst, err = storage.Open(to); err != nil {
+			return nil, nil, fmt.Errorf("open destination: %w", err)
+		}
+	} else {
+		if dst, err = storage.Open(to); err != nil {
+			return nil, nil, fmt.Errorf("open destination: %w", err)
+		}
+		if src, err = storage.Open(from); err != nil {
+			return nil, nil, fmt.Errorf("open source: %w", err)
+		}
+	}
+
+	return src, dst, nil
+}
+
+// Run переносит все ссылки из from в to с сохранением ID, кодов, владельцев
+// и удаления, затем сверяет число ссылок и контрольные суммы.
+func Run(from, to storage.Storage, opts Options) (Result, error) {
+	var res Result
+
+	src, ok := storage.As[storage.Exporter](from)
+	if !ok {
+		return res, fmt.Errorf("source: %w", ErrUnsupported)
+	}
+
+	dst, ok := storage.As[storage.Importer](to)
+	if !ok {
+		return res, fmt.Errorf("destination: %w", ErrUnsupported)
+	}
+
+	check, ok := storage.As[storage.Exporter](to)
+	if !ok {
+		return res, fmt.Errorf("destination: %w", ErrUnsupported)
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	after, resumed, err := readCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return res, err
+	}
+
+	if !resumed {
+		existing, err := check.Export(-1, 1)
+		if err != nil {
+			return res, err
+		}
+		if len(existing) > 0 {
+			return res, ErrNotEmpty
+		}
+	}
+
+	for {
+		events, err := src.Export(after, opts.BatchSize)
+		if err != nil {
+			return res, fmt.Errorf("export after %d: %w", after, err)
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		if err = dst.Import(events); err != nil {
+			return res, err
+		}
+
+		after = events[len(events)-1].ID
+		res.Copied += len(events)
+
+		if err = writeCheckpoint(opts.Checkpoint, after); err != nil {
+			return res, err
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(res.Copied)
+		}
+	}
+
+	last, err := src.LastID()
+	if err != nil {
+		return res, err
+	}
+
+	if err = dst.Reserve(last); err != nil {
+		return res, err
+	}
+
+	srcCount, srcSum, err := Sum(src, opts.BatchSize)
+	if err != nil {
+		return res, err
+	}
+
+	dstCount, dstSum, err := Sum(check, opts.BatchSize)
+	if err != nil {
+		return res, err
+	}
+
+	if srcCount != dstCount || srcSum != dstSum {
+		return res, fmt.Errorf("%w: source %d links %s, destination %d links %s", ErrMismatch, srcCount, srcSum, dstCount, dstSum)
+	}
+
+	res.Count, res.Checksum = srcCount, srcSum
+
+	if opts.Checkpoint != "" {
+		if err = os.Remove(opts.Checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// Sum возвращает число ссылок хранилища и их контрольную сумму.
+func Sum(s storage.Exporter, batch int) (int, string, error) {
+	sum := NewChecksum()
+	for after := -1; ; {
+		events, err := s.Export(after, batch)
+		if err != nil {
+			return 0, "", err
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		for _, e := range events {
+			sum.Add(e)
+		}
+
+		after = events[len(events)-1].ID
+	}
+
+	return sum.Count(), sum.String(), nil
+}
+
+// Checksum - контрольная сумма ID, кодов, адресов, владельцев, удаления,
+// переходов, истории и параметров ссылок. Время учитывается с точностью до микросекунды,
+// с которой его хранит Postgres.
+type Checksum struct {
+	h hash.Hash
+	n int
+}
+
+func NewChecksum() *Checksum {
+	return &Checksum{h: sha256.New()}
+}
+
+// Add добавляет ссылку к сумме. Ссылки добавляются в порядке ID.
+func (c *Checksum) Add(e mod.Event) {
+	var delAt int64
+	if e.Del {
+		delAt = e.DelAt.UnixMicro()
+	}
+
+	_, _ = fmt.Fprintf(c.h, "%d\t%s\t%s\t%s\t%t\t%d\t%d\t%d\n",
+		e.ID, e.Code, e.URL, e.UserID, e.Del, e.Clicks, e.Created.UnixMicro(), delAt)
+
+	for _, v := range e.History {
+		_, _ = fmt.Fprintf(c.h, "\t%s\t%d\n", v.URL, v.Replaced.UnixMicro())
+	}
+
+	// Параметры по умолчанию не меняют сумму, поэтому суммы снимков, снятых до
+	// появления параметров, остаются верными.
+	if settings, err := json.Marshal(e.Settings); err == nil && string(settings) != "{}" {
+		_, _ = fmt.Fprintf(c.h, "\t%s\n", settings)
+	}
+
+	c.n++
+}
+
+func (c *Checksum) Count() int {
+	return c.n
+}
+
+func (c *Checksum) String() string {
+	return hex.EncodeToString(c.h.Sum(nil))
+}
+
+func readCheckpoint(path string) (int, bool, error) {
+	if path == "" {
+		return -1, false, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return -1, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	id, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, false, fmt.Errorf("bad checkpoint %s: %w", path, err)
+	}
+
+	return id, true, nil
+}
+
+func writeCheckpoint(path string, id int) error {
+	if path == "" {
+		return nil
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(id)), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,181 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"main/internal/app/config"
+	"main/internal/app/storage"
+	mod "main/internal/app/storage/model"
+)
+
+// docs - параметры ссылки "3" в fill.
+var docs = mod.Settings{Title: "Docs", Preview: true, Redirect: 301, PasswordHash: "$2a$10$hash", MaxClicks: 3,
+	Rules: []mod.Rule{{ID: 1, URL: "https://apps.apple.com/docs", Platforms: []string{"ios"}, Countries: []string{"RU"}}}}
+
+// fill создает ссылки со всеми переносимыми данными: псевдонимом, переходами,
+// историей, параметрами, удалением и удаленной навсегда последней ссылкой.
+func fill(t *testing.T, s storage.Storage) {
+	_, err := s.BatchAdd([]string{"https://ya.ru/0", "https://ya.ru/1", "https://ya.ru/2", "https://ya.ru/3"}, "user")
+	require.NoError(t, err)
+
+	_, err = s.AddAlias("https://ya.ru/alias", "alias", "other")
+	require.NoError(t, err)
+
+	_, err = s.Add("https://ya.ru/purged", "user", mod.Settings{})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Click("0"))
+	require.NoError(t, s.Click("alias"))
+	require.NoError(t, s.Update("1", "https://ya.ru/edited", "user"))
+	require.NoError(t, s.Configure("3", func(v *mod.Settings) error {
+		*v = docs
+		return nil
+	}, "user"))
+
+	s.(storage.Deleter).BatchUpdate([]string{"2", "5"}, "user")
+	require.Eventually(t, func() bool {
+		trash, err := s.Trash("user", time.Time{})
+		return err == nil && len(trash) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = s.Restore([]string{"2"}, "user", time.Time{})
+	require.NoError(t, err)
+
+	n, err := s.Purge(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+
+	from, err := ParseTarget("file:" + filepath.Join(dir, "links.json"))
+	require.NoError(t, err)
+	to, err := ParseTarget("embedded:" + filepath.Join(dir, "shortener.db"))
+	require.NoError(t, err)
+	from.ServerAddress, to.ServerAddress = "localhost:8080/", "localhost:8080/"
+
+	src, dst, err := Open(from, to)
+	require.NoError(t, err)
+	defer src.(storage.Closer).Close()
+	defer dst.(storage.Closer).Close()
+
+	fill(t, src)
+
+	checkpoint := filepath.Join(dir, "checkpoint")
+	var progress []int
+	res, err := Run(src, dst, Options{
+		BatchSize:  2,
+		Checkpoint: checkpoint,
+		Progress:   func(n int) { progress = append(progress, n) },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 5, res.Copied)
+	assert.Equal(t, 5, res.Count)
+	assert.Equal(t, []int{2, 4, 5}, progress)
+	assert.NoFileExists(t, checkpoint)
+
+	url, del, err := dst.Get("alias")
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/alias", url)
+	assert.False(t, del)
+
+	url, _, err = dst.Get("1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/edited", url)
+
+	history, err := dst.History("1", "user")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "https://ya.ru/1", history[0].URL)
+
+	link, err := dst.Link("3")
+	require.NoError(t, err)
+	assert.Equal(t, docs, link.Settings)
+
+	_, err = dst.Restore([]string{"2"}, "user", time.Time{})
+	require.NoError(t, err)
+
+	// ID удаленной навсегда ссылки не выдается повторно.
+	id, err := dst.Add("https://ya.ru/new", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.Equal(t, "6", id)
+
+	server := miniredis.RunT(t)
+	redis, err := storage.Open(config.Config{StorageBackend: storage.Redis, RedisAddr: server.Addr(), ServerAddress: "localhost:8080/"})
+	require.NoError(t, err)
+	defer redis.(storage.Closer).Close()
+
+	res, err = Run(dst, redis, Options{BatchSize: 4})
+	require.NoError(t, err)
+	assert.Equal(t, 6, res.Count)
+
+	link, err = redis.Link("3")
+	require.NoError(t, err)
+	assert.Equal(t, docs, link.Settings)
+
+	_, err = Run(dst, redis, Options{})
+	assert.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestRunResume(t *testing.T) {
+	dir := t.TempDir()
+
+	src, dst, err := Open(
+		config.Config{StorageBackend: storage.Embedded, EmbeddedPath: filepath.Join(dir, "shortener.db")},
+		config.Config{StorageBackend: storage.Memory},
+	)
+	require.NoError(t, err)
+	defer src.(storage.Closer).Close()
+
+	_, err = src.BatchAdd([]string{"https://ya.ru/0", "https://ya.ru/1", "https://ya.ru/2"}, "user")
+	require.NoError(t, err)
+
+	// Первая ссылка уже перенесена прерванным запуском.
+	events, err := src.(storage.Exporter).Export(-1, 1)
+	require.NoError(t, err)
+	require.NoError(t, dst.(storage.Importer).Import(events))
+
+	checkpoint := filepath.Join(dir, "checkpoint")
+	require.NoError(t, os.WriteFile(checkpoint, []byte("0"), 0600))
+
+	res, err := Run(src, dst, Options{Checkpoint: checkpoint})
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Copied)
+	assert.Equal(t, 3, res.Count)
+
+	count, sum, err := Sum(dst.(storage.Exporter), 1)
+	require.NoError(t, err)
+	assert.Equal(t, res.Count, count)
+	assert.Equal(t, res.Checksum, sum)
+
+	url, _, err := dst.Get("2")
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/2", url)
+}
+
+func TestParseTarget(t *testing.T) {
+	conf, err := ParseTarget("postgres:postgres://user@localhost/db")
+	require.NoError(t, err)
+	assert.Equal(t, storage.Postgres, conf.StorageBackend)
+	assert.Equal(t, "postgres://user@localhost/db", conf.DataBaseDSN)
+
+	_, err = ParseTarget("memory")
+	assert.NoError(t, err)
+
+	_, err = ParseTarget("file")
+	assert.Error(t, err)
+
+	_, err = ParseTarget("mysql:localhost")
+	assert.Error(t, err)
+
+	_, _, err = Open(config.Config{StorageBackend: storage.Memory}, config.Config{StorageBackend: storage.File, FileStoragePath: "links.json"})
+	assert.Error(t, err)
+}
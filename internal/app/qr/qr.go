@@ -0,0 +1,167 @@
+// Package qr рисует QR коды коротких ссылок в PNG и SVG.
+package qr
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// Форматы изображения.
+const (
+	PNG = "png"
+	SVG = "svg"
+)
+
+// Ограничения параметров изображения.
+const (
+	MaxSize   = 2048
+	MaxMargin = 16
+)
+
+var (
+	ErrFormat = errors.New("unsupported qr format")
+	ErrLevel  = errors.New("unsupported qr error correction level")
+	ErrSize   = errors.New("qr size out of range")
+	ErrMargin = errors.New("qr margin out of range")
+)
+
+var levels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// Options - параметры изображения.
+type Options struct {
+	Size   int    // сторона изображения в пикселях
+	Format string // PNG или SVG
+	Level  string // уровень коррекции ошибок: L, M, Q или H
+	Margin int    // ширина пустого поля в модулях
+}
+
+// Validate проверяет параметры и приводит уровень коррекции к верхнему регистру.
+func (o *Options) Validate() error {
+	o.Format = strings.ToLower(o.Format)
+	if o.Format != PNG && o.Format != SVG {
+		return fmt.Errorf("%w: %q", ErrFormat, o.Format)
+	}
+
+	o.Level = strings.ToUpper(o.Level)
+	if _, ok := levels[o.Level]; !ok {
+		return fmt.Errorf("%w: %q", ErrLevel, o.Level)
+	}
+
+	if o.Size <= 0 || o.Size > MaxSize {
+		return fmt.Errorf("%w: %d", ErrSize, o.Size)
+	}
+
+	if o.Margin < 0 || o.Margin > MaxMargin {
+		return fmt.Errorf("%w: %d", ErrMargin, o.Margin)
+	}
+
+	return nil
+}
+
+// ContentType возвращает тип содержимого изображения.
+func (o Options) ContentType() string {
+	if o.Format == SVG {
+		return "image/svg+xml"
+	}
+
+	return "image/png"
+}
+
+// ETag возвращает тег изображения content с параметрами o. Изображение
+// однозначно определяется ими, поэтому тег считается без его отрисовки.
+func (o Options) ETag(content string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s\x00%d", content, o.Format, o.Size, o.Level, o.Margin)))
+
+	return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+// Encode рисует QR код content в w. Параметры должны пройти Validate.
+// Если в Size не помещается по пикселю на модуль, возвращает ErrSize.
+func Encode(w io.Writer, content string, o Options) error {
+	code, err := qrcode.New(content, levels[o.Level])
+	if err != nil {
+		return err
+	}
+
+	// Поле добавляется само, чтобы его ширину можно было задать.
+	code.DisableBorder = true
+	bitmap := code.Bitmap()
+
+	total := len(bitmap) + 2*o.Margin
+	if o.Size < total {
+		return fmt.Errorf("%w: %d, at least %d", ErrSize, o.Size, total)
+	}
+
+	if o.Format == SVG {
+		return writeSVG(w, bitmap, total, o)
+	}
+
+	return writePNG(w, bitmap, total, o)
+}
+
+// writePNG рисует модули целым числом пикселей, остаток делится поровну
+// между краями.
+func writePNG(w io.Writer, bitmap [][]bool, total int, o Options) error {
+	scale := o.Size / total
+	offset := (o.Size-scale*total)/2 + o.Margin*scale
+
+	img := image.NewPaletted(image.Rect(0, 0, o.Size, o.Size), color.Palette{color.White, color.Black})
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	return png.Encode(w, img)
+}
+
+// writeSVG рисует модули одним путем в координатах модулей, по отрезку
+// на каждую серию темных модулей в строке.
+func writeSVG(w io.Writer, bitmap [][]bool, total int, o Options) error {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x := 0; x < len(row); {
+			if !row[x] {
+				x++
+				continue
+			}
+
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start+o.Margin, y+o.Margin, x-start, x-start)
+		}
+	}
+
+	_, err := fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">
+<rect width="%d" height="%d" fill="#fff"/>
+<path fill="#000" d="%s"/>
+</svg>
+`, o.Size, o.Size, total, total, total, total, path.String())
+
+	return err
+}
@@ -0,0 +1,93 @@
+package qr
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/skip2/go-qrcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const content = "http://localhost:8080/abc"
+
+func TestEncodePNG(t *testing.T) {
+	o := Options{Size: 256, Format: "PNG", Level: "m", Margin: 4}
+	require.NoError(t, o.Validate())
+
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, content, o))
+
+	img, err := png.Decode(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 256, img.Bounds().Dx())
+	assert.Equal(t, 256, img.Bounds().Dy())
+
+	code, err := qrcode.New(content, qrcode.Medium)
+	require.NoError(t, err)
+	code.DisableBorder = true
+
+	// Модули рисуются целым числом пикселей, остаток делится поровну между
+	// краями, поэтому поисковый узор начинается после поля и половины остатка.
+	total := len(code.Bitmap()) + 2*o.Margin
+	scale := 256 / total
+	corner := (256-scale*total)/2 + o.Margin*scale
+
+	black := color.GrayModel.Convert(color.Black)
+	assert.NotEqual(t, black, color.GrayModel.Convert(img.At(corner-1, corner-1)))
+	assert.Equal(t, black, color.GrayModel.Convert(img.At(corner, corner)))
+}
+
+func TestEncodeSVG(t *testing.T) {
+	o := Options{Size: 100, Format: SVG, Level: "H", Margin: 0}
+	require.NoError(t, o.Validate())
+
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, content, o))
+
+	svg := buf.String()
+	assert.True(t, strings.HasPrefix(svg, "<?xml"))
+	assert.Contains(t, svg, `width="100" height="100"`)
+	// Левый верхний поисковый узор начинается с отрезка в семь модулей.
+	assert.Contains(t, svg, `d="M0 0h7v1h-7z`)
+}
+
+func TestEncodeTooSmall(t *testing.T) {
+	o := Options{Size: 20, Format: PNG, Level: "L", Margin: 4}
+	require.NoError(t, o.Validate())
+
+	assert.ErrorIs(t, Encode(&bytes.Buffer{}, content, o), ErrSize)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Options
+		err  error
+	}{
+		{name: "format", o: Options{Size: 256, Format: "gif", Level: "M"}, err: ErrFormat},
+		{name: "level", o: Options{Size: 256, Format: PNG, Level: "X"}, err: ErrLevel},
+		{name: "zero size", o: Options{Format: PNG, Level: "M"}, err: ErrSize},
+		{name: "large size", o: Options{Size: MaxSize + 1, Format: PNG, Level: "M"}, err: ErrSize},
+		{name: "margin", o: Options{Size: 256, Format: PNG, Level: "M", Margin: -1}, err: ErrMargin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, tt.o.Validate(), tt.err)
+		})
+	}
+}
+
+func TestETag(t *testing.T) {
+	o := Options{Size: 256, Format: PNG, Level: "M", Margin: 4}
+
+	assert.Equal(t, o.ETag(content), o.ETag(content))
+	assert.NotEqual(t, o.ETag(content), o.ETag(content+"d"))
+
+	other := o
+	other.Margin = 2
+	assert.NotEqual(t, o.ETag(content), other.ETag(content))
+}
@@ -0,0 +1,127 @@
+package rules
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GeoIP определяет страну по IP адресу. База - CSV файл с диапазонами
+// адресов вида "начало,конец,страна", как в базе IP to Country Lite от db-ip.com.
+type GeoIP struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// OpenGeoIP загружает базу из файла path.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	geo, err := LoadGeoIP(file)
+	if err != nil {
+		return nil, fmt.Errorf("geoip %s: %w", path, err)
+	}
+
+	return geo, nil
+}
+
+// LoadGeoIP читает базу из r. Первая строка может быть заголовком, диапазоны
+// без страны или со страной ZZ пропускаются.
+func LoadGeoIP(r io.Reader) (*GeoIP, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	geo := &GeoIP{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: want start,end,country", line)
+		}
+
+		start, err := netip.ParseAddr(strings.TrimSpace(record[0]))
+		if err != nil && line == 1 {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		end, err := netip.ParseAddr(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		start, end = start.Unmap(), end.Unmap()
+		if start.BitLen() != end.BitLen() || end.Less(start) {
+			return nil, fmt.Errorf("line %d: bad range %s-%s", line, start, end)
+		}
+
+		country := strings.ToUpper(strings.TrimSpace(record[2]))
+		if country == "" || country == "ZZ" || country == "-" {
+			continue
+		}
+
+		geo.ranges = append(geo.ranges, ipRange{start: start, end: end, country: country})
+	}
+
+	sort.Slice(geo.ranges, func(i, j int) bool {
+		return geo.ranges[i].start.Less(geo.ranges[j].start)
+	})
+
+	return geo, nil
+}
+
+// Country возвращает код страны адреса или пустую строку, если адреса нет
+// в базе. Работает и на nil базе.
+func (g *GeoIP) Country(addr netip.Addr) string {
+	if g == nil {
+		return ""
+	}
+
+	addr = addr.Unmap()
+
+	// Последний диапазон, начинающийся не позже адреса.
+	i := sort.Search(len(g.ranges), func(i int) bool {
+		return addr.Less(g.ranges[i].start)
+	}) - 1
+	if i < 0 {
+		return ""
+	}
+
+	if r := g.ranges[i]; !r.end.Less(addr) && r.end.BitLen() == addr.BitLen() {
+		return r.country
+	}
+
+	return ""
+}
+
+// Len возвращает число диапазонов в базе.
+func (g *GeoIP) Len() int {
+	if g == nil {
+		return 0
+	}
+
+	return len(g.ranges)
+}
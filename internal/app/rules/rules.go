@@ -0,0 +1,238 @@
+// Package rules выбирает адрес перехода по правилам ссылки: платформе из
+// User-Agent, языкам из Accept-Language, стране по базе GeoIP и времени.
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mod "main/internal/app/storage/model"
+)
+
+// Платформы User-Agent.
+const (
+	IOS     = "ios"
+	Android = "android"
+	Windows = "windows"
+	MacOS   = "macos"
+	Linux   = "linux"
+)
+
+// MaxRules - наибольшее число правил ссылки.
+const MaxRules = 20
+
+var (
+	ErrTooMany  = errors.New("too many rules")
+	ErrPlatform = errors.New("unknown platform")
+	ErrLanguage = errors.New("invalid language")
+	ErrCountry  = errors.New("invalid country")
+	ErrWindow   = errors.New("rule ends before it starts")
+)
+
+var (
+	languageRe = regexp.MustCompile(`^[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*$`)
+	countryRe  = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// Request - свойства запроса, по которым проверяются правила.
+type Request struct {
+	Platform  string
+	Languages []string // в порядке предпочтения
+	Country   string   // пустая, если страна не определена
+	Time      time.Time
+}
+
+// NewRequest собирает свойства запроса r. Страна определяется по адресу
+// клиента в geo, nil geo страну не определяет.
+func NewRequest(r *http.Request, geo *GeoIP, now time.Time) Request {
+	req := Request{
+		Platform:  Platform(r.UserAgent()),
+		Languages: Languages(r.Header.Get("Accept-Language")),
+		Time:      now,
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		req.Country = geo.Country(addr)
+	}
+
+	return req
+}
+
+// Platform определяет платформу по User-Agent, неизвестная платформа -
+// пустая строка. iPadOS в режиме компьютера не отличить от macOS.
+func Platform(ua string) string {
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		return IOS
+	case strings.Contains(ua, "Android"):
+		return Android
+	case strings.Contains(ua, "Windows"):
+		return Windows
+	case strings.Contains(ua, "Macintosh"), strings.Contains(ua, "Mac OS X"):
+		return MacOS
+	case strings.Contains(ua, "Linux"), strings.Contains(ua, "X11"):
+		return Linux
+	}
+
+	return ""
+}
+
+// Languages возвращает языки из Accept-Language в порядке убывания веса без
+// языков с весом 0 и "*".
+func Languages(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err != nil {
+				continue
+			}
+		}
+
+		if tag = strings.TrimSpace(tag); tag == "" || tag == "*" || q <= 0 {
+			continue
+		}
+
+		langs = append(langs, weighted{tag: tag, q: q})
+	}
+
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+
+	res := make([]string, 0, len(langs))
+	for _, l := range langs {
+		res = append(res, l.tag)
+	}
+
+	return res
+}
+
+// Select возвращает адрес первого подходящего под запрос правила.
+func Select(rules []mod.Rule, req Request) (string, bool) {
+	for _, rule := range rules {
+		if Match(rule, req) {
+			return rule.URL, true
+		}
+	}
+
+	return "", false
+}
+
+// Match сообщает, подходит ли запрос под все условия правила.
+func Match(rule mod.Rule, req Request) bool {
+	if rule.From != nil && req.Time.Before(*rule.From) {
+		return false
+	}
+
+	if rule.Until != nil && !req.Time.Before(*rule.Until) {
+		return false
+	}
+
+	if len(rule.Platforms) > 0 && !contains(rule.Platforms, req.Platform) {
+		return false
+	}
+
+	if len(rule.Countries) > 0 && !contains(rule.Countries, req.Country) {
+		return false
+	}
+
+	if len(rule.Languages) > 0 && !matchLanguage(rule.Languages, req.Languages) {
+		return false
+	}
+
+	return true
+}
+
+// matchLanguage сравнивает языки без учета регистра. Язык правила без
+// региона подходит для всех его регионов: en подходит для en-US.
+func matchLanguage(want, langs []string) bool {
+	for _, lang := range langs {
+		for _, w := range want {
+			if strings.EqualFold(lang, w) || (len(lang) > len(w) && lang[len(w)] == '-' && strings.EqualFold(lang[:len(w)], w)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Normalize приводит платформы правила к нижнему регистру, а страны к
+// верхнему.
+func Normalize(rule *mod.Rule) {
+	for i, p := range rule.Platforms {
+		rule.Platforms[i] = strings.ToLower(p)
+	}
+
+	for i, c := range rule.Countries {
+		rule.Countries[i] = strings.ToUpper(c)
+	}
+}
+
+// Validate проверяет условия правил, прошедших Normalize. Адреса правил
+// проверяет вызывающий.
+func Validate(rules []mod.Rule) error {
+	if len(rules) > MaxRules {
+		return fmt.Errorf("%w: %d, at most %d", ErrTooMany, len(rules), MaxRules)
+	}
+
+	for _, rule := range rules {
+		for _, p := range rule.Platforms {
+			switch p {
+			case IOS, Android, Windows, MacOS, Linux:
+			default:
+				return fmt.Errorf("%w: %q", ErrPlatform, p)
+			}
+		}
+
+		for _, l := range rule.Languages {
+			if !languageRe.MatchString(l) {
+				return fmt.Errorf("%w: %q", ErrLanguage, l)
+			}
+		}
+
+		for _, c := range rule.Countries {
+			if !countryRe.MatchString(c) {
+				return fmt.Errorf("%w: %q", ErrCountry, c)
+			}
+		}
+
+		if rule.From != nil && rule.Until != nil && !rule.From.Before(*rule.Until) {
+			return ErrWindow
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package rules
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	mod "main/internal/app/storage/model"
+)
+
+func TestPlatform(t *testing.T) {
+	tests := map[string]string{
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15":     IOS,
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile": Android,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0":       Windows,
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0) AppleWebKit/605.1.15 Version/17.0":  MacOS,
+		"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0":  Linux,
+		"curl/8.4.0": "",
+	}
+	for ua, platform := range tests {
+		assert.Equal(t, platform, Platform(ua), ua)
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	assert.Equal(t, []string{"ru-RU", "ru", "en"}, Languages("en;q=0.5, ru-RU, ru;q=0.9, *;q=0.1, de;q=0"))
+	assert.Equal(t, []string{}, Languages(""))
+}
+
+func TestSelect(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := from.Add(24 * time.Hour)
+
+	list := []mod.Rule{
+		{ID: 1, URL: "https://apps.apple.com/app", Platforms: []string{IOS}},
+		{ID: 2, URL: "https://play.google.com/app", Platforms: []string{Android}, Countries: []string{"RU", "KZ"}},
+		{ID: 3, URL: "https://ya.ru/en", Languages: []string{"en"}, From: &from, Until: &until},
+	}
+
+	tests := []struct {
+		name string
+		req  Request
+		url  string
+	}{
+		{name: "platform", req: Request{Platform: IOS}, url: "https://apps.apple.com/app"},
+		{name: "platform and country", req: Request{Platform: Android, Country: "KZ"}, url: "https://play.google.com/app"},
+		{name: "other country", req: Request{Platform: Android, Country: "DE"}},
+		{name: "language region", req: Request{Languages: []string{"EN-us"}, Time: from.Add(time.Hour)}, url: "https://ya.ru/en"},
+		{name: "before window", req: Request{Languages: []string{"en"}, Time: from.Add(-time.Second)}},
+		{name: "window end", req: Request{Languages: []string{"en"}, Time: until}},
+		{name: "language prefix", req: Request{Languages: []string{"eng"}, Time: from}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, ok := Select(list, tt.req)
+			assert.Equal(t, tt.url != "", ok)
+			assert.Equal(t, tt.url, url)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	rule := mod.Rule{URL: "https://ya.ru", Platforms: []string{"iOS"}, Countries: []string{"ru"}, Languages: []string{"en-US"}}
+	Normalize(&rule)
+	assert.Equal(t, []string{IOS}, rule.Platforms)
+	assert.Equal(t, []string{"RU"}, rule.Countries)
+	require.NoError(t, Validate([]mod.Rule{rule}))
+
+	tests := []struct {
+		name string
+		list []mod.Rule
+		err  error
+	}{
+		{name: "platform", list: []mod.Rule{{Platforms: []string{"symbian"}}}, err: ErrPlatform},
+		{name: "language", list: []mod.Rule{{Languages: []string{"en_US"}}}, err: ErrLanguage},
+		{name: "country", list: []mod.Rule{{Countries: []string{"RUS"}}}, err: ErrCountry},
+		{name: "window", list: []mod.Rule{{From: &from, Until: &from}}, err: ErrWindow},
+		{name: "too many", list: make([]mod.Rule, MaxRules+1), err: ErrTooMany},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, Validate(tt.list), tt.err)
+		})
+	}
+}
+
+const geoCSV = `ip_start,ip_end,country
+1.0.0.0,1.0.0.255,AU
+5.255.255.0,5.255.255.255,ru
+10.0.0.0,10.255.255.255,ZZ
+2a02:6b8::,2a02:6b8:ffff:ffff:ffff:ffff:ffff:ffff,RU
+`
+
+func TestGeoIP(t *testing.T) {
+	geo, err := LoadGeoIP(strings.NewReader(geoCSV))
+	require.NoError(t, err)
+	assert.Equal(t, 3, geo.Len())
+
+	tests := map[string]string{
+		"1.0.0.0":             "AU",
+		"1.0.0.255":           "AU",
+		"1.0.1.0":             "",
+		"5.255.255.77":        "RU",
+		"::ffff:5.255.255.77": "RU",
+		"10.1.2.3":            "",
+		"0.0.0.1":             "",
+		"2a02:6b8::feed":      "RU",
+		"2a03::1":             "",
+	}
+	for ip, country := range tests {
+		assert.Equal(t, country, geo.Country(netip.MustParseAddr(ip)), ip)
+	}
+
+	var none *GeoIP
+	assert.Equal(t, "", none.Country(netip.MustParseAddr("1.0.0.1")))
+
+	_, err = LoadGeoIP(strings.NewReader("1.0.0.0,1.0.0.255,AU\nbad,1.0.1.255,AU\n"))
+	assert.Error(t, err)
+
+	_, err = LoadGeoIP(strings.NewReader("1.0.0.255,1.0.0.0,AU\n"))
+	assert.Error(t, err)
+}
+
+func TestNewRequest(t *testing.T) {
+	geo, err := LoadGeoIP(strings.NewReader(geoCSV))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/abc", nil)
+	r.RemoteAddr = "5.255.255.5:43210"
+	r.Header.Set("User-Agent", "Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X)")
+	r.Header.Set("Accept-Language", "ru-RU,ru;q=0.9")
+
+	now := time.Now()
+	assert.Equal(t, Request{Platform: IOS, Languages: []string{"ru-RU", "ru"}, Country: "RU", Time: now}, NewRequest(r, geo, now))
+	assert.Equal(t, "", NewRequest(r, nil, now).Country)
+}
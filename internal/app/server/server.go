@@ -1,14 +1,15 @@
 package server
 
 import (
-	"database/sql"
 	"fmt"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"main/internal/app/config"
 	h "main/internal/app/handlers"
+	"main/internal/app/rules"
 	"main/internal/app/storage"
+	"main/internal/app/storage/cache"
 )
 
 func StartSever() error {
@@ -17,38 +18,68 @@ func StartSever() error {
 		return fmt.Errorf("parse config err: %s", err)
 	}
 
-	memoryModel, fileModel, dbModel, err := storage.StartStorage(conf)
+	model, err := storage.Open(conf)
 	if err != nil {
-		return fmt.Errorf("start storage file path err: %s", err)
+		return fmt.Errorf("start storage err: %s", err)
 	}
 
-	var model storage.Storage
-	var db *sql.DB
-
-	if memoryModel != nil {
-		model = memoryModel
-	} else if fileModel != nil {
-		model = fileModel
-	} else if dbModel != nil {
-		model = dbModel
-		db = dbModel.DB
-	} else {
-		return fmt.Errorf("start storage err")
+	if closer, ok := storage.As[storage.Closer](model); ok {
+		defer func() {
+			_ = closer.Close()
+		}()
 	}
 
-	c := h.NewController(model, conf, db)
+	redirects, err := cache.New(conf)
+	if err != nil {
+		return fmt.Errorf("start cache err: %s", err)
+	}
+
+	if redirects != nil {
+		model = storage.NewCached(model, redirects, conf.CacheTTL, conf.CacheNegativeTTL)
+	}
+
+	c := h.NewController(model, conf)
+
+	if conf.GeoIPPath != "" {
+		geo, err := rules.OpenGeoIP(conf.GeoIPPath)
+		if err != nil {
+			return fmt.Errorf("load geoip err: %s", err)
+		}
+
+		c.UseGeoIP(geo)
+	}
+
+	go storage.RunPurge(model, conf.TrashRetention, conf.PurgeInterval)
 
 	r := chi.NewRouter()
 
 	r.Get("/"+conf.BaseURL+"{id}", c.Get)
+	r.Post("/"+conf.BaseURL+"{id}", c.Get)
+	r.Get("/"+conf.BaseURL+"{id}/qr", c.QR)
 	r.Get("/api/user/urls", c.UserURLs)
+	r.Get("/api/user/urls/export", c.Export)
+	r.Get("/api/user/urls/trash", c.Trash)
+	r.Get("/api/user/urls/{id}/history", c.History)
+	r.Get("/api/user/urls/{id}/rules", c.Rules)
 	r.Get("/ping", c.Ping)
+	r.Get("/api/admin/snapshot", c.Snapshot)
+	r.Get("/api/admin/cache", c.CacheStats)
 
 	r.Post("/", c.Post)
 	r.Post("/api/shorten", c.Shorten)
 	r.Post("/api/shorten/batch", c.BatchAdd)
+	r.Post("/api/shorten/batch/stream", c.BatchStream)
+	r.Post("/api/user/urls/import", c.ImportCSV)
+	r.Post("/api/user/urls/restore", c.Restore)
+	r.Post("/api/user/urls/{id}/rules", c.AddRule)
+
+	r.Put("/api/user/urls/{id}/rules", c.SetRules)
+	r.Put("/api/user/urls/{id}/rules/{rule}", c.UpdateRule)
+
+	r.Patch("/api/user/urls/{id}", c.UpdateURL)
 
 	r.Delete("/api/user/urls", c.BatchUpdate)
+	r.Delete("/api/user/urls/{id}/rules/{rule}", c.DeleteRule)
 
 	return http.ListenAndServe(conf.ServerAddress[:len(conf.ServerAddress)-1], h.MiddlewaresConveyor(r))
 }
@@ -2,26 +2,41 @@ package server
 
 import (
 	"bytes"
-	"database/sql"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/csv"
 	"encoding/json"
+	"image/png"
 	"io"
 	"log"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"main/internal/app/config"
 	h "main/internal/app/handlers"
+	"main/internal/app/rules"
+	"main/internal/app/snapshot"
 	"main/internal/app/storage"
+	"main/internal/app/storage/cache"
 )
 
 type (
 	short struct {
 		Result string `json:"result"`
+		QRURL  string `json:"qr_url"`
 	}
 
 	original struct {
@@ -55,32 +70,26 @@ func testRequest(t *testing.T, ts *httptest.Server, method, path, body string) (
 	}
 }
 
+func variant(u string, i int) string {
+	if strings.Contains(u, "?") {
+		return u + "&v=" + strconv.Itoa(i)
+	}
+
+	return u + "?v=" + strconv.Itoa(i)
+}
+
 func TestServer(t *testing.T) {
 	conf, err := config.ParseConfig()
 	if err != nil {
 		log.Print("parse config err: ", err)
 	}
 
-	memoryModel, fileModel, dbModel, err := storage.StartStorage(conf)
+	model, err := storage.Open(conf)
 	if err != nil {
 		log.Print(err)
 	}
 
-	var model storage.Storage
-	var db *sql.DB
-
-	if memoryModel != nil {
-		model = memoryModel
-	} else if fileModel != nil {
-		model = fileModel
-	} else if dbModel != nil {
-		model = dbModel
-		db = dbModel.DB
-	} else {
-		log.Print(err)
-	}
-
-	c := h.NewController(model, conf, db)
+	c := h.NewController(model, conf)
 
 	r := chi.NewRouter()
 	r.Get("/"+conf.BaseURL+"{id}", c.Get)
@@ -99,7 +108,8 @@ func TestServer(t *testing.T) {
 	var n = 0
 	for i := 0; i < 25; i += 2 {
 		expectedOne := "http://" + conf.ServerAddress + conf.BaseURL + strconv.FormatInt(int64(i), 36)
-		marshal, err := json.Marshal(short{Result: "http://" + conf.ServerAddress + conf.BaseURL + strconv.FormatInt(int64(i+1), 36)})
+		linkTwo := "http://" + conf.ServerAddress + conf.BaseURL + strconv.FormatInt(int64(i+1), 36)
+		marshal, err := json.Marshal(short{Result: linkTwo, QRURL: linkTwo + "/qr"})
 		expectedTwo := string(marshal)
 		if err != nil {
 			log.Fatal(err)
@@ -107,11 +117,22 @@ func TestServer(t *testing.T) {
 		pathOne := "/" + conf.BaseURL + strconv.FormatInt(int64(i), 36)
 		pathTwo := "/" + conf.BaseURL + strconv.FormatInt(int64(i+1), 36)
 
-		statusCode, actual := testRequest(t, ts, "POST", "/", urls[n])
+		// Адрес сокращается только один раз, поэтому запросы отличаются параметром.
+		urlOne, urlTwo := variant(urls[n], i), variant(urls[n], i+1)
+
+		statusCode, actual := testRequest(t, ts, "POST", "/", urlOne)
 		assert.Equal(t, http.StatusCreated, statusCode)
 		assert.Equal(t, expectedOne, actual)
 
-		url, err := json.Marshal(original{URL: urls[n]})
+		url, err := json.Marshal(original{URL: urlOne})
+		if err != nil {
+			log.Fatal(err)
+		}
+		statusCode, actual = testRequest(t, ts, "POST", "/api/shorten", string(url))
+		assert.Equal(t, http.StatusConflict, statusCode)
+		assert.JSONEq(t, `{"result":"`+expectedOne+`","qr_url":"`+expectedOne+`/qr"}`, actual)
+
+		url, err = json.Marshal(original{URL: urlTwo})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -121,11 +142,11 @@ func TestServer(t *testing.T) {
 
 		statusCode, actual = testRequest(t, ts, "GET", pathOne, "")
 		assert.Equal(t, http.StatusOK, statusCode)
-		assert.Equal(t, urls[n], actual)
+		assert.Equal(t, urlOne, actual)
 
 		statusCode, actual = testRequest(t, ts, "GET", pathTwo, "")
 		assert.Equal(t, http.StatusOK, statusCode)
-		assert.Equal(t, urls[n], actual)
+		assert.Equal(t, urlTwo, actual)
 
 		if n == 3 {
 			n = 0
@@ -134,3 +155,1393 @@ func TestServer(t *testing.T) {
 		}
 	}
 }
+
+func newLimitedServer(t *testing.T, conf config.Config) *httptest.Server {
+	t.Helper()
+
+	model, err := storage.Open(conf)
+	require.NoError(t, err)
+
+	redirects, err := cache.New(conf)
+	require.NoError(t, err)
+
+	if redirects != nil {
+		model = storage.NewCached(model, redirects, conf.CacheTTL, conf.CacheNegativeTTL)
+	}
+
+	c := h.NewController(model, conf)
+
+	if conf.GeoIPPath != "" {
+		geo, err := rules.OpenGeoIP(conf.GeoIPPath)
+		require.NoError(t, err)
+		c.UseGeoIP(geo)
+	}
+
+	r := chi.NewRouter()
+	r.Get("/{id}", c.Get)
+	r.Post("/{id}", c.Get)
+	r.Get("/{id}/qr", c.QR)
+	r.Post("/", c.Post)
+	r.Post("/api/shorten", c.Shorten)
+	r.Post("/api/shorten/batch", c.BatchAdd)
+	r.Post("/api/shorten/batch/stream", c.BatchStream)
+	r.Post("/api/user/urls/import", c.ImportCSV)
+	r.Get("/api/user/urls", c.UserURLs)
+	r.Get("/api/user/urls/export", c.Export)
+	r.Get("/api/user/urls/trash", c.Trash)
+	r.Post("/api/user/urls/restore", c.Restore)
+	r.Get("/api/user/urls/{id}/history", c.History)
+	r.Patch("/api/user/urls/{id}", c.UpdateURL)
+	r.Get("/api/user/urls/{id}/rules", c.Rules)
+	r.Post("/api/user/urls/{id}/rules", c.AddRule)
+	r.Put("/api/user/urls/{id}/rules", c.SetRules)
+	r.Put("/api/user/urls/{id}/rules/{rule}", c.UpdateRule)
+	r.Delete("/api/user/urls/{id}/rules/{rule}", c.DeleteRule)
+	r.Delete("/api/user/urls", c.BatchUpdate)
+	r.Get("/api/admin/snapshot", c.Snapshot)
+	r.Get("/api/admin/cache", c.CacheStats)
+
+	return httptest.NewServer(h.MiddlewaresConveyor(r))
+}
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	return buf.Bytes()
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+
+	return b
+}
+
+func TestLimits(t *testing.T) {
+	conf := config.Config{
+		ServerAddress:       "localhost:8080/",
+		MaxBodySize:         256,
+		MaxDecompressedSize: 1024,
+		MaxURLLength:        64,
+		MaxBatchSize:        2,
+	}
+
+	ts := newLimitedServer(t, conf)
+	defer ts.Close()
+
+	batch := func(n int) string {
+		var b []h.BatchOriginal
+		for i := 0; i < n; i++ {
+			b = append(b, h.BatchOriginal{ID: strconv.Itoa(i), URL: "https://ya.ru/" + strconv.Itoa(i)})
+		}
+		marshal, err := json.Marshal(b)
+		require.NoError(t, err)
+		return string(marshal)
+	}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      []byte
+		gzip      bool
+		wantCode  int
+		wantLimit int64
+	}{
+		{"plain ok", "POST", "/", []byte("https://ya.ru/"), false, http.StatusCreated, 0},
+		{"plain body too large", "POST", "/", bytes.Repeat([]byte("a"), 257), false, http.StatusRequestEntityTooLarge, 256},
+		{"url too long", "POST", "/", []byte("https://ya.ru/" + strings.Repeat("a", 64)), false, http.StatusRequestEntityTooLarge, 64},
+		{"json url too long", "POST", "/api/shorten", []byte(`{"url":"https://ya.ru/` + strings.Repeat("a", 64) + `"}`), false, http.StatusRequestEntityTooLarge, 64},
+		{"gzip ok", "POST", "/", gzipBytes(t, []byte("https://ya.ru/gzip")), true, http.StatusCreated, 0},
+		{"gzip bomb", "POST", "/", gzipBytes(t, bytes.Repeat([]byte("a"), 1<<20)), true, http.StatusRequestEntityTooLarge, 1024},
+		{"gzip compressed too large", "POST", "/", gzipBytes(t, randomBytes(t, 512)), true, http.StatusRequestEntityTooLarge, 256},
+		{"batch ok", "POST", "/api/shorten/batch", []byte(batch(2)), false, http.StatusCreated, 0},
+		{"batch too many", "POST", "/api/shorten/batch", []byte(batch(3)), false, http.StatusRequestEntityTooLarge, 2},
+		{"delete too many", "DELETE", "/api/user/urls", []byte(`["1","2","3"]`), false, http.StatusRequestEntityTooLarge, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, bytes.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			if tt.wantCode != http.StatusRequestEntityTooLarge {
+				return
+			}
+
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+			var errResp struct {
+				Error string `json:"error"`
+				Limit int64  `json:"limit"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+			assert.NotEmpty(t, errResp.Error)
+			if tt.wantLimit != 0 {
+				assert.Equal(t, tt.wantLimit, errResp.Limit)
+			}
+		})
+	}
+}
+
+func TestBatchStream(t *testing.T) {
+	conf := config.Config{
+		ServerAddress:     "localhost:8080/",
+		MaxURLLength:      64,
+		MaxBatchSize:      3,
+		MaxStreamBodySize: 1 << 20,
+	}
+
+	ts := newLimitedServer(t, conf)
+	defer ts.Close()
+
+	var ndjson, array bytes.Buffer
+	var items []h.BatchOriginal
+	for i := 0; i < 10; i++ {
+		items = append(items, h.BatchOriginal{ID: "c" + strconv.Itoa(i), URL: "https://ya.ru/stream/" + strconv.Itoa(i)})
+	}
+	items = append(items, h.BatchOriginal{ID: "long", URL: "https://ya.ru/" + strings.Repeat("a", 64)})
+
+	enc := json.NewEncoder(&ndjson)
+	for _, i := range items {
+		require.NoError(t, enc.Encode(i))
+	}
+	require.NoError(t, json.NewEncoder(&array).Encode(items))
+
+	tests := []struct {
+		name string
+		body []byte
+		gzip bool
+	}{
+		{"ndjson", ndjson.Bytes(), false},
+		{"array", array.Bytes(), false},
+		{"gzip ndjson", gzipBytes(t, ndjson.Bytes()), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", ts.URL+"/api/shorten/batch/stream", bytes.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+			got := make(map[string]h.BatchShort)
+			var order []string
+			dec := json.NewDecoder(resp.Body)
+			for dec.More() {
+				var res h.BatchShort
+				require.NoError(t, dec.Decode(&res))
+				got[res.ID] = res
+				order = append(order, res.ID)
+			}
+
+			require.Len(t, got, len(items))
+			for n, i := range items[:10] {
+				assert.Equal(t, i.ID, order[n])
+				assert.Empty(t, got[i.ID].Error)
+				assert.Contains(t, got[i.ID].URL, "http://localhost:8080/")
+				// Каждый вариант отправляет те же ссылки, сокращает их только первый.
+				if tt.name == "ndjson" {
+					assert.Equal(t, h.BatchCreated, got[i.ID].Status)
+				} else {
+					assert.Equal(t, h.BatchExists, got[i.ID].Status)
+				}
+			}
+			assert.Equal(t, "long", order[10])
+			assert.Equal(t, h.BatchInvalid, got["long"].Status)
+			assert.Equal(t, "url too long", got["long"].Error)
+		})
+	}
+
+	statusCode, _ := testRequest(t, ts, "POST", "/api/shorten/batch/stream", "[{]")
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	// Распакованное тело ограничено отдельно от сжатого.
+	conf.MaxStreamDecompressedSize = 4096
+	limited := newLimitedServer(t, conf)
+	defer limited.Close()
+
+	req, err := http.NewRequest("POST", limited.URL+"/api/shorten/batch/stream",
+		bytes.NewReader(gzipBytes(t, append(bytes.Repeat([]byte(" "), 1<<16), ndjson.Bytes()...))))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "application/json")
+
+	var errResp struct {
+		Limit int64 `json:"limit"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal(t, int64(4096), errResp.Limit)
+}
+
+func newCookieClient(t *testing.T) *http.Client {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func doRequest(t *testing.T, client *http.Client, method, url, body string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, string(b)
+}
+
+func TestImportExport(t *testing.T) {
+	conf := config.Config{ServerAddress: "localhost:8080/", MaxURLLength: 64}
+
+	ts := newLimitedServer(t, conf)
+	defer ts.Close()
+
+	client := newCookieClient(t)
+
+	csvBody := "original_url,alias,correlation_id\n" +
+		"https://ya.ru/import/1,,a\n" +
+		"https://ya.ru/import/2,promo-2023,b\n" +
+		"https://ya.ru/import/3,promo-2023,c\n" +
+		"https://ya.ru/" + strings.Repeat("a", 64) + ",,d\n" +
+		"javascript:alert(1),,e\n" +
+		"ya.ru/import/no-scheme,,f\n"
+
+	resp, body := doRequest(t, client, "POST", ts.URL+"/api/user/urls/import", csvBody)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var results []struct {
+		Line   int    `json:"line"`
+		ID     string `json:"correlation_id"`
+		URL    string `json:"short_url"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &results))
+	require.Len(t, results, 6)
+
+	assert.Equal(t, "a", results[0].ID)
+	assert.Equal(t, "created", results[0].Status)
+	assert.Equal(t, "http://localhost:8080/promo-2023", results[1].URL)
+	assert.Equal(t, "created", results[1].Status)
+	assert.Equal(t, "invalid", results[2].Status)
+	assert.Equal(t, "alias conflict", results[2].Error)
+	assert.Equal(t, "invalid", results[3].Status)
+	for _, res := range results[4:] {
+		assert.Equal(t, "invalid", res.Status, res.ID)
+		assert.Equal(t, "invalid url", res.Error, res.ID)
+	}
+
+	resp, _ = doRequest(t, client, "GET", ts.URL+"/promo-2023", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "https://ya.ru/import/2", resp.Header.Get("Location"))
+
+	resp, _ = doRequest(t, client, "DELETE", ts.URL+"/api/user/urls", `["promo-2023"]`)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	assert.Eventually(t, func() bool {
+		resp, _ := doRequest(t, client, "GET", ts.URL+"/promo-2023", "")
+		return resp.StatusCode == http.StatusGone
+	}, time.Second, 10*time.Millisecond)
+
+	resp, body = doRequest(t, client, "GET", ts.URL+"/api/user/urls/export?format=csv", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, []string{"short_url", "original_url", "created", "deleted"}, records[0])
+	assert.Equal(t, "https://ya.ru/import/1", records[1][1])
+	assert.NotEmpty(t, records[1][2])
+	assert.Equal(t, "false", records[1][3])
+	assert.Equal(t, "http://localhost:8080/promo-2023", records[2][0])
+	assert.Equal(t, "true", records[2][3])
+
+	for _, format := range []string{"json", "ndjson"} {
+		resp, body = doRequest(t, client, "GET", ts.URL+"/api/user/urls/export?format="+format, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var got []struct {
+			ShortURL string `json:"short_url"`
+			Deleted  bool   `json:"deleted"`
+		}
+		if format == "json" {
+			require.NoError(t, json.Unmarshal([]byte(body), &got))
+		} else {
+			for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+				var u struct {
+					ShortURL string `json:"short_url"`
+					Deleted  bool   `json:"deleted"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(line), &u))
+				got = append(got, u)
+			}
+		}
+
+		require.Len(t, got, 2, format)
+		assert.True(t, got[1].Deleted, format)
+	}
+
+	resp, _ = doRequest(t, client, "GET", ts.URL+"/api/user/urls/export?format=xml", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Распакованный CSV ограничен отдельно от сжатого.
+	conf.MaxStreamDecompressedSize = 4096
+	limited := newLimitedServer(t, conf)
+	defer limited.Close()
+
+	req, err := http.NewRequest("POST", limited.URL+"/api/user/urls/import",
+		bytes.NewReader(gzipBytes(t, []byte(strings.Repeat("https://ya.ru/import/bomb,,\n", 1000)))))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	var errResp struct {
+		Limit int64 `json:"limit"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal(t, int64(4096), errResp.Limit)
+}
+
+func TestUserURLsPagination(t *testing.T) {
+	conf := config.Config{ServerAddress: "localhost:8080/"}
+
+	ts := newLimitedServer(t, conf)
+	defer ts.Close()
+
+	client := newCookieClient(t)
+
+	urls := []string{
+		"https://ya.ru/a",
+		"https://github.com/b",
+		"https://ya.ru/c",
+		"https://go.dev/d",
+		"https://YA.ru:443/e",
+	}
+
+	var short []string
+	for _, u := range urls {
+		resp, body := doRequest(t, client, "POST", ts.URL+"/", u)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		short = append(short, body)
+	}
+
+	for i, n := range []int{0, 3, 1, 0, 2} {
+		for j := 0; j < n; j++ {
+			resp, _ := doRequest(t, client, "GET", strings.Replace(short[i], "http://localhost:8080", ts.URL, 1), "")
+			require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		}
+	}
+
+	type userURL struct {
+		ShortURL    string `json:"short_url"`
+		OriginalURL string `json:"original_url"`
+	}
+
+	page := func(path string) ([]string, string) {
+		resp, body := doRequest(t, client, "GET", ts.URL+path, "")
+		if resp.StatusCode == http.StatusNoContent {
+			return nil, ""
+		}
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+
+		var got []userURL
+		require.NoError(t, json.Unmarshal([]byte(body), &got))
+
+		var res []string
+		for _, u := range got {
+			res = append(res, u.OriginalURL)
+		}
+
+		next := resp.Header.Get("Link")
+		if next != "" {
+			require.True(t, strings.HasPrefix(next, "<http://localhost:8080/api/user/urls?"), next)
+			require.True(t, strings.HasSuffix(next, `>; rel="next"`), next)
+			next = strings.TrimPrefix(strings.TrimSuffix(next, `>; rel="next"`), "<http://localhost:8080")
+		}
+
+		return res, next
+	}
+
+	all, next := page("/api/user/urls")
+	assert.Equal(t, urls, all)
+	assert.Empty(t, next)
+
+	var got []string
+	path := "/api/user/urls?limit=2"
+	for path != "" {
+		var p []string
+		p, path = page(path)
+		assert.LessOrEqual(t, len(p), 2)
+		got = append(got, p...)
+	}
+	assert.Equal(t, urls, got)
+
+	got, _ = page("/api/user/urls?sort=-clicks&limit=3")
+	assert.Equal(t, []string{urls[1], urls[4], urls[2]}, got)
+
+	got, _ = page("/api/user/urls?host=ya.ru&sort=-created")
+	assert.Equal(t, []string{urls[4], urls[2], urls[0]}, got)
+
+	got, _ = page("/api/user/urls?q=GITHUB")
+	assert.Equal(t, []string{urls[1]}, got)
+
+	future := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	got, _ = page("/api/user/urls?created_from=" + future)
+	assert.Empty(t, got)
+
+	got, _ = page("/api/user/urls?created_to=" + future)
+	assert.Equal(t, urls, got)
+
+	for _, bad := range []string{"limit=-1", "cursor=!!", "sort=name", "created_from=yesterday"} {
+		resp, _ := doRequest(t, client, "GET", ts.URL+"/api/user/urls?"+bad, "")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, bad)
+	}
+}
+
+func TestUpdateURL(t *testing.T) {
+	conf := config.Config{ServerAddress: "localhost:8080/", MaxURLLength: 64}
+
+	ts := newLimitedServer(t, conf)
+	defer ts.Close()
+
+	owner := newCookieClient(t)
+	other := newCookieClient(t)
+
+	resp, short := doRequest(t, owner, "POST", ts.URL+"/", "https://ya.ru/flyer")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	id := strings.TrimPrefix(short, "http://localhost:8080/")
+
+	resp, body := doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"url":"https://ya.ru/flyer/v2"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"short_url":"`+short+`","original_url":"https://ya.ru/flyer/v2"}`, body)
+
+	resp, _ = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"url":"https://ya.ru/flyer/v3"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = doRequest(t, other, "GET", ts.URL+"/"+id, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "https://ya.ru/flyer/v3", resp.Header.Get("Location"))
+
+	resp, body = doRequest(t, owner, "GET", ts.URL+"/api/user/urls/"+id+"/history", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var history []struct {
+		URL      string    `json:"url"`
+		Replaced time.Time `json:"replaced_at"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &history))
+	require.Len(t, history, 2)
+	assert.Equal(t, "https://ya.ru/flyer", history[0].URL)
+	assert.Equal(t, "https://ya.ru/flyer/v2", history[1].URL)
+	assert.False(t, history[0].Replaced.After(history[1].Replaced))
+
+	tests := []struct {
+		name     string
+		client   *http.Client
+		method   string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{"other user", other, "PATCH", "/api/user/urls/" + id, `{"url":"https://evil.com"}`, http.StatusForbidden},
+		{"other user history", other, "GET", "/api/user/urls/" + id + "/history", "", http.StatusForbidden},
+		{"missing", owner, "PATCH", "/api/user/urls/zzzz", `{"url":"https://ya.ru"}`, http.StatusNotFound},
+		{"empty url", owner, "PATCH", "/api/user/urls/" + id, `{"url":""}`, http.StatusBadRequest},
+		{"url too long", owner, "PATCH", "/api/user/urls/" + id, `{"url":"https://ya.ru/` + strings.Repeat("a", 64) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := doRequest(t, tt.client, tt.method, ts.URL+tt.path, tt.body)
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestTrashAndRestore(t *testing.T) {
+	conf := config.Config{ServerAddress: "localhost:8080/", TrashRetention: time.Hour}
+
+	ts := newLimitedServer(t, conf)
+	defer ts.Close()
+
+	owner := newCookieClient(t)
+	other := newCookieClient(t)
+
+	var ids []string
+	for _, u := range []string{"https://ya.ru/trash/1", "https://ya.ru/trash/2"} {
+		resp, short := doRequest(t, owner, "POST", ts.URL+"/", u)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		ids = append(ids, strings.TrimPrefix(short, "http://localhost:8080/"))
+	}
+
+	resp, _ := doRequest(t, owner, "GET", ts.URL+"/api/user/urls/trash", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	marshal, err := json.Marshal(ids)
+	require.NoError(t, err)
+
+	resp, _ = doRequest(t, owner, "DELETE", ts.URL+"/api/user/urls", string(marshal))
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var trash []struct {
+		ShortURL  string    `json:"short_url"`
+		DeletedAt time.Time `json:"deleted_at"`
+		PurgeAt   time.Time `json:"purge_at"`
+	}
+	require.Eventually(t, func() bool {
+		resp, body := doRequest(t, owner, "GET", ts.URL+"/api/user/urls/trash", "")
+		if resp.StatusCode != http.StatusOK {
+			return false
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &trash))
+		return len(trash) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, time.Hour, trash[0].PurgeAt.Sub(trash[0].DeletedAt))
+
+	resp, body := doRequest(t, other, "POST", ts.URL+"/api/user/urls/restore", string(marshal))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "[]", body)
+
+	resp, body = doRequest(t, owner, "POST", ts.URL+"/api/user/urls/restore", `["`+ids[0]+`","zzzz"]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `["`+ids[0]+`"]`, body)
+
+	resp, _ = doRequest(t, owner, "GET", ts.URL+"/"+ids[0], "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	resp, _ = doRequest(t, owner, "GET", ts.URL+"/"+ids[1], "")
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestSnapshot(t *testing.T) {
+	ts := newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/"})
+	client := newCookieClient(t)
+
+	resp, _ := doRequest(t, client, "GET", ts.URL+"/api/admin/snapshot", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	ts.Close()
+
+	ts = newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/", AdminToken: "secret"})
+	defer ts.Close()
+
+	resp, _ = doRequest(t, client, "POST", ts.URL+"/api/shorten/batch",
+		`[{"correlation_id":"a","original_url":"https://ya.ru/snapshot/1"},{"correlation_id":"b","original_url":"https://ya.ru/snapshot/2"}]`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/admin/snapshot", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer wrong")
+
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/gzip", resp.Header.Get("Content-Type"))
+
+	trailer, err := snapshot.Verify(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 2, trailer.Count)
+}
+
+func TestCacheStats(t *testing.T) {
+	ts := newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/", AdminToken: "secret"})
+	client := newCookieClient(t)
+
+	stats := func() (int, string) {
+		req, err := http.NewRequest("GET", ts.URL+"/api/admin/cache", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp.StatusCode, string(b)
+	}
+
+	// Без кеша счетчиков нет.
+	status, _ := stats()
+	assert.Equal(t, http.StatusNotImplemented, status)
+	ts.Close()
+
+	ts = newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/", AdminToken: "secret", CacheSize: 10, CacheTTL: time.Minute})
+	defer ts.Close()
+
+	resp, _ := doRequest(t, client, "GET", ts.URL+"/api/admin/cache", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, body := doRequest(t, client, "POST", ts.URL+"/", "https://ya.ru/cache/stats")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	id := strings.TrimPrefix(body, "http://localhost:8080/")
+
+	for i := 0; i < 3; i++ {
+		resp, _ = doRequest(t, client, "GET", ts.URL+"/"+id, "")
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	}
+
+	status, body = stats()
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"hits":2,"misses":1}`, body)
+}
+
+func TestBatchStatuses(t *testing.T) {
+	ts := newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/", MaxURLLength: 64})
+	defer ts.Close()
+
+	client := newCookieClient(t)
+
+	resp, existing := doRequest(t, client, "POST", ts.URL+"/", "https://ya.ru/batch/existing")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	batch := func(query string, items ...h.BatchOriginal) (int, []h.BatchShort) {
+		marshal, err := json.Marshal(items)
+		require.NoError(t, err)
+
+		resp, body := doRequest(t, client, "POST", ts.URL+"/api/shorten/batch"+query, string(marshal))
+
+		var res []h.BatchShort
+		if resp.StatusCode != http.StatusBadRequest || body != "" {
+			require.NoError(t, json.Unmarshal([]byte(body), &res))
+		}
+
+		return resp.StatusCode, res
+	}
+
+	long := "https://ya.ru/" + strings.Repeat("a", 64)
+
+	status, res := batch("?atomic=true",
+		h.BatchOriginal{ID: "a", URL: "https://ya.ru/batch/new"},
+		h.BatchOriginal{ID: "b", URL: long},
+	)
+	assert.Equal(t, http.StatusBadRequest, status)
+	require.Len(t, res, 2)
+	assert.Equal(t, h.BatchShort{ID: "a", Status: h.BatchSkipped}, res[0])
+	assert.Equal(t, h.BatchShort{ID: "b", Status: h.BatchInvalid, Error: "url too long"}, res[1])
+
+	status, res = batch("",
+		h.BatchOriginal{ID: "a", URL: "https://ya.ru/batch/new"},
+		h.BatchOriginal{ID: "b", URL: "https://ya.ru/batch/existing"},
+		h.BatchOriginal{ID: "c", URL: long},
+		h.BatchOriginal{ID: "d", URL: ""},
+		h.BatchOriginal{ID: "e", URL: "https://ya.ru/batch/new"},
+	)
+	assert.Equal(t, http.StatusCreated, status)
+	require.Len(t, res, 5)
+
+	// Пакет с atomic=true не сохранил ссылку "a".
+	assert.Equal(t, h.BatchCreated, res[0].Status)
+	assert.Equal(t, h.BatchShort{ID: "b", URL: existing, QRURL: existing + "/qr", Status: h.BatchExists}, res[1])
+	assert.Equal(t, h.BatchShort{ID: "c", Status: h.BatchInvalid, Error: "url too long"}, res[2])
+	assert.Equal(t, h.BatchShort{ID: "d", Status: h.BatchInvalid, Error: "empty url"}, res[3])
+	assert.Equal(t, h.BatchShort{ID: "e", URL: res[0].URL, QRURL: res[0].URL + "/qr", Status: h.BatchExists}, res[4])
+
+	status, res = batch("?atomic=true", h.BatchOriginal{ID: "a", URL: "https://ya.ru/batch/existing"})
+	assert.Equal(t, http.StatusConflict, status)
+	require.Len(t, res, 1)
+	assert.Equal(t, h.BatchExists, res[0].Status)
+
+	status, _ = batch("", h.BatchOriginal{ID: "a", URL: long})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = batch("?atomic=maybe", h.BatchOriginal{ID: "a", URL: "https://ya.ru/batch/other"})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// Ссылка без схемы или хоста не сокращается.
+	status, res = batch("",
+		h.BatchOriginal{ID: "a", URL: "not a url"},
+		h.BatchOriginal{ID: "b", URL: "ya.ru/batch/no-scheme"},
+		h.BatchOriginal{ID: "c", URL: "mailto:user@ya.ru"},
+		h.BatchOriginal{ID: "d", URL: "https://"},
+		h.BatchOriginal{ID: "e", URL: "http://[::1"},
+		h.BatchOriginal{ID: "f", URL: "http://ya.ru:8080/batch/port"},
+	)
+	assert.Equal(t, http.StatusCreated, status)
+	require.Len(t, res, 6)
+	for _, r := range res[:5] {
+		assert.Equal(t, h.BatchShort{ID: r.ID, Status: h.BatchInvalid, Error: "invalid url"}, r)
+	}
+	assert.Equal(t, h.BatchCreated, res[5].Status)
+}
+
+func TestDeleteWait(t *testing.T) {
+	ts := newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/"})
+	defer ts.Close()
+
+	client, other := newCookieClient(t), newCookieClient(t)
+
+	_, own := doRequest(t, client, "POST", ts.URL+"/", "https://ya.ru/wait/1")
+	_, foreign := doRequest(t, other, "POST", ts.URL+"/", "https://ya.ru/wait/2")
+	own, foreign = own[strings.LastIndex(own, "/")+1:], foreign[strings.LastIndex(foreign, "/")+1:]
+
+	body, err := json.Marshal([]string{own, foreign, "zzzz"})
+	require.NoError(t, err)
+
+	resp, res := doRequest(t, client, "DELETE", ts.URL+"/api/user/urls?wait=true", string(body))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var got map[string]string
+	require.NoError(t, json.Unmarshal([]byte(res), &got))
+	assert.Equal(t, map[string]string{own: "deleted", foreign: "forbidden", "zzzz": "not_found"}, got)
+
+	resp, _ = doRequest(t, client, "GET", ts.URL+"/"+own, "")
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	resp, res = doRequest(t, client, "DELETE", ts.URL+"/api/user/urls?wait=1", `["`+own+`"]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"`+own+`":"already_deleted"}`, res)
+
+	resp, _ = doRequest(t, client, "DELETE", ts.URL+"/api/user/urls?wait=later", `["`+own+`"]`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestQR(t *testing.T) {
+	ts := newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/", QRMargin: 4})
+	defer ts.Close()
+
+	client := newCookieClient(t)
+
+	resp, body := doRequest(t, client, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/qr"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var res short
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	assert.Equal(t, res.Result+"/qr", res.QRURL)
+
+	path := ts.URL + strings.TrimPrefix(res.QRURL, "http://localhost:8080")
+
+	resp, body = doRequest(t, client, "GET", path+"?size=128", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+	img, err := png.Decode(strings.NewReader(body))
+	require.NoError(t, err)
+	assert.Equal(t, 128, img.Bounds().Dx())
+
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	req, err := http.NewRequest("GET", path+"?size=128", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", etag)
+
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp, body = doRequest(t, client, "GET", path+"?format=svg&level=H&margin=0", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/svg+xml", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, "<svg")
+	assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+
+	for _, query := range []string{"?format=gif", "?size=abc", "?size=10", "?level=X", "?margin=100"} {
+		resp, _ = doRequest(t, client, "GET", path+query, "")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+
+	resp, _ = doRequest(t, client, "GET", ts.URL+"/zzzzzz/qr", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestPreview(t *testing.T) {
+	ts := newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/"})
+	defer ts.Close()
+
+	owner, visitor := newCookieClient(t), newCookieClient(t)
+
+	resp, body := doRequest(t, owner, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/preview?a=1&b=2","title":"<Отчет>"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var res short
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	id := strings.TrimPrefix(res.Result, "http://localhost:8080/")
+
+	resp, _ = doRequest(t, visitor, "GET", ts.URL+"/"+id, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	for _, path := range []string{"/" + id + "+", "/" + id + "?preview=1"} {
+		resp, body = doRequest(t, visitor, "GET", ts.URL+path, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Contains(t, body, "https://ya.ru/preview?a=1&amp;b=2")
+		assert.Contains(t, body, "&lt;Отчет&gt;")
+		assert.Contains(t, body, "followed 1 times")
+		assert.Contains(t, body, `href="/`+id+`?pass=`)
+	}
+
+	// Флаг ссылки показывает предпросмотр всем посетителям.
+	resp, _ = doRequest(t, visitor, "PATCH", ts.URL+"/api/user/urls/"+id, `{"preview":true}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, body = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"preview":true}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"short_url":"`+res.Result+`","original_url":"https://ya.ru/preview?a=1&b=2","title":"<Отчет>","preview":true}`, body)
+
+	resp, body = doRequest(t, visitor, "GET", ts.URL+"/"+id, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	next := continueLink(t, body)
+
+	// Флаг отменяет только пропуск со страницы предпросмотра.
+	for _, path := range []string{"/" + id + "?preview=false", "/" + id + "?pass=1.x", "/" + id + "?pass=" + next[strings.Index(next, "=")+1:] + "x"} {
+		resp, body = doRequest(t, visitor, "GET", ts.URL+path, "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Contains(t, body, "https://ya.ru/preview?a=1&amp;b=2", path)
+	}
+
+	resp, _ = doRequest(t, visitor, "GET", ts.URL+next, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "https://ya.ru/preview?a=1&b=2", resp.Header.Get("Location"))
+
+	resp, _ = doRequest(t, visitor, "GET", ts.URL+"/"+id+"?preview=maybe", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Адрес и параметры вместе не меняются: ни то, ни другое не применяется.
+	resp, _ = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"url":"https://ya.ru/moved","preview":false}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, body = doRequest(t, owner, "GET", ts.URL+"/api/user/urls/"+id+"/history", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[]`, body)
+
+	resp, body = doRequest(t, visitor, "GET", ts.URL+"/"+id, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "https://ya.ru/preview?a=1&amp;b=2")
+}
+
+// continueLink возвращает ссылку перехода со страницы предпросмотра.
+func continueLink(t *testing.T, body string) string {
+	t.Helper()
+
+	m := regexp.MustCompile(`href="(/[^"]+\?pass=[^"]+)"`).FindStringSubmatch(body)
+	require.Len(t, m, 2, body)
+
+	return m[1]
+}
+
+func TestRedirectStatus(t *testing.T) {
+	ts := newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/", RedirectStatus: http.StatusFound})
+	defer ts.Close()
+
+	client := newCookieClient(t)
+
+	shorten := func(body string) (int, string) {
+		resp, body := doRequest(t, client, "POST", ts.URL+"/api/shorten", body)
+
+		var res short
+		if resp.StatusCode == http.StatusCreated {
+			require.NoError(t, json.Unmarshal([]byte(body), &res))
+		}
+
+		return resp.StatusCode, strings.TrimPrefix(res.Result, "http://localhost:8080/")
+	}
+
+	redirect := func(id string) int {
+		resp, _ := doRequest(t, client, "GET", ts.URL+"/"+id, "")
+		return resp.StatusCode
+	}
+
+	status, permanent := shorten(`{"url":"https://ya.ru/redirect/permanent","redirect":308}`)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, http.StatusPermanentRedirect, redirect(permanent))
+
+	status, tracked := shorten(`{"url":"https://ya.ru/redirect/default"}`)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, http.StatusFound, redirect(tracked))
+
+	status, _ = shorten(`{"url":"https://ya.ru/redirect/bad","redirect":200}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	resp, body := doRequest(t, client, "PATCH", ts.URL+"/api/user/urls/"+tracked, `{"redirect":301}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"short_url":"http://localhost:8080/`+tracked+`","original_url":"https://ya.ru/redirect/default","redirect":301}`, body)
+	assert.Equal(t, http.StatusMovedPermanently, redirect(tracked))
+
+	// 0 возвращает код по умолчанию.
+	resp, _ = doRequest(t, client, "PATCH", ts.URL+"/api/user/urls/"+permanent, `{"redirect":0}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, http.StatusFound, redirect(permanent))
+
+	resp, _ = doRequest(t, client, "PATCH", ts.URL+"/api/user/urls/"+permanent, `{"redirect":304}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Одновременные изменения разных параметров не теряют друг друга.
+	var wg sync.WaitGroup
+	for _, patch := range []string{`{"title":"Docs"}`, `{"redirect":308}`, `{"max_clicks":100}`, `{"preview":false}`} {
+		wg.Add(1)
+		go func(patch string) {
+			defer wg.Done()
+
+			resp, _ := doRequest(t, client, "PATCH", ts.URL+"/api/user/urls/"+tracked, patch)
+			assert.Equal(t, http.StatusOK, resp.StatusCode, patch)
+		}(patch)
+	}
+	wg.Wait()
+
+	resp, body = doRequest(t, client, "PATCH", ts.URL+"/api/user/urls/"+tracked, `{"preview":false}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"short_url":"http://localhost:8080/`+tracked+`","original_url":"https://ya.ru/redirect/default","title":"Docs","redirect":308,"max_clicks":100}`, body)
+}
+
+func TestPassword(t *testing.T) {
+	ts := newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/", PasswordAttempts: 3, PasswordLockout: time.Hour})
+	defer ts.Close()
+
+	owner, visitor := newCookieClient(t), newCookieClient(t)
+
+	resp, body := doRequest(t, owner, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/internal/docs","title":"Docs","password":"s3cret"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var res short
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	id := strings.TrimPrefix(res.Result, "http://localhost:8080/")
+
+	open := func(method, password, form string) (*http.Response, string) {
+		req, err := http.NewRequest(method, ts.URL+"/"+id, strings.NewReader(form))
+		require.NoError(t, err)
+
+		if password != "" {
+			req.Header.Set("X-Link-Password", password)
+		}
+		if form != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		resp, err := visitor.Do(req)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp, string(b)
+	}
+
+	// Без пароля отдается форма, адрес ссылки на ней не виден.
+	for _, path := range []string{"/" + id, "/" + id + "+"} {
+		resp, body = doRequest(t, visitor, "GET", ts.URL+path, "")
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode, path)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Contains(t, body, `<form method="post">`)
+		assert.NotContains(t, body, "ya.ru")
+	}
+
+	resp, _ = open("GET", "s3cret", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "https://ya.ru/internal/docs", resp.Header.Get("Location"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	// Ссылка с паролем не подменяется уже сокращенной ссылкой.
+	resp, _ = doRequest(t, visitor, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/open","title":"Open"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, body = doRequest(t, owner, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/open","password":"s3cret"}`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.NotContains(t, body, "result")
+	assert.Contains(t, body, "error")
+
+	resp, body = doRequest(t, owner, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/open","title":"Mine"}`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Contains(t, body, "result")
+
+	resp, _ = open("POST", "", "password=s3cret")
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, "https://ya.ru/internal/docs", resp.Header.Get("Location"))
+
+	resp, body = open("POST", "", "password=wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, body, "Wrong password")
+
+	// Пароль и обязательный предпросмотр спрашивают пароль один раз.
+	resp, _ = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"preview":true}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = open("POST", "", "password=s3cret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "https://ya.ru/internal/docs")
+	next := continueLink(t, body)
+
+	resp, _ = doRequest(t, visitor, "GET", ts.URL+next, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "https://ya.ru/internal/docs", resp.Header.Get("Location"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	resp, body = doRequest(t, visitor, "GET", ts.URL+"/"+id+"?pass=1.x", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NotContains(t, body, "ya.ru")
+
+	resp, _ = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"preview":false}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Верный пароль сбрасывает счетчик неверных.
+	resp, _ = open("GET", "s3cret", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	for i := 0; i < 3; i++ {
+		resp, _ = open("GET", "wrong", "")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	resp, _ = open("GET", "s3cret", "")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	retry, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 3600, retry, 60)
+
+	// Владелец снимает пароль пустой строкой.
+	resp, body = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"password":""}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"short_url":"`+res.Result+`","original_url":"https://ya.ru/internal/docs","title":"Docs"}`, body)
+
+	resp, _ = open("GET", "", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	resp, body = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"password":"n3w"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"protected":true`)
+
+	// Смена пароля отзывает выданные пропуски.
+	resp, _ = doRequest(t, visitor, "GET", ts.URL+next, "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"password":"`+strings.Repeat("x", 73)+`"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Адрес удаленной ссылки сокращается заново без пароля и заголовка.
+	resp, _ = doRequest(t, owner, "DELETE", ts.URL+"/api/user/urls?wait=true", `["`+id+`"]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = doRequest(t, visitor, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/internal/docs"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	fresh := strings.TrimPrefix(res.Result, "http://localhost:8080/")
+	assert.NotEqual(t, id, fresh)
+
+	resp, _ = doRequest(t, visitor, "GET", ts.URL+"/"+fresh, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	resp, body = doRequest(t, visitor, "GET", ts.URL+"/"+fresh+"+", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotContains(t, body, "Docs")
+}
+
+func TestMaxClicks(t *testing.T) {
+	ts := newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/"})
+	defer ts.Close()
+
+	client := newCookieClient(t)
+
+	resp, body := doRequest(t, client, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/onboarding","max_clicks":3}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var res short
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	id := strings.TrimPrefix(res.Result, "http://localhost:8080/")
+
+	// Одновременные переходы не превышают ограничение.
+	statuses := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, _ := doRequest(t, client, "GET", ts.URL+"/"+id, "")
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	assert.Equal(t, map[int]int{http.StatusTemporaryRedirect: 3, http.StatusGone: 7}, counts)
+
+	// Исчерпанная ссылка не показывает и предпросмотр.
+	resp, _ = doRequest(t, client, "GET", ts.URL+"/"+id+"+", "")
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	resp, body = doRequest(t, client, "PATCH", ts.URL+"/api/user/urls/"+id, `{"max_clicks":0}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"short_url":"`+res.Result+`","original_url":"https://ya.ru/onboarding"}`, body)
+
+	resp, _ = doRequest(t, client, "GET", ts.URL+"/"+id, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	resp, _ = doRequest(t, client, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/onboarding/bad","max_clicks":-1}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Адрес исчерпанной и удаленной ссылки сокращается заново без ограничения
+	// и с нулевым счетчиком.
+	resp, _ = doRequest(t, client, "PATCH", ts.URL+"/api/user/urls/"+id, `{"max_clicks":4}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, client, "GET", ts.URL+"/"+id, "")
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	resp, _ = doRequest(t, client, "DELETE", ts.URL+"/api/user/urls?wait=true", `["`+id+`"]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	other := newCookieClient(t)
+	resp, body = doRequest(t, other, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/onboarding"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	fresh := strings.TrimPrefix(res.Result, "http://localhost:8080/")
+	assert.NotEqual(t, id, fresh)
+
+	for i := 0; i < 5; i++ {
+		resp, _ = doRequest(t, other, "GET", ts.URL+"/"+fresh, "")
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	}
+
+	resp, _ = doRequest(t, other, "PATCH", ts.URL+"/api/user/urls/"+fresh, `{"max_clicks":6}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, other, "GET", ts.URL+"/"+fresh, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	resp, _ = doRequest(t, other, "GET", ts.URL+"/"+fresh, "")
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestRules(t *testing.T) {
+	// Тестовый клиент приходит с 127.0.0.1.
+	geoPath := filepath.Join(t.TempDir(), "geoip.csv")
+	require.NoError(t, os.WriteFile(geoPath, []byte("127.0.0.0,127.255.255.255,RU\n"), 0600))
+
+	ts := newLimitedServer(t, config.Config{ServerAddress: "localhost:8080/", GeoIPPath: geoPath})
+	defer ts.Close()
+
+	owner, visitor := newCookieClient(t), newCookieClient(t)
+
+	resp, body := doRequest(t, owner, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/app"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var res short
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	id := strings.TrimPrefix(res.Result, "http://localhost:8080/")
+	rulesURL := ts.URL + "/api/user/urls/" + id + "/rules"
+
+	redirect := func(ua, lang string) string {
+		req, err := http.NewRequest("GET", ts.URL+"/"+id, nil)
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", ua)
+		req.Header.Set("Accept-Language", lang)
+
+		resp, err := visitor.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+		return resp.Header.Get("Location")
+	}
+
+	const (
+		iPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)"
+		android = "Mozilla/5.0 (Linux; Android 14; Pixel 8)"
+		desktop = "Mozilla/5.0 (Windows NT 10.0; Win64; x64)"
+	)
+
+	resp, body = doRequest(t, owner, "GET", rulesURL, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[]`, body)
+
+	resp, _ = doRequest(t, visitor, "GET", rulesURL, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _ = doRequest(t, owner, "GET", ts.URL+"/api/user/urls/zzzzzz/rules", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, body = doRequest(t, owner, "PUT", rulesURL, `[
+		{"url":"https://apps.apple.com/app","platforms":["iOS"]},
+		{"url":"https://play.google.com/app","platforms":["android"]},
+		{"url":"https://ya.ru/app/ru","countries":["ru"]}
+	]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[
+		{"id":1,"url":"https://apps.apple.com/app","platforms":["ios"]},
+		{"id":2,"url":"https://play.google.com/app","platforms":["android"]},
+		{"id":3,"url":"https://ya.ru/app/ru","countries":["RU"]}
+	]`, body)
+
+	assert.Equal(t, "https://apps.apple.com/app", redirect(iPhone, ""))
+	assert.Equal(t, "https://play.google.com/app", redirect(android, ""))
+	assert.Equal(t, "https://ya.ru/app/ru", redirect(desktop, ""))
+
+	resp, _ = doRequest(t, visitor, "GET", ts.URL+"/"+id, "")
+	assert.Equal(t, "User-Agent, Accept-Language", resp.Header.Get("Vary"))
+
+	resp, _ = doRequest(t, owner, "DELETE", rulesURL+"/3", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://ya.ru/app", redirect(desktop, ""))
+
+	resp, body = doRequest(t, owner, "POST", rulesURL, `{"url":"https://ya.ru/app/en","languages":["en"]}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.JSONEq(t, `{"id":3,"url":"https://ya.ru/app/en","languages":["en"]}`, body)
+	assert.Equal(t, "https://ya.ru/app/en", redirect(desktop, "ru;q=0.5, en-GB"))
+
+	resp, body = doRequest(t, owner, "PUT", rulesURL+"/1", `{"url":"https://apps.apple.com/app2","platforms":["ios"]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"id":1,"url":"https://apps.apple.com/app2","platforms":["ios"]}`, body)
+	assert.Equal(t, "https://apps.apple.com/app2", redirect(iPhone, "en"))
+
+	resp, body = doRequest(t, owner, "GET", rulesURL, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[
+		{"id":1,"url":"https://apps.apple.com/app2","platforms":["ios"]},
+		{"id":2,"url":"https://play.google.com/app","platforms":["android"]},
+		{"id":3,"url":"https://ya.ru/app/en","languages":["en"]}
+	]`, body)
+
+	for method, path := range map[string]string{"PUT": rulesURL + "/99", "DELETE": rulesURL + "/x"} {
+		resp, _ = doRequest(t, owner, method, path, `{"url":"https://ya.ru"}`)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+
+	for _, rule := range []string{`{"url":"https://ya.ru","platforms":["symbian"]}`, `{"platforms":["ios"]}`, `[]`} {
+		resp, _ = doRequest(t, owner, "POST", rulesURL, rule)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, rule)
+	}
+
+	resp, _ = doRequest(t, visitor, "POST", rulesURL, `{"url":"https://ya.ru/evil"}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Правила не трогают остальные параметры ссылки.
+	resp, body = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"title":"App"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"title":"App"`)
+	assert.Equal(t, "https://apps.apple.com/app2", redirect(iPhone, ""))
+
+	// Одновременные правки правил и параметров не теряют друг друга.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+
+			resp, _ := doRequest(t, owner, "POST", rulesURL, `{"url":"https://ya.ru/app/`+strconv.Itoa(i)+`","languages":["de"]}`)
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+
+			resp, _ := doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"max_clicks":`+strconv.Itoa(100+i)+`}`)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}(i)
+	}
+	wg.Wait()
+
+	resp, body = doRequest(t, owner, "GET", rulesURL, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var list []json.RawMessage
+	require.NoError(t, json.Unmarshal([]byte(body), &list))
+	assert.Len(t, list, 8)
+
+	resp, body = doRequest(t, owner, "PATCH", ts.URL+"/api/user/urls/"+id, `{"preview":false}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"title":"App"`)
+	assert.Contains(t, body, `"max_clicks":10`)
+
+	resp, body = doRequest(t, owner, "PUT", rulesURL, `[]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[]`, body)
+	assert.Equal(t, "https://ya.ru/app", redirect(iPhone, ""))
+
+	// Адрес удаленной ссылки с правилами сокращается заново без правил.
+	resp, _ = doRequest(t, owner, "PUT", rulesURL, `[{"url":"https://apps.apple.com/app","platforms":["ios"]}]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "https://apps.apple.com/app", redirect(iPhone, ""))
+
+	resp, _ = doRequest(t, owner, "DELETE", ts.URL+"/api/user/urls?wait=true", `["`+id+`"]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = doRequest(t, visitor, "POST", ts.URL+"/api/shorten", `{"url":"https://ya.ru/app"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	fresh := strings.TrimPrefix(res.Result, "http://localhost:8080/")
+	assert.NotEqual(t, id, fresh)
+
+	id = fresh
+	assert.Equal(t, "https://ya.ru/app", redirect(iPhone, ""))
+
+	resp, body = doRequest(t, visitor, "GET", ts.URL+"/api/user/urls/"+id+"/rules", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[]`, body)
+}
@@ -0,0 +1,227 @@
+// Package snapshot сохраняет все ссылки хранилища в сжатый файл и
+// восстанавливает их из него в пустое хранилище любого типа.
+//
+// Снимок - gzip поток JSON записей, по одной в строке: заголовок с версией
+// формата, ссылки в порядке ID и итоговая запись с их числом и контрольной
+// суммой.
+package snapshot
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"main/internal/app/migrate"
+	"main/internal/app/storage"
+	mod "main/internal/app/storage/model"
+)
+
+// Version - версия формата снимка.
+const Version = 1
+
+const batchSize = 1000
+
+var (
+	ErrCorrupt = errors.New("snapshot is corrupt")
+	ErrVersion = errors.New("unsupported snapshot version")
+)
+
+// Header - первая запись снимка.
+type Header struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// Trailer - последняя запись снимка.
+type Trailer struct {
+	Count    int    `json:"count"`
+	Checksum string `json:"checksum"`
+	// LastID - наибольший выданный ID, включая удаленные навсегда ссылки.
+	LastID int `json:"last_id"`
+}
+
+type record struct {
+	Header *Header    `json:"header,omitempty"`
+	Link   *mod.Event `json:"link,omitempty"`
+	End    *Trailer   `json:"end,omitempty"`
+}
+
+// Write пишет снимок всех ссылок хранилища в w.
+func Write(w io.Writer, s storage.Storage) (Trailer, error) {
+	var t Trailer
+
+	src, ok := storage.As[storage.Exporter](s)
+	if !ok {
+		return t, migrate.ErrUnsupported
+	}
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	err := enc.Encode(record{Header: &Header{Version: Version, Created: time.Now().UTC()}})
+	if err != nil {
+		return t, err
+	}
+
+	sum := migrate.NewChecksum()
+	after := -1
+	for {
+		events, err := src.Export(after, batchSize)
+		if err != nil {
+			return t, fmt.Errorf("export after %d: %w", after, err)
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		for i := range events {
+			sum.Add(events[i])
+			if err = enc.Encode(record{Link: &events[i]}); err != nil {
+				return t, err
+			}
+		}
+
+		after = events[len(events)-1].ID
+	}
+
+	// LastID читается после ссылок, чтобы он был не меньше любого их ID.
+	last, err := src.LastID()
+	if err != nil {
+		return t, err
+	}
+
+	t = Trailer{Count: sum.Count(), Checksum: sum.String(), LastID: last}
+	if err = enc.Encode(record{End: &t}); err != nil {
+		return t, err
+	}
+
+	return t, gz.Close()
+}
+
+// Verify проверяет версию, целостность и контрольную сумму снимка, не
+// загружая его.
+func Verify(r io.Reader) (Trailer, error) {
+	return read(r, func([]mod.Event) error {
+		return nil
+	}, nil)
+}
+
+// Restore загружает снимок в пустое хранилище и сверяет загруженные ссылки с
+// контрольной суммой снимка. Если снимок поврежден, часть ссылок может
+// остаться загруженной, поэтому перед загрузкой его стоит проверить Verify.
+func Restore(r io.Reader, s storage.Storage) (Trailer, error) {
+	dst, ok := storage.As[storage.Importer](s)
+	if !ok {
+		return Trailer{}, migrate.ErrUnsupported
+	}
+
+	check, ok := storage.As[storage.Exporter](s)
+	if !ok {
+		return Trailer{}, migrate.ErrUnsupported
+	}
+
+	existing, err := check.Export(-1, 1)
+	if err != nil {
+		return Trailer{}, err
+	}
+
+	if len(existing) > 0 {
+		return Trailer{}, migrate.ErrNotEmpty
+	}
+
+	t, err := read(r, dst.Import, dst.Reserve)
+	if err != nil {
+		return t, err
+	}
+
+	count, checksum, err := migrate.Sum(check, batchSize)
+	if err != nil {
+		return t, err
+	}
+
+	if count != t.Count || checksum != t.Checksum {
+		return t, fmt.Errorf("%w: snapshot %d links %s, storage %d links %s", migrate.ErrMismatch, t.Count, t.Checksum, count, checksum)
+	}
+
+	return t, nil
+}
+
+// read разбирает снимок и передает ссылки порциями в load, а наибольший ID -
+// в reserve.
+func read(r io.Reader, load func([]mod.Event) error, reserve func(int) error) (Trailer, error) {
+	var t Trailer
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return t, fmt.Errorf("%w: %s", ErrCorrupt, err)
+	}
+	defer gz.Close()
+
+	dec := json.NewDecoder(gz)
+
+	var rec record
+	if err = dec.Decode(&rec); err != nil || rec.Header == nil {
+		return t, fmt.Errorf("%w: missing header", ErrCorrupt)
+	}
+
+	if rec.Header.Version != Version {
+		return t, fmt.Errorf("%w: %d", ErrVersion, rec.Header.Version)
+	}
+
+	sum := migrate.NewChecksum()
+	batch := make([]mod.Event, 0, batchSize)
+	last := -1
+
+	for {
+		rec = record{}
+		if err = dec.Decode(&rec); err != nil {
+			return t, fmt.Errorf("%w: %s", ErrCorrupt, err)
+		}
+
+		if rec.End != nil {
+			break
+		}
+
+		if rec.Link == nil || rec.Link.ID <= last {
+			return t, fmt.Errorf("%w: bad link after %d", ErrCorrupt, last)
+		}
+
+		last = rec.Link.ID
+		sum.Add(*rec.Link)
+		batch = append(batch, *rec.Link)
+
+		if len(batch) == batchSize {
+			if err = load(batch); err != nil {
+				return t, err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	t = *rec.End
+	if sum.Count() != t.Count || sum.String() != t.Checksum || t.LastID < last {
+		return t, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+
+	if _, err = dec.Token(); err != io.EOF {
+		return t, fmt.Errorf("%w: data after the end", ErrCorrupt)
+	}
+
+	if len(batch) > 0 {
+		if err = load(batch); err != nil {
+			return t, err
+		}
+	}
+
+	if reserve != nil {
+		if err = reserve(t.LastID); err != nil {
+			return t, err
+		}
+	}
+
+	return t, nil
+}
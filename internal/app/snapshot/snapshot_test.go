@@ -0,0 +1,179 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"main/internal/app/config"
+	"main/internal/app/migrate"
+	"main/internal/app/storage"
+	mod "main/internal/app/storage/model"
+)
+
+func fill(t *testing.T, s storage.Storage) {
+	_, err := s.BatchAdd([]string{"https://ya.ru/0", "https://ya.ru/1", "https://ya.ru/2"}, "user")
+	require.NoError(t, err)
+
+	_, err = s.AddAlias("https://ya.ru/alias", "alias", "other")
+	require.NoError(t, err)
+
+	_, err = s.Add("https://ya.ru/purged", "user", mod.Settings{})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Click("alias"))
+	require.NoError(t, s.Update("0", "https://ya.ru/edited", "user"))
+
+	s.(storage.Deleter).BatchUpdate([]string{"4"}, "user")
+	require.Eventually(t, func() bool {
+		n, err := s.Purge(time.Now().Add(time.Hour))
+		return err == nil && n > 0
+	}, time.Second, 10*time.Millisecond)
+
+	s.(storage.Deleter).BatchUpdate([]string{"1"}, "user")
+	require.Eventually(t, func() bool {
+		trash, err := s.Trash("user", time.Time{})
+		return err == nil && len(trash) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+// check проверяет, что в хранилище восстановлены данные fill.
+func check(t *testing.T, s storage.Storage) {
+	url, del, err := s.Get("alias")
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/alias", url)
+	assert.False(t, del)
+
+	_, del, err = s.Get("1")
+	require.NoError(t, err)
+	assert.True(t, del)
+
+	history, err := s.History("0", "user")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "https://ya.ru/0", history[0].URL)
+
+	id, err := s.Add("https://ya.ru/new", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.Equal(t, "5", id)
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	memory := config.Config{StorageBackend: storage.Memory, ServerAddress: "localhost:8080/"}
+	file := config.Config{StorageBackend: storage.File, FileStoragePath: filepath.Join(dir, "links.json"), ServerAddress: "localhost:8080/"}
+
+	src, err := storage.Open(memory)
+	require.NoError(t, err)
+	fill(t, src)
+
+	var buf bytes.Buffer
+	written, err := Write(&buf, src)
+	require.NoError(t, err)
+	assert.Equal(t, 4, written.Count)
+	assert.Equal(t, 4, written.LastID)
+
+	// InMemory -> InFile.
+	dst, err := storage.Open(file)
+	require.NoError(t, err)
+
+	restored, err := Restore(bytes.NewReader(buf.Bytes()), dst)
+	require.NoError(t, err)
+	assert.Equal(t, written, restored)
+
+	_, err = Restore(bytes.NewReader(buf.Bytes()), dst)
+	assert.ErrorIs(t, err, migrate.ErrNotEmpty)
+	require.NoError(t, dst.(storage.Closer).Close())
+
+	// Восстановленные ссылки переживают перезапуск файлового хранилища.
+	dst, err = storage.Open(file)
+	require.NoError(t, err)
+	count, checksum, err := migrate.Sum(dst.(storage.Exporter), 10)
+	require.NoError(t, err)
+	assert.Equal(t, written.Count, count)
+	assert.Equal(t, written.Checksum, checksum)
+
+	buf.Reset()
+	_, err = Write(&buf, dst)
+	require.NoError(t, err)
+	require.NoError(t, dst.(storage.Closer).Close())
+
+	// InFile -> InMemory.
+	dst, err = storage.Open(memory)
+	require.NoError(t, err)
+
+	restored, err = Restore(bytes.NewReader(buf.Bytes()), dst)
+	require.NoError(t, err)
+	assert.Equal(t, written.Checksum, restored.Checksum)
+	check(t, dst)
+
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("DATABASE_DSN is not set")
+	}
+
+	// InDB -> InMemory -> InDB.
+	db, err := storage.Open(config.Config{StorageBackend: storage.Postgres, DataBaseDSN: dsn, ServerAddress: "localhost:8080/"})
+	require.NoError(t, err)
+	defer db.(storage.Closer).Close()
+
+	existing, err := db.(storage.Exporter).Export(-1, 1)
+	require.NoError(t, err)
+	if len(existing) > 0 {
+		t.Skip("database is not empty")
+	}
+
+	restored, err = Restore(bytes.NewReader(buf.Bytes()), db)
+	require.NoError(t, err)
+	assert.Equal(t, written.Checksum, restored.Checksum)
+	check(t, db)
+}
+
+func TestCorrupt(t *testing.T) {
+	s, err := storage.Open(config.Config{StorageBackend: storage.Memory})
+	require.NoError(t, err)
+
+	_, err = s.BatchAdd([]string{"https://ya.ru/0", "https://ya.ru/1"}, "user")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = Write(&buf, s)
+	require.NoError(t, err)
+
+	_, err = Verify(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	_, err = Verify(bytes.NewReader(buf.Bytes()[:buf.Len()-10]))
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	_, err = Verify(strings.NewReader("not a snapshot"))
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	gz, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(gz)
+	require.NoError(t, err)
+
+	rewrite := func(old, new string) io.Reader {
+		var out bytes.Buffer
+		w := gzip.NewWriter(&out)
+		_, err := w.Write([]byte(strings.Replace(string(plain), old, new, 1)))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return &out
+	}
+
+	_, err = Verify(rewrite("https://ya.ru/1", "https://ya.ru/2"))
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	_, err = Verify(rewrite(`"version":1`, `"version":2`))
+	assert.ErrorIs(t, err, ErrVersion)
+}
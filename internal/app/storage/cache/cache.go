@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"main/internal/app/config"
+	mod "main/internal/app/storage/model"
+)
+
+// Entry - закешированный результат Storage.Link.
+type Entry struct {
+	URL      string       `json:"url,omitempty"`
+	Del      bool         `json:"del,omitempty"`
+	Created  time.Time    `json:"created,omitempty"`
+	Clicks   int          `json:"clicks,omitempty"` // на момент кеширования
+	Settings mod.Settings `json:"settings"`
+	// Missing - ссылка не найдена (негативное кеширование).
+	Missing bool `json:"missing,omitempty"`
+}
+
+// Cache хранит результаты Storage.Link по короткому коду.
+type Cache interface {
+	Get(key string) (Entry, bool, error)
+	Set(key string, e Entry, ttl time.Duration) error
+	Delete(keys ...string) error
+	Flush() error
+}
+
+// New возвращает кеш, выбранный в конфигурации, или nil, если кеш выключен.
+func New(conf config.Config) (Cache, error) {
+	if conf.CacheRedisAddr != "" {
+		return NewRedis(conf.CacheRedisAddr)
+	}
+
+	if conf.CacheSize > 0 {
+		return NewLRU(conf.CacheSize), nil
+	}
+
+	return nil, nil
+}
+
+type lruItem struct {
+	key     string
+	entry   Entry
+	expires time.Time
+}
+
+// LRU - кеш в памяти процесса, вытесняющий давно не использованные записи.
+type LRU struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func NewLRU(size int) *LRU {
+	return &LRU{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *LRU) Get(key string) (Entry, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return Entry{}, false, nil
+	}
+
+	item := el.Value.(*lruItem)
+	if time.Now().After(item.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return Entry{}, false, nil
+	}
+
+	c.order.MoveToFront(el)
+
+	return item.entry, true, nil
+}
+
+func (c *LRU) Set(key string, e Entry, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		item := el.Value.(*lruItem)
+		item.entry, item.expires = e, time.Now().Add(ttl)
+		c.order.MoveToFront(el)
+		return nil
+	}
+
+	c.items[key] = c.order.PushFront(&lruItem{key: key, entry: e, expires: time.Now().Add(ttl)})
+
+	for c.order.Len() > c.size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.items, el.Value.(*lruItem).key)
+	}
+
+	return nil
+}
+
+func (c *LRU) Delete(keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if el, ok := c.items[key]; ok {
+			c.order.Remove(el)
+			delete(c.items, key)
+		}
+	}
+
+	return nil
+}
+
+func (c *LRU) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+
+	return nil
+}
+
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// redisPrefix - префикс ключей кеша в Redis.
+const redisPrefix = "shortener:cache:"
+
+// Redis - кеш в Redis, общий для нескольких экземпляров сервиса. Размер
+// ограничивается настройкой maxmemory самого Redis.
+type Redis struct {
+	client *redis.Client
+}
+
+func NewRedis(addr string) (*Redis, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	return &Redis{client: client}, nil
+}
+
+func (c *Redis) Get(key string) (Entry, bool, error) {
+	var e Entry
+
+	b, err := c.client.Get(context.Background(), redisPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return e, false, nil
+	} else if err != nil {
+		return e, false, err
+	}
+
+	if err = json.Unmarshal(b, &e); err != nil {
+		return e, false, err
+	}
+
+	return e, true, nil
+}
+
+func (c *Redis) Set(key string, e Entry, ttl time.Duration) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return c.client.Set(context.Background(), redisPrefix+key, b, ttl).Err()
+}
+
+func (c *Redis) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = redisPrefix + key
+	}
+
+	return c.client.Del(context.Background(), prefixed...).Err()
+}
+
+func (c *Redis) Flush() error {
+	ctx := context.Background()
+
+	iter := c.client.Scan(ctx, 0, redisPrefix+"*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return c.client.Del(ctx, keys...).Err()
+}
+
+func (c *Redis) Close() error {
+	return c.client.Close()
+}
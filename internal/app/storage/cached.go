@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"main/internal/app/storage/cache"
+	mod "main/internal/app/storage/model"
+)
+
+// Cached - Storage с read-through кешем Get и Link. Записи сбрасываются при
+// изменении, удалении и восстановлении ссылок. Число переходов в кеше не
+// обновляется и может отставать на время жизни записи.
+type Cached struct {
+	Storage
+	cache       cache.Cache
+	ttl         time.Duration
+	negativeTTL time.Duration
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	// writing - число незавершенных изменений по ключам ссылок, epoch -
+	// число завершенных. Ссылка не кешируется, пока ее меняют или если
+	// изменение завершилось после чтения: прочитанное состояние устарело.
+	mu      sync.Mutex
+	writing map[string]int
+	epoch   uint64
+}
+
+// NewCached оборачивает хранилище кешем. Удаление поддерживается, если его
+// поддерживает s.
+func NewCached(s Storage, c cache.Cache, ttl, negativeTTL time.Duration) Storage {
+	cached := &Cached{Storage: s, cache: c, ttl: ttl, negativeTTL: negativeTTL, writing: make(map[string]int)}
+
+	if deleter, ok := As[Deleter](s); ok {
+		return &cachedDeleter{Cached: cached, deleter: deleter}
+	}
+
+	return cached
+}
+
+// Unwrap возвращает хранилище под кешем.
+func (c *Cached) Unwrap() Storage {
+	return c.Storage
+}
+
+// Stats возвращает количество попаданий и промахов кеша.
+func (c *Cached) Stats() (hits, misses uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+func (c *Cached) Get(str string) (string, bool, error) {
+	e, err := c.Link(str)
+	if err != nil {
+		return "", false, err
+	}
+
+	if e.Del {
+		return "", true, nil
+	}
+
+	return e.URL, false, nil
+}
+
+// Link отдает ссылку из кеша без ID, кода и владельца.
+func (c *Cached) Link(str string) (mod.Event, error) {
+	e, ok, err := c.cache.Get(str)
+	if err != nil {
+		log.Print("CACHE: get err: ", err)
+	}
+
+	if ok {
+		c.hits.Add(1)
+		if e.Missing {
+			return mod.Event{}, mod.ErrStorageIsNil
+		}
+		return mod.Event{URL: e.URL, Del: e.Del, Created: e.Created, Clicks: e.Clicks, Settings: e.Settings}, nil
+	}
+
+	c.misses.Add(1)
+
+	c.mu.Lock()
+	epoch := c.epoch
+	c.mu.Unlock()
+
+	link, err := c.Storage.Link(str)
+	switch {
+	case err == nil:
+		c.set(str, cache.Entry{URL: link.URL, Del: link.Del, Created: link.Created, Clicks: link.Clicks, Settings: link.Settings}, c.ttl, epoch)
+	case errors.Is(err, mod.ErrStorageIsNil) && c.negativeTTL > 0:
+		c.set(str, cache.Entry{Missing: true}, c.negativeTTL, epoch)
+	}
+
+	return link, err
+}
+
+// set кеширует ссылку, прочитанную в эпоху epoch, если с тех пор ссылки не
+// менялись.
+func (c *Cached) set(str string, e cache.Entry, ttl time.Duration, epoch uint64) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	stale := c.writing[str] > 0 || c.epoch != epoch
+	c.mu.Unlock()
+
+	if stale {
+		return
+	}
+
+	if err := c.cache.Set(str, e, ttl); err != nil {
+		log.Print("CACHE: set err: ", err)
+	}
+}
+
+func (c *Cached) invalidate(keys ...string) {
+	if err := c.cache.Delete(keys...); err != nil {
+		log.Print("CACHE: delete err: ", err)
+	}
+}
+
+// Add сбрасывает кеш нового кода: он мог быть закеширован как отсутствующий.
+func (c *Cached) Add(url, user string, s mod.Settings) (string, error) {
+	id, err := c.Storage.Add(url, user, s)
+	if id != "" {
+		c.invalidate(id)
+	}
+
+	return id, err
+}
+
+func (c *Cached) AddAlias(url, alias, user string) (string, error) {
+	id, err := c.Storage.AddAlias(url, alias, user)
+	c.invalidate(alias)
+
+	return id, err
+}
+
+func (c *Cached) BatchAdd(urls []string, user string) ([]string, error) {
+	ids, err := c.Storage.BatchAdd(urls, user)
+	c.invalidate(ids...)
+
+	return ids, err
+}
+
+// cachedDeleter - Cached над хранилищем, поддерживающим удаление.
+type cachedDeleter struct {
+	*Cached
+	deleter Deleter
+}
+
+// BatchUpdate удаляет ссылки в фоне через Delete, чтобы сбросить их кеш,
+// когда удаление завершится.
+func (c *cachedDeleter) BatchUpdate(ids []string, user string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	c.hold(ids)
+
+	go func() {
+		if _, err := c.delete(ids, user); err != nil {
+			log.Print("CACHE: delete err: ", err)
+		}
+	}()
+}
+
+// Delete удаляет ссылки сразу и сбрасывает их кеш после удаления.
+func (c *cachedDeleter) Delete(ids []string, user string) (map[string]string, error) {
+	c.hold(ids)
+
+	return c.delete(ids, user)
+}
+
+// delete удаляет ссылки, отложенные hold, и снова разрешает их кешировать.
+func (c *cachedDeleter) delete(ids []string, user string) (map[string]string, error) {
+	defer c.release(ids)
+
+	return c.deleter.Delete(ids, user)
+}
+
+// hold запрещает кешировать ссылки до release.
+func (c *Cached) hold(ids []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range ids {
+		c.writing[id]++
+	}
+}
+
+// release снимает запрет hold и сбрасывает кеш ссылок: запись могла попасть
+// в кеш до или во время изменения. Прочитанные до release ссылки больше не
+// кешируются.
+func (c *Cached) release(ids []string) {
+	c.mu.Lock()
+	for _, id := range ids {
+		if c.writing[id]--; c.writing[id] <= 0 {
+			delete(c.writing, id)
+		}
+	}
+	c.epoch++
+	c.mu.Unlock()
+
+	c.invalidate(ids...)
+}
+
+func (c *Cached) Update(str, url, user string) error {
+	c.hold([]string{str})
+	defer c.release([]string{str})
+
+	return c.Storage.Update(str, url, user)
+}
+
+func (c *Cached) Configure(str string, edit func(*mod.Settings) error, user string) error {
+	c.hold([]string{str})
+	defer c.release([]string{str})
+
+	return c.Storage.Configure(str, edit, user)
+}
+
+func (c *Cached) Restore(ids []string, user string, since time.Time) ([]string, error) {
+	c.hold(ids)
+	defer c.release(ids)
+
+	return c.Storage.Restore(ids, user, since)
+}
+
+func (c *Cached) Purge(before time.Time) (int, error) {
+	n, err := c.Storage.Purge(before)
+	if n > 0 {
+		if err := c.cache.Flush(); err != nil {
+			log.Print("CACHE: flush err: ", err)
+		}
+	}
+
+	return n, err
+}
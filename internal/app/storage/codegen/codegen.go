@@ -0,0 +1,202 @@
+package codegen
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"main/internal/app/config"
+	mod "main/internal/app/storage/model"
+)
+
+const (
+	Counter    = "counter"
+	Random     = "random"
+	Obfuscated = "obfuscated"
+	Hash       = "hash"
+)
+
+// MaxAttempts - сколько раз генератор вызывается для одной ссылки, пока код
+// не окажется свободным.
+const MaxAttempts = 10
+
+var ErrCodesExhausted = errors.New("no free short code found")
+
+const alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// CodeGenerator выдает короткие коды новых ссылок.
+type CodeGenerator interface {
+	// Generate возвращает код для ссылки url с порядковым номером id.
+	// attempt увеличивается, если предыдущий код уже занят.
+	Generate(id int, url string, attempt int) (string, error)
+}
+
+// New возвращает генератор, выбранный в конфигурации.
+func New(conf config.Config) (CodeGenerator, error) {
+	switch conf.CodeGenerator {
+	case "", Counter:
+		return CounterGenerator{}, nil
+	case Random:
+		return NewRandom(conf.CodeLength)
+	case Obfuscated:
+		return NewObfuscated(conf.CodeKey)
+	case Hash:
+		return NewHash(conf.CodeLength, conf.CodeNamespace)
+	default:
+		return nil, fmt.Errorf("unknown code generator: %s", conf.CodeGenerator)
+	}
+}
+
+// CounterGenerator выдает ID ссылки в base36. Если код занят псевдонимом,
+// выдает сдвинутый код (mod.ShiftedCode).
+type CounterGenerator struct{}
+
+func (CounterGenerator) Generate(id int, _ string, attempt int) (string, error) {
+	code := strconv.FormatInt(int64(id), 36)
+
+	switch attempt {
+	case 0:
+		return code, nil
+	case 1:
+		return mod.ShiftedCode(code), nil
+	default:
+		return "", ErrCodesExhausted
+	}
+}
+
+// RandomGenerator выдает случайные base62 коды.
+type RandomGenerator struct {
+	length int
+}
+
+func NewRandom(length int) (*RandomGenerator, error) {
+	if length < 4 {
+		return nil, fmt.Errorf("code length must be at least 4, got %d", length)
+	}
+
+	return &RandomGenerator{length: length}, nil
+}
+
+func (g *RandomGenerator) Generate(_ int, _ string, _ int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+
+	var b strings.Builder
+	for i := 0; i < g.length; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(alphabet[n.Int64()])
+	}
+
+	return b.String(), nil
+}
+
+// feistelBits - размер области значений перестановки. ID ссылок должны быть
+// меньше 2^feistelBits.
+const (
+	feistelBits   = 40
+	feistelHalf   = feistelBits / 2
+	feistelMask   = 1<<feistelHalf - 1
+	feistelRounds = 4
+)
+
+// ObfuscatedGenerator переставляет ID сетью Фейстеля с секретным ключом:
+// коды выглядят случайными, но однозначно соответствуют ID. При коллизии
+// перестановка повторяется с другим раундовым ключом.
+type ObfuscatedGenerator struct {
+	key []byte
+}
+
+func NewObfuscated(key string) (*ObfuscatedGenerator, error) {
+	if key == "" {
+		return nil, errors.New("obfuscated code generator requires a key")
+	}
+
+	return &ObfuscatedGenerator{key: []byte(key)}, nil
+}
+
+func (g *ObfuscatedGenerator) Generate(id int, _ string, attempt int) (string, error) {
+	if id < 0 || uint64(id) >= 1<<feistelBits {
+		return "", fmt.Errorf("id %d is out of obfuscation range", id)
+	}
+
+	return encode(new(big.Int).SetUint64(g.feistel(uint64(id), attempt))), nil
+}
+
+func (g *ObfuscatedGenerator) feistel(v uint64, attempt int) uint64 {
+	l, r := v>>feistelHalf, v&feistelMask
+
+	var buf [16]byte
+	for round := 0; round < feistelRounds; round++ {
+		binary.BigEndian.PutUint32(buf[0:], uint32(attempt))
+		binary.BigEndian.PutUint32(buf[4:], uint32(round))
+		binary.BigEndian.PutUint64(buf[8:], r)
+
+		mac := hmac.New(sha256.New, g.key)
+		mac.Write(buf[:])
+		f := binary.BigEndian.Uint64(mac.Sum(nil)) & feistelMask
+
+		l, r = r, l^f
+	}
+
+	return l<<feistelHalf | r
+}
+
+// HashGenerator выдает начало base62 записи SHA-256 от пространства имен и
+// ссылки: одна и та же ссылка получает один и тот же код на любом экземпляре
+// сервиса. Ссылка хешируется как есть, как ее сравнивают хранилища: разные
+// записи одного адреса - разные ссылки с разными кодами. При коллизии код
+// удлиняется на символ.
+type HashGenerator struct {
+	length    int
+	namespace string
+}
+
+func NewHash(length int, namespace string) (*HashGenerator, error) {
+	if length < 4 {
+		return nil, fmt.Errorf("code length must be at least 4, got %d", length)
+	}
+
+	return &HashGenerator{length: length, namespace: namespace}, nil
+}
+
+func (g *HashGenerator) Generate(_ int, rawURL string, attempt int) (string, error) {
+	sum := sha256.Sum256([]byte(g.namespace + "\n" + rawURL))
+	code := encode(new(big.Int).SetBytes(sum[:]))
+
+	n := g.length + attempt
+	if n > len(code) {
+		return "", ErrCodesExhausted
+	}
+
+	return code[:n], nil
+}
+
+func encode(v *big.Int) string {
+	if v.Sign() == 0 {
+		return alphabet[:1]
+	}
+
+	base := big.NewInt(int64(len(alphabet)))
+	mod := new(big.Int)
+	v = new(big.Int).Set(v)
+
+	var b []byte
+	for v.Sign() > 0 {
+		v.DivMod(v, base, mod)
+		b = append(b, alphabet[mod.Int64()])
+	}
+
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+
+	return string(b)
+}
@@ -0,0 +1,595 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"main/internal/app/config"
+	mod "main/internal/app/storage/model"
+)
+
+// conformanceBackend открывает пустое хранилище для одного теста.
+type conformanceBackend struct {
+	name string
+	open func(t *testing.T) Storage
+}
+
+func conformanceBackends() []conformanceBackend {
+	closeOnCleanup := func(t *testing.T, c Storage) Storage {
+		if closer, ok := c.(Closer); ok {
+			t.Cleanup(func() {
+				_ = closer.Close()
+			})
+		}
+
+		return c
+	}
+
+	open := func(t *testing.T, conf config.Config) Storage {
+		conf.ServerAddress = "localhost:8080/"
+
+		c, err := Open(conf)
+		require.NoError(t, err)
+
+		return closeOnCleanup(t, c)
+	}
+
+	backends := []conformanceBackend{
+		{name: Memory, open: func(t *testing.T) Storage {
+			return open(t, config.Config{StorageBackend: Memory})
+		}},
+		{name: "durable", open: func(t *testing.T) Storage {
+			return open(t, config.Config{StorageBackend: Memory, MemorySnapshotPath: filepath.Join(t.TempDir(), "memory.snapshot")})
+		}},
+		{name: File, open: func(t *testing.T) Storage {
+			return open(t, config.Config{StorageBackend: File, FileStoragePath: filepath.Join(t.TempDir(), "storage.json")})
+		}},
+		{name: Redis, open: func(t *testing.T) Storage {
+			return open(t, config.Config{StorageBackend: Redis, RedisAddr: miniredis.RunT(t).Addr()})
+		}},
+		{name: Embedded, open: func(t *testing.T) Storage {
+			return open(t, config.Config{StorageBackend: Embedded, EmbeddedPath: filepath.Join(t.TempDir(), "shortener.db")})
+		}},
+	}
+
+	// Postgres проверяется, если задан DATABASE_DSN. База общая для всех
+	// тестов, поэтому тесты используют уникальные ссылки, псевдонимы и
+	// пользователей.
+	if dsn := os.Getenv("DATABASE_DSN"); dsn != "" {
+		backends = append(backends, conformanceBackend{name: Postgres, open: func(t *testing.T) Storage {
+			return open(t, config.Config{StorageBackend: Postgres, DataBaseDSN: dsn})
+		}})
+	}
+
+	return backends
+}
+
+var conformanceSeq atomic.Int64
+
+// unique возвращает строку, уникальную в пределах запуска тестов.
+func unique(prefix string) string {
+	return prefix + strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatInt(conformanceSeq.Add(1), 36)
+}
+
+// set возвращает изменение, заменяющее параметры ссылки на s.
+func set(s mod.Settings) func(*mod.Settings) error {
+	return func(v *mod.Settings) error {
+		*v = s
+		return nil
+	}
+}
+
+func waitDeleted(t *testing.T, c Storage, code string) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		_, del, err := c.Get(code)
+		return err == nil && del
+	}, time.Second, 10*time.Millisecond)
+}
+
+var conformanceCases = []struct {
+	name string
+	run  func(t *testing.T, c Storage)
+}{
+	{"add and get", func(t *testing.T, c Storage) {
+		url := unique("https://ya.ru/")
+
+		code, err := c.Add(url, unique("user"), mod.Settings{})
+		require.NoError(t, err)
+		assert.NotEmpty(t, code)
+
+		got, del, err := c.Get(code)
+		require.NoError(t, err)
+		assert.False(t, del)
+		assert.Equal(t, url, got)
+
+		_, _, err = c.Get(unique("missing"))
+		assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+	}},
+	{"alias conflicts", func(t *testing.T, c Storage) {
+		user, alias := unique("user"), unique("alias")
+
+		code, err := c.AddAlias(unique("https://ya.ru/"), alias, user)
+		require.NoError(t, err)
+		assert.Equal(t, alias, code)
+
+		_, err = c.AddAlias(unique("https://ya.ru/"), alias, unique("user"))
+		assert.ErrorIs(t, err, mod.ErrAliasConflict)
+
+		_, err = c.AddAlias(unique("https://ya.ru/"), "0"+alias, user)
+		assert.ErrorIs(t, err, mod.ErrInvalidAlias)
+
+		_, err = c.AddAlias(unique("https://ya.ru/"), "bad alias", user)
+		assert.ErrorIs(t, err, mod.ErrInvalidAlias)
+	}},
+	{"alias shadows counter code", func(t *testing.T, c Storage) {
+		user := unique("user")
+
+		// Следующий код счетчика занимается псевдонимом заранее.
+		last, err := c.Add(unique("https://ya.ru/"), user, mod.Settings{})
+		require.NoError(t, err)
+		n, err := strconv.ParseInt(last, 36, 64)
+		require.NoError(t, err)
+		next := strconv.FormatInt(n+2, 36)
+
+		_, err = c.AddAlias("https://ya.ru/"+next, next, user)
+		if err != nil {
+			t.Skip("counter code is not a valid alias: ", next)
+		}
+
+		code, err := c.Add(unique("https://ya.ru/"), user, mod.Settings{})
+		require.NoError(t, err)
+		assert.NotEqual(t, next, code)
+
+		url, _, err := c.Get(next)
+		require.NoError(t, err)
+		assert.Equal(t, "https://ya.ru/"+next, url)
+	}},
+	{"batch keeps order", func(t *testing.T, c Storage) {
+		user := unique("user")
+		urls := []string{unique("https://ya.ru/"), unique("https://ya.ru/"), unique("https://ya.ru/")}
+
+		codes, err := c.BatchAdd(urls, user)
+		require.NoError(t, err)
+		require.Len(t, codes, len(urls))
+
+		for i, code := range codes {
+			url, _, err := c.Get(code)
+			require.NoError(t, err)
+			assert.Equal(t, urls[i], url)
+		}
+
+		assert.NotEqual(t, codes[0], codes[1])
+		assert.NotEqual(t, codes[1], codes[2])
+	}},
+	{"duplicate url", func(t *testing.T, c Storage) {
+		user, url := unique("user"), unique("https://ya.ru/")
+
+		code, err := c.Add(url, user, mod.Settings{})
+		require.NoError(t, err)
+
+		again, err := c.Add(url, unique("user"), mod.Settings{})
+		assert.ErrorIs(t, err, mod.ErrURLConflict)
+		assert.Equal(t, code, again)
+
+		again, err = c.AddAlias(url, unique("alias"), user)
+		assert.ErrorIs(t, err, mod.ErrURLConflict)
+		assert.Equal(t, code, again)
+
+		fresh := unique("https://ya.ru/")
+		codes, err := c.BatchAdd([]string{fresh, url, fresh}, user)
+		var conflict *mod.BatchConflictError
+		require.ErrorAs(t, err, &conflict)
+		assert.Equal(t, []int{1, 2}, conflict.Exists)
+		require.Len(t, codes, 3)
+		assert.Equal(t, code, codes[1])
+		assert.Equal(t, codes[0], codes[2])
+
+		got, _, err := c.Get(codes[2])
+		require.NoError(t, err)
+		assert.Equal(t, fresh, got)
+
+		other, err := c.Add(unique("https://ya.ru/"), user, mod.Settings{})
+		require.NoError(t, err)
+		assert.ErrorIs(t, c.Update(other, url, user), mod.ErrURLConflict)
+	}},
+	{"duplicate of deleted url", func(t *testing.T, c Storage) {
+		user, other, url := unique("user"), unique("user"), unique("https://ya.ru/")
+
+		code, err := c.Add(url, user, mod.Settings{})
+		require.NoError(t, err)
+
+		c.(Deleter).BatchUpdate([]string{code}, user)
+		waitDeleted(t, c, code)
+
+		// Для адреса удаленной ссылки создается новая ссылка, удаленная
+		// остается в корзине прежнего владельца.
+		again, err := c.Add(url, other, mod.Settings{})
+		require.NoError(t, err)
+		assert.NotEqual(t, code, again)
+
+		got, del, err := c.Get(again)
+		require.NoError(t, err)
+		assert.False(t, del)
+		assert.Equal(t, url, got)
+
+		_, del, err = c.Get(code)
+		require.NoError(t, err)
+		assert.True(t, del)
+
+		all, err := c.GetAll(other)
+		require.NoError(t, err)
+		require.Len(t, all, 1)
+
+		trash, err := c.Trash(user, time.Time{})
+		require.NoError(t, err)
+		require.Len(t, trash, 1)
+		assert.Equal(t, "http://localhost:8080/"+code, trash[0].ShortURL)
+
+		// Пока адрес занят, удаленная ссылка не восстанавливается.
+		restored, err := c.Restore([]string{code}, user, time.Time{})
+		require.NoError(t, err)
+		assert.Empty(t, restored)
+
+		_, err = c.Add(url, user, mod.Settings{})
+		assert.ErrorIs(t, err, mod.ErrURLConflict)
+
+		res, err := c.(Deleter).Delete([]string{again}, other)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{again: mod.DelDeleted}, res)
+
+		restored, err = c.Restore([]string{code}, user, time.Time{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{code}, restored)
+
+		dup, err := c.Add(url, other, mod.Settings{})
+		assert.ErrorIs(t, err, mod.ErrURLConflict)
+		assert.Equal(t, code, dup)
+	}},
+	{"empty batch", func(t *testing.T, c Storage) {
+		codes, err := c.BatchAdd(nil, unique("user"))
+		require.NoError(t, err)
+		assert.Empty(t, codes)
+	}},
+	{"get all", func(t *testing.T, c Storage) {
+		user, other := unique("user"), unique("user")
+
+		codes, err := c.BatchAdd([]string{unique("https://ya.ru/"), unique("https://ya.ru/")}, user)
+		require.NoError(t, err)
+		_, err = c.Add(unique("https://ya.ru/"), other, mod.Settings{})
+		require.NoError(t, err)
+		alias, err := c.AddAlias(unique("https://ya.ru/"), unique("alias"), user)
+		require.NoError(t, err)
+
+		c.(Deleter).BatchUpdate([]string{codes[1]}, user)
+		waitDeleted(t, c, codes[1])
+
+		all, err := c.GetAll(user)
+		require.NoError(t, err)
+		require.Len(t, all, 3)
+
+		for i, code := range []string{codes[0], codes[1], alias} {
+			assert.Equal(t, "http://localhost:8080/"+code, all[i].ShortURL)
+			assert.False(t, all[i].Created.IsZero())
+		}
+		assert.False(t, all[0].Deleted)
+		assert.True(t, all[1].Deleted)
+
+		none, err := c.GetAll(unique("user"))
+		require.NoError(t, err)
+		assert.Empty(t, none)
+	}},
+	{"ownership", func(t *testing.T, c Storage) {
+		user, other := unique("user"), unique("user")
+
+		code, err := c.Add(unique("https://ya.ru/"), user, mod.Settings{})
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, c.Update(code, unique("https://ya.ru/"), other), mod.ErrForbidden)
+
+		_, err = c.History(code, other)
+		assert.ErrorIs(t, err, mod.ErrForbidden)
+
+		c.(Deleter).BatchUpdate([]string{code}, other)
+
+		restored, err := c.Restore([]string{code}, other, time.Time{})
+		require.NoError(t, err)
+		assert.Empty(t, restored)
+
+		// Удаление выполняется асинхронно, даем ему время.
+		time.Sleep(50 * time.Millisecond)
+		_, del, err := c.Get(code)
+		require.NoError(t, err)
+		assert.False(t, del)
+	}},
+	{"delete with results", func(t *testing.T, c Storage) {
+		user, other := unique("user"), unique("user")
+
+		codes, err := c.BatchAdd([]string{unique("https://ya.ru/"), unique("https://ya.ru/")}, user)
+		require.NoError(t, err)
+		foreign, err := c.Add(unique("https://ya.ru/"), other, mod.Settings{})
+		require.NoError(t, err)
+		missing := unique("missing")
+
+		res, err := c.(Deleter).Delete([]string{codes[0], foreign, missing, codes[0]}, user)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			codes[0]: mod.DelDeleted,
+			foreign:  mod.DelForbidden,
+			missing:  mod.DelNotFound,
+		}, res)
+
+		// Удаление синхронное.
+		_, del, err := c.Get(codes[0])
+		require.NoError(t, err)
+		assert.True(t, del)
+
+		_, del, err = c.Get(foreign)
+		require.NoError(t, err)
+		assert.False(t, del)
+
+		res, err = c.(Deleter).Delete([]string{codes[0], codes[1]}, user)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{codes[0]: mod.DelAlreadyDeleted, codes[1]: mod.DelDeleted}, res)
+
+		trash, err := c.Trash(user, time.Time{})
+		require.NoError(t, err)
+		assert.Len(t, trash, 2)
+	}},
+	{"settings", func(t *testing.T, c Storage) {
+		user, url := unique("user"), unique("https://ya.ru/")
+
+		code, err := c.Add(url, user, mod.Settings{})
+		require.NoError(t, err)
+
+		link, err := c.Link(code)
+		require.NoError(t, err)
+		assert.Equal(t, url, link.URL)
+		assert.Equal(t, user, link.UserID)
+		assert.False(t, link.Created.IsZero())
+		assert.Equal(t, mod.Settings{}, link.Settings)
+
+		from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		settings := mod.Settings{Title: "Квартальный отчет", Preview: true, Redirect: 308, PasswordHash: "$2a$10$hash", MaxClicks: 10,
+			Rules: []mod.Rule{
+				{ID: 1, URL: "https://apps.apple.com/app", Platforms: []string{"ios"}},
+				{ID: 2, URL: "https://ya.ru/en", Languages: []string{"en"}, Countries: []string{"GB", "US"}, From: &from},
+			}}
+		assert.ErrorIs(t, c.Configure(code, set(settings), unique("user")), mod.ErrForbidden)
+		assert.ErrorIs(t, c.Configure(unique("missing"), set(settings), user), mod.ErrStorageIsNil)
+		require.NoError(t, c.Configure(code, set(settings), user))
+
+		require.NoError(t, c.Click(code))
+
+		link, err = c.Link(code)
+		require.NoError(t, err)
+		assert.Equal(t, settings, link.Settings)
+		assert.Equal(t, 1, link.Clicks)
+
+		// Адрес меняется без потери параметров.
+		require.NoError(t, c.Update(code, unique("https://ya.ru/"), user))
+		link, err = c.Link(code)
+		require.NoError(t, err)
+		assert.Equal(t, settings, link.Settings)
+
+		_, err = c.Link(unique("missing"))
+		assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+
+		// Параметры задаются вместе с созданием ссылки, существующая ссылка
+		// их не получает.
+		url = unique("https://ya.ru/")
+		code, err = c.Add(url, user, settings)
+		require.NoError(t, err)
+
+		link, err = c.Link(code)
+		require.NoError(t, err)
+		assert.Equal(t, settings, link.Settings)
+
+		again, err := c.Add(url, unique("user"), mod.Settings{Title: "Чужой"})
+		assert.ErrorIs(t, err, mod.ErrURLConflict)
+		assert.Equal(t, code, again)
+
+		link, err = c.Link(code)
+		require.NoError(t, err)
+		assert.Equal(t, settings, link.Settings)
+	}},
+	{"configure edits current settings", func(t *testing.T, c Storage) {
+		user := unique("user")
+
+		code, err := c.Add(unique("https://ya.ru/"), user, mod.Settings{Title: "Отчет"})
+		require.NoError(t, err)
+
+		// Ошибка изменения возвращается, параметры не меняются.
+		failed := errors.New("failed")
+		assert.ErrorIs(t, c.Configure(code, func(s *mod.Settings) error {
+			s.Title = "Черновик"
+			return failed
+		}, user), failed)
+
+		// Одновременные изменения видят друг друга и не теряются.
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				assert.NoError(t, c.Configure(code, func(s *mod.Settings) error {
+					s.MaxClicks++
+					s.Rules = append(append([]mod.Rule(nil), s.Rules...), mod.Rule{ID: i + 1, URL: "https://ya.ru/rule"})
+					return nil
+				}, user))
+			}(i)
+		}
+		wg.Wait()
+
+		link, err := c.Link(code)
+		require.NoError(t, err)
+		assert.Equal(t, "Отчет", link.Title)
+		assert.Equal(t, 20, link.MaxClicks)
+		assert.Len(t, link.Rules, 20)
+	}},
+	{"max clicks", func(t *testing.T, c Storage) {
+		user := unique("user")
+
+		code, err := c.Add(unique("https://ya.ru/"), user, mod.Settings{})
+		require.NoError(t, err)
+		require.NoError(t, c.Configure(code, set(mod.Settings{MaxClicks: 5}), user))
+
+		// Одновременные переходы не превышают ограничение.
+		var clicked, exhausted atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				switch err := c.Click(code); {
+				case err == nil:
+					clicked.Add(1)
+				case errors.Is(err, mod.ErrExhausted):
+					exhausted.Add(1)
+				default:
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int64(5), clicked.Load())
+		assert.Equal(t, int64(15), exhausted.Load())
+
+		link, err := c.Link(code)
+		require.NoError(t, err)
+		assert.Equal(t, 5, link.Clicks)
+		assert.True(t, link.Exhausted())
+
+		// Поднятое ограничение снова пропускает переходы.
+		require.NoError(t, c.Configure(code, set(mod.Settings{MaxClicks: 6}), user))
+		require.NoError(t, c.Click(code))
+		assert.ErrorIs(t, c.Click(code), mod.ErrExhausted)
+
+		assert.ErrorIs(t, c.Click(unique("missing")), mod.ErrStorageIsNil)
+	}},
+	{"update and history", func(t *testing.T, c Storage) {
+		user, first, second := unique("user"), unique("https://ya.ru/"), unique("https://ya.ru/")
+
+		code, err := c.Add(first, user, mod.Settings{})
+		require.NoError(t, err)
+
+		require.NoError(t, c.Update(code, second, user))
+		require.NoError(t, c.Update(code, second, user))
+
+		url, _, err := c.Get(code)
+		require.NoError(t, err)
+		assert.Equal(t, second, url)
+
+		history, err := c.History(code, user)
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+		assert.Equal(t, first, history[0].URL)
+
+		assert.ErrorIs(t, c.Update(unique("missing"), second, user), mod.ErrStorageIsNil)
+	}},
+	{"delete, restore and purge", func(t *testing.T, c Storage) {
+		user := unique("user")
+
+		codes, err := c.BatchAdd([]string{unique("https://ya.ru/"), unique("https://ya.ru/")}, user)
+		require.NoError(t, err)
+
+		since := time.Now().Add(-time.Minute)
+		c.(Deleter).BatchUpdate(codes, user)
+		waitDeleted(t, c, codes[0])
+		waitDeleted(t, c, codes[1])
+
+		assert.ErrorIs(t, c.Update(codes[0], unique("https://ya.ru/"), user), mod.ErrStorageIsNil)
+
+		_, err = c.History(codes[0], user)
+		assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+
+		trash, err := c.Trash(user, since)
+		require.NoError(t, err)
+		assert.Len(t, trash, 2)
+
+		trash, err = c.Trash(user, time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		assert.Empty(t, trash)
+
+		// Ссылки, удаленные позже отсечки, не удаляются окончательно.
+		n, err := c.Purge(since)
+		require.NoError(t, err)
+		assert.Zero(t, n)
+
+		restored, err := c.Restore([]string{codes[0]}, user, since)
+		require.NoError(t, err)
+		assert.Equal(t, []string{codes[0]}, restored)
+
+		_, del, err := c.Get(codes[0])
+		require.NoError(t, err)
+		assert.False(t, del)
+
+		n, err = c.Purge(time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, n, 1)
+
+		_, _, err = c.Get(codes[1])
+		assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+
+		restored, err = c.Restore([]string{codes[1]}, user, since)
+		require.NoError(t, err)
+		assert.Empty(t, restored)
+
+		// Код окончательно удаленной ссылки не выдается повторно.
+		code, err := c.Add(unique("https://ya.ru/"), user, mod.Settings{})
+		require.NoError(t, err)
+		assert.NotEqual(t, codes[1], code)
+	}},
+	{"clicks and find", func(t *testing.T, c Storage) {
+		user := unique("user")
+
+		codes, err := c.BatchAdd([]string{unique("https://ya.ru/"), unique("https://ya.ru/"), unique("https://ya.ru/")}, user)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Click(codes[1]))
+		require.NoError(t, c.Click(codes[1]))
+		require.NoError(t, c.Click(codes[2]))
+		assert.ErrorIs(t, c.Click(unique("missing")), mod.ErrStorageIsNil)
+
+		urls, next, err := c.Find(user, mod.Query{Limit: 2, Sort: mod.SortClicks, Desc: true})
+		require.NoError(t, err)
+		require.Len(t, urls, 2)
+		assert.Equal(t, "http://localhost:8080/"+codes[1], urls[0].ShortURL)
+		assert.Equal(t, 2, urls[0].Clicks)
+		assert.Equal(t, "http://localhost:8080/"+codes[2], urls[1].ShortURL)
+		require.NotNil(t, next)
+
+		urls, next, err = c.Find(user, mod.Query{Limit: 2, Sort: mod.SortClicks, Desc: true, After: next})
+		require.NoError(t, err)
+		require.Len(t, urls, 1)
+		assert.Equal(t, "http://localhost:8080/"+codes[0], urls[0].ShortURL)
+		assert.Nil(t, next)
+	}},
+}
+
+func TestConformance(t *testing.T) {
+	for _, backend := range conformanceBackends() {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tc := range conformanceCases {
+				tc := tc
+				t.Run(tc.name, func(t *testing.T) {
+					tc.run(t, backend.open(t))
+				})
+			}
+		})
+	}
+}
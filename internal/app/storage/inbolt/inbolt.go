@@ -0,0 +1,813 @@
+package inbolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"main/internal/app/storage/codegen"
+	mod "main/internal/app/storage/model"
+)
+
+// Бакеты:
+//
+//	links   - ID (8 байт) -> ссылка в JSON
+//	codes   - явно заданный код -> ID
+//	urls    - адрес -> ID, адреса действующих ссылок уникальны
+//	users   - пользователь, 0, ID -> пусто
+//	deleted - время удаления в нс (8 байт), ID -> пусто
+var (
+	linksBucket   = []byte("links")
+	codesBucket   = []byte("codes")
+	urlsBucket    = []byte("urls")
+	usersBucket   = []byte("users")
+	deletedBucket = []byte("deleted")
+)
+
+type InBolt struct {
+	ServerAddress string
+	BaseURL       string
+	EmbeddedPath  string
+	DB            *bbolt.DB
+	// Generator выдает коды новых ссылок. Если nil, используется
+	// codegen.CounterGenerator.
+	Generator codegen.CodeGenerator
+}
+
+func (c *InBolt) StartEmbedded() (*bbolt.DB, error) {
+	db, err := bbolt.Open(c.EmbeddedPath, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{linksBucket, codesBucket, urlsBucket, usersBucket, deletedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (c *InBolt) PingDB(_ context.Context) error {
+	return c.DB.View(func(tx *bbolt.Tx) error {
+		return nil
+	})
+}
+
+func (c *InBolt) Close() error {
+	return c.DB.Close()
+}
+
+func (c *InBolt) generator() codegen.CodeGenerator {
+	if c.Generator == nil {
+		return codegen.CounterGenerator{}
+	}
+
+	return c.Generator
+}
+
+func itob(id int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+func userKey(user string, id int) []byte {
+	return append(append([]byte(user), 0), itob(id)...)
+}
+
+func deletedKey(e mod.Event) []byte {
+	return append(itob(int(e.DelAt.UnixNano())), itob(e.ID)...)
+}
+
+func get(tx *bbolt.Tx, id int) (mod.Event, bool, error) {
+	var e mod.Event
+
+	b := tx.Bucket(linksBucket).Get(itob(id))
+	if b == nil {
+		return e, false, nil
+	}
+
+	return e, true, json.Unmarshal(b, &e)
+}
+
+func put(tx *bbolt.Tx, e mod.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(linksBucket).Put(itob(e.ID), b)
+}
+
+// lookup ищет ссылку по короткому коду. Явно заданные коды имеют приоритет
+// над base36 ID.
+func lookup(tx *bbolt.Tx, str string) (mod.Event, bool, error) {
+	if id := tx.Bucket(codesBucket).Get([]byte(str)); id != nil {
+		return get(tx, int(binary.BigEndian.Uint64(id)))
+	}
+
+	id, err := strconv.ParseInt(str, 36, 64)
+	if err != nil || id < 0 {
+		return mod.Event{}, false, nil
+	}
+
+	e, ok, err := get(tx, int(id))
+	if err != nil || !ok || e.Code != "" {
+		return mod.Event{}, false, err
+	}
+
+	return e, true, nil
+}
+
+// owned ищет неудаленную ссылку пользователя по короткому коду.
+func owned(tx *bbolt.Tx, str, user string) (mod.Event, error) {
+	e, ok, err := lookup(tx, str)
+	if err != nil {
+		return e, err
+	}
+
+	if !ok || e.Del {
+		return e, mod.ErrStorageIsNil
+	}
+
+	if e.UserID != user {
+		return e, mod.ErrForbidden
+	}
+
+	return e, nil
+}
+
+// insert сохраняет новую ссылку и ее индексы.
+func insert(tx *bbolt.Tx, e mod.Event) error {
+	if err := put(tx, e); err != nil {
+		return err
+	}
+
+	if e.Code != "" {
+		if err := tx.Bucket(codesBucket).Put([]byte(e.Code), itob(e.ID)); err != nil {
+			return err
+		}
+	}
+
+	// Удаленная ссылка не занимает адрес.
+	if !e.Del {
+		if err := tx.Bucket(urlsBucket).Put([]byte(e.URL), itob(e.ID)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(usersBucket).Put(userKey(e.UserID, e.ID), nil)
+}
+
+// byURL ищет действующую ссылку по адресу. Адрес удаленной ссылки можно
+// сократить заново, при этом создается новая ссылка.
+func byURL(tx *bbolt.Tx, url string) (mod.Event, bool, error) {
+	id := tx.Bucket(urlsBucket).Get([]byte(url))
+	if id == nil {
+		return mod.Event{}, false, nil
+	}
+
+	e, ok, err := get(tx, int(binary.BigEndian.Uint64(id)))
+	return e, ok && !e.Del, err
+}
+
+func nextID(tx *bbolt.Tx) (int, error) {
+	seq, err := tx.Bucket(linksBucket).NextSequence()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(seq) - 1, nil
+}
+
+// add добавляет ссылку url с параметрами s. Если адрес уже сокращен,
+// возвращается существующая ссылка и exists = true.
+func (c *InBolt) add(tx *bbolt.Tx, url, user string, s mod.Settings) (mod.Event, bool, error) {
+	if e, ok, err := byURL(tx, url); err != nil || ok {
+		return e, ok, err
+	}
+
+	id, err := nextID(tx)
+	if err != nil {
+		return mod.Event{}, false, err
+	}
+
+	e := mod.Event{ID: id, URL: url, UserID: user, Created: time.Now(), Settings: s}
+
+	gen := c.generator()
+	for attempt := 0; attempt < codegen.MaxAttempts; attempt++ {
+		code, err := gen.Generate(id, url, attempt)
+		if err != nil {
+			return e, false, err
+		}
+
+		_, taken, err := lookup(tx, code)
+		if err != nil {
+			return e, false, err
+		}
+
+		if !taken {
+			// Код, совпадающий с base36 ID, не хранится явно.
+			if code != e.ShortID() {
+				e.Code = code
+			}
+
+			return e, false, insert(tx, e)
+		}
+	}
+
+	return e, false, codegen.ErrCodesExhausted
+}
+
+// setDeleted помечает ссылку удаленной или восстанавливает ее и обновляет
+// индекс удаленных ссылок.
+func setDeleted(tx *bbolt.Tx, e mod.Event, del bool) (mod.Event, error) {
+	if e.Del {
+		if err := tx.Bucket(deletedBucket).Delete(deletedKey(e)); err != nil {
+			return e, err
+		}
+	}
+
+	e.Del = del
+	e.DelAt = time.Time{}
+	if del {
+		e.DelAt = time.Now()
+		if err := tx.Bucket(deletedBucket).Put(deletedKey(e), nil); err != nil {
+			return e, err
+		}
+	}
+
+	return e, put(tx, e)
+}
+
+func (c *InBolt) Add(url, user string, s mod.Settings) (string, error) {
+	var id string
+
+	err := c.DB.Update(func(tx *bbolt.Tx) error {
+		e, exists, err := c.add(tx, url, user, s)
+		if err != nil {
+			return err
+		}
+		id = e.ShortID()
+
+		if exists {
+			return mod.ErrURLConflict
+		}
+
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, mod.ErrURLConflict) {
+		return "", err
+	}
+
+	return id, err
+}
+
+func (c *InBolt) AddAlias(url, alias, user string) (string, error) {
+	if !mod.ValidAlias(alias) {
+		return "", mod.ErrInvalidAlias
+	}
+
+	var id string
+
+	err := c.DB.Update(func(tx *bbolt.Tx) error {
+		_, taken, err := lookup(tx, alias)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return mod.ErrAliasConflict
+		}
+
+		e, exists, err := byURL(tx, url)
+		if err != nil {
+			return err
+		}
+		if exists {
+			id = e.ShortID()
+			return mod.ErrURLConflict
+		}
+
+		n, err := nextID(tx)
+		if err != nil {
+			return err
+		}
+
+		id = alias
+		return insert(tx, mod.Event{ID: n, Code: alias, URL: url, UserID: user, Created: time.Now()})
+	})
+
+	if errors.Is(err, mod.ErrURLConflict) {
+		return id, err
+	} else if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// BatchAdd добавляет ссылки одной транзакцией. Для уже сокращенных адресов
+// возвращаются коды существующих ссылок и mod.BatchConflictError.
+func (c *InBolt) BatchAdd(urls []string, user string) ([]string, error) {
+	ids := make([]string, 0, len(urls))
+	var exists []int
+
+	err := c.DB.Update(func(tx *bbolt.Tx) error {
+		for i, url := range urls {
+			e, found, err := c.add(tx, url, user, mod.Settings{})
+			if err != nil {
+				return err
+			}
+
+			ids = append(ids, e.ShortID())
+			if found {
+				exists = append(exists, i)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, mod.BatchConflict(exists)
+}
+
+func (c *InBolt) Get(str string) (string, bool, error) {
+	var e mod.Event
+	var ok bool
+
+	err := c.DB.View(func(tx *bbolt.Tx) error {
+		var err error
+		e, ok, err = lookup(tx, str)
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	if !ok {
+		return "", false, mod.ErrStorageIsNil
+	}
+
+	if e.Del {
+		return "", true, nil
+	}
+
+	return e.URL, false, nil
+}
+
+// events возвращает все ссылки пользователя, отсортированные по ID.
+func (c *InBolt) events(user string) ([]mod.Event, error) {
+	var events []mod.Event
+
+	err := c.DB.View(func(tx *bbolt.Tx) error {
+		prefix := append([]byte(user), 0)
+
+		cur := tx.Bucket(usersBucket).Cursor()
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+			e, ok, err := get(tx, int(binary.BigEndian.Uint64(k[len(prefix):])))
+			if err != nil {
+				return err
+			}
+			if ok {
+				events = append(events, e)
+			}
+		}
+		return nil
+	})
+
+	return events, err
+}
+
+func (c *InBolt) toURLs(events []mod.Event) []mod.URLs {
+	var UserURLs []mod.URLs
+	for _, i := range events {
+		UserURLs = append(UserURLs, mod.URLs{
+			ShortURL:    "http://" + c.ServerAddress + c.BaseURL + i.ShortID(),
+			OriginalURL: i.URL,
+			Created:     i.Created,
+			Deleted:     i.Del,
+			Clicks:      i.Clicks,
+			DeletedAt:   i.DelAt,
+		})
+	}
+
+	return UserURLs
+}
+
+func (c *InBolt) GetAll(user string) ([]mod.URLs, error) {
+	events, err := c.events(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toURLs(events), nil
+}
+
+func (c *InBolt) Find(user string, q mod.Query) ([]mod.URLs, *mod.Cursor, error) {
+	all, err := c.events(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var events []mod.Event
+	for _, i := range all {
+		if !i.Del {
+			events = append(events, i)
+		}
+	}
+
+	page, next := mod.Page(events, q)
+
+	return c.toURLs(page), next, nil
+}
+
+func (c *InBolt) Click(str string) error {
+	return c.DB.Update(func(tx *bbolt.Tx) error {
+		e, ok, err := lookup(tx, str)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return mod.ErrStorageIsNil
+		}
+
+		if e.Exhausted() {
+			return mod.ErrExhausted
+		}
+
+		e.Clicks++
+
+		return put(tx, e)
+	})
+}
+
+func (c *InBolt) Update(str, url, user string) error {
+	return c.DB.Update(func(tx *bbolt.Tx) error {
+		e, err := owned(tx, str, user)
+		if err != nil {
+			return err
+		}
+
+		if e.URL == url {
+			return nil
+		}
+
+		if other, taken, err := byURL(tx, url); err != nil {
+			return err
+		} else if taken && other.ID != e.ID {
+			return mod.ErrURLConflict
+		}
+
+		urls := tx.Bucket(urlsBucket)
+
+		if err = urls.Delete([]byte(e.URL)); err != nil {
+			return err
+		}
+		if err = urls.Put([]byte(url), itob(e.ID)); err != nil {
+			return err
+		}
+
+		e.History = append(e.History, mod.Version{URL: e.URL, Replaced: time.Now()})
+		e.URL = url
+
+		return put(tx, e)
+	})
+}
+
+// Link возвращает ссылку по короткому коду вместе с ее параметрами, без истории.
+func (c *InBolt) Link(str string) (mod.Event, error) {
+	var e mod.Event
+	var ok bool
+
+	err := c.DB.View(func(tx *bbolt.Tx) error {
+		var err error
+		e, ok, err = lookup(tx, str)
+		return err
+	})
+	if err != nil {
+		return mod.Event{}, err
+	}
+
+	if !ok {
+		return mod.Event{}, mod.ErrStorageIsNil
+	}
+
+	e.History = nil
+
+	return e, nil
+}
+
+func (c *InBolt) Configure(str string, edit func(*mod.Settings) error, user string) error {
+	return c.DB.Update(func(tx *bbolt.Tx) error {
+		e, err := owned(tx, str, user)
+		if err != nil {
+			return err
+		}
+
+		if err = edit(&e.Settings); err != nil {
+			return err
+		}
+
+		return put(tx, e)
+	})
+}
+
+func (c *InBolt) History(str, user string) ([]mod.Version, error) {
+	var history []mod.Version
+
+	err := c.DB.View(func(tx *bbolt.Tx) error {
+		e, err := owned(tx, str, user)
+		if err != nil {
+			return err
+		}
+
+		history = append([]mod.Version{}, e.History...)
+		return nil
+	})
+
+	return history, err
+}
+
+func (c *InBolt) Trash(user string, since time.Time) ([]mod.URLs, error) {
+	all, err := c.events(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []mod.Event
+	for _, i := range all {
+		if i.Del && !i.DelAt.Before(since) {
+			events = append(events, i)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].DelAt.After(events[j].DelAt)
+	})
+
+	return c.toURLs(events), nil
+}
+
+func (c *InBolt) Restore(ids []string, user string, since time.Time) ([]string, error) {
+	var restored []string
+
+	err := c.DB.Update(func(tx *bbolt.Tx) error {
+		for _, sid := range ids {
+			e, ok, err := lookup(tx, sid)
+			if err != nil {
+				return err
+			}
+			if !ok || e.UserID != user || !e.Del || e.DelAt.Before(since) {
+				continue
+			}
+
+			// Адрес уже занят новой ссылкой.
+			if _, taken, err := byURL(tx, e.URL); err != nil {
+				return err
+			} else if taken {
+				continue
+			}
+
+			if _, err = setDeleted(tx, e, false); err != nil {
+				return err
+			}
+			if err = tx.Bucket(urlsBucket).Put([]byte(e.URL), itob(e.ID)); err != nil {
+				return err
+			}
+
+			restored = append(restored, sid)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return restored, nil
+}
+
+func (c *InBolt) Purge(before time.Time) (int, error) {
+	var n int
+
+	err := c.DB.Update(func(tx *bbolt.Tx) error {
+		limit := itob(int(before.UnixNano()))
+
+		var keys [][]byte
+		cur := tx.Bucket(deletedBucket).Cursor()
+		for k, _ := cur.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, _ = cur.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+
+		for _, k := range keys {
+			e, ok, err := get(tx, int(binary.BigEndian.Uint64(k[8:])))
+			if err != nil {
+				return err
+			}
+
+			if err = tx.Bucket(deletedBucket).Delete(k); err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+
+			if err = remove(tx, e); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+
+	return n, err
+}
+
+// BatchUpdate удаляет ссылки одной транзакцией в фоне.
+func (c *InBolt) BatchUpdate(ids []string, user string) {
+	go func() {
+		if _, err := c.Delete(ids, user); err != nil {
+			log.Print("delete err: ", err)
+		}
+	}()
+}
+
+// Delete удаляет ссылки пользователя одной транзакцией и возвращает результат
+// для каждого кода.
+func (c *InBolt) Delete(ids []string, user string) (map[string]string, error) {
+	res := make(map[string]string, len(ids))
+
+	err := c.DB.Update(func(tx *bbolt.Tx) error {
+		for _, sid := range ids {
+			if _, ok := res[sid]; ok {
+				continue
+			}
+
+			e, ok, err := lookup(tx, sid)
+			if err != nil {
+				return err
+			}
+
+			res[sid] = mod.DelStatus(e, ok, user)
+			log.Printf("delete: %5s, user: %s, id: %s, url: %s", strconv.FormatBool(res[sid] == mod.DelDeleted), user, sid, e.URL)
+			if res[sid] != mod.DelDeleted {
+				continue
+			}
+
+			if _, err = setDeleted(tx, e, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Export возвращает до limit ссылок с ID больше after в порядке ID.
+func (c *InBolt) Export(after, limit int) ([]mod.Event, error) {
+	var events []mod.Event
+
+	err := c.DB.View(func(tx *bbolt.Tx) error {
+		cur := tx.Bucket(linksBucket).Cursor()
+		for k, v := cur.Seek(itob(after + 1)); k != nil && len(events) < limit; k, v = cur.Next() {
+			var e mod.Event
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+		return nil
+	})
+
+	return events, err
+}
+
+// LastID возвращает наибольший выданный ID.
+func (c *InBolt) LastID() (int, error) {
+	var id int
+
+	err := c.DB.View(func(tx *bbolt.Tx) error {
+		id = int(tx.Bucket(linksBucket).Sequence()) - 1
+		return nil
+	})
+
+	return id, err
+}
+
+// remove удаляет ссылку и ее индексы.
+func remove(tx *bbolt.Tx, e mod.Event) error {
+	if e.Code != "" {
+		if id := tx.Bucket(codesBucket).Get([]byte(e.Code)); id != nil && int(binary.BigEndian.Uint64(id)) == e.ID {
+			if err := tx.Bucket(codesBucket).Delete([]byte(e.Code)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if id := tx.Bucket(urlsBucket).Get([]byte(e.URL)); id != nil && int(binary.BigEndian.Uint64(id)) == e.ID {
+		if err := tx.Bucket(urlsBucket).Delete([]byte(e.URL)); err != nil {
+			return err
+		}
+	}
+
+	if e.Del {
+		if err := tx.Bucket(deletedBucket).Delete(deletedKey(e)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Bucket(usersBucket).Delete(userKey(e.UserID, e.ID)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(linksBucket).Delete(itob(e.ID))
+}
+
+// reserve поднимает последовательность ID так, чтобы новые ссылки получили ID больше id.
+func reserve(tx *bbolt.Tx, id int) error {
+	links := tx.Bucket(linksBucket)
+	if uint64(id+1) > links.Sequence() {
+		return links.SetSequence(uint64(id + 1))
+	}
+
+	return nil
+}
+
+// Import сохраняет ссылки с их ID и кодами одной транзакцией. Ссылки с теми
+// же ID перезаписываются.
+func (c *InBolt) Import(events []mod.Event) error {
+	return c.DB.Update(func(tx *bbolt.Tx) error {
+		for _, e := range events {
+			if e.Code != "" {
+				if id := tx.Bucket(codesBucket).Get([]byte(e.Code)); id != nil && int(binary.BigEndian.Uint64(id)) != e.ID {
+					return fmt.Errorf("import %d: %w", e.ID, mod.ErrAliasConflict)
+				}
+			}
+
+			if other, taken, err := byURL(tx, e.URL); err != nil {
+				return err
+			} else if taken && other.ID != e.ID && !e.Del {
+				return fmt.Errorf("import %d: %w", e.ID, mod.ErrURLConflict)
+			}
+
+			old, ok, err := get(tx, e.ID)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if err = remove(tx, old); err != nil {
+					return err
+				}
+			}
+
+			if e.Del && e.DelAt.IsZero() {
+				e.DelAt = time.Now()
+			}
+
+			if err = insert(tx, e); err != nil {
+				return err
+			}
+
+			if e.Del {
+				if err = tx.Bucket(deletedBucket).Put(deletedKey(e), nil); err != nil {
+					return err
+				}
+			}
+
+			if err = reserve(tx, e.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reserve гарантирует, что новые ссылки получат ID больше id.
+func (c *InBolt) Reserve(id int) error {
+	return c.DB.Update(func(tx *bbolt.Tx) error {
+		return reserve(tx, id)
+	})
+}
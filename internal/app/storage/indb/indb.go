@@ -4,11 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/lib/pq"
+	"main/internal/app/storage/codegen"
 	mod "main/internal/app/storage/model"
 )
 
@@ -17,24 +20,99 @@ type InDB struct {
 	BaseURL       string
 	DataBaseDSN   string
 	DB            *sql.DB
+	// Generator выдает коды новых ссылок. Если nil, используется
+	// codegen.CounterGenerator.
+	Generator codegen.CodeGenerator
 }
 
 var (
 	createTable = `CREATE TABLE IF NOT EXISTS shortURL (
 						id 		SERIAL 	PRIMARY KEY NOT NULL, 
-						url 	VARCHAR UNIQUE 		NOT NULL,
+						url 	VARCHAR 			NOT NULL,
 						del 	BOOLEAN 			NOT NULL 	DEFAULT false, 
 						userID 	VARCHAR 			NOT NULL)`
 
-	selectMaxID          = `SELECT MAX(id) FROM shortURL`
-	selectIDWhereURL     = `SELECT id, del FROM shortURL WHERE url = $1`
-	selectAllWhereID     = `SELECT * FROM shortURL WHERE id = $1`
-	selectAllWhereUserID = `SELECT * FROM shortURL WHERE userID = $1`
-
-	insertOnConflict = `INSERT INTO shortURL (url, userID) VALUES ($1, $2) ON CONFLICT(url) DO NOTHING RETURNING id`
+	// migrations добавляют колонки, появившиеся после создания таблицы.
+	migrations = []string{
+		`ALTER TABLE shortURL ADD COLUMN IF NOT EXISTS code VARCHAR UNIQUE`,
+		`ALTER TABLE shortURL ADD COLUMN IF NOT EXISTS created TIMESTAMPTZ NOT NULL DEFAULT now()`,
+		`ALTER TABLE shortURL ADD COLUMN IF NOT EXISTS clicks INTEGER NOT NULL DEFAULT 0`,
+		`CREATE TABLE IF NOT EXISTS shortURL_history (
+						id 			SERIAL 		PRIMARY KEY NOT NULL,
+						link_id 	INTEGER 	NOT NULL REFERENCES shortURL(id) ON DELETE CASCADE,
+						url 		VARCHAR 	NOT NULL,
+						replaced 	TIMESTAMPTZ NOT NULL DEFAULT now())`,
+		`ALTER TABLE shortURL ADD COLUMN IF NOT EXISTS deleted TIMESTAMPTZ`,
+		`UPDATE shortURL SET deleted = now() WHERE del AND deleted IS NULL`,
+		`ALTER TABLE shortURL ADD COLUMN IF NOT EXISTS title VARCHAR NOT NULL DEFAULT ''`,
+		`ALTER TABLE shortURL ADD COLUMN IF NOT EXISTS preview BOOLEAN NOT NULL DEFAULT false`,
+		`ALTER TABLE shortURL ADD COLUMN IF NOT EXISTS redirect INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE shortURL ADD COLUMN IF NOT EXISTS password_hash VARCHAR NOT NULL DEFAULT ''`,
+		`ALTER TABLE shortURL ADD COLUMN IF NOT EXISTS max_clicks INTEGER NOT NULL DEFAULT 0`,
+		// rules - правила переадресации в JSON (mod.EncodeRules).
+		`ALTER TABLE shortURL ADD COLUMN IF NOT EXISTS rules VARCHAR NOT NULL DEFAULT ''`,
+		// Адрес уникален только среди неудаленных ссылок: адрес удаленной
+		// ссылки можно сократить заново, при этом создается новая ссылка.
+		`CREATE UNIQUE INDEX IF NOT EXISTS shorturl_live_url ON shortURL (url) WHERE NOT del`,
+		`ALTER TABLE shortURL DROP CONSTRAINT IF EXISTS shorturl_url_key`,
+	}
 
-	updateDelWhereIDAndUserID = `UPDATE shortURL SET del = $3 WHERE id = $1 AND userID = $2`
-	updateDelAndUserIDWhereID = `UPDATE shortURL SET del = $2, userID = $3 WHERE id = $1`
+	selectMaxID          = `SELECT MAX(id) FROM shortURL`
+	selectIDWhereURL     = `SELECT id, code FROM shortURL WHERE url = $1 AND NOT del`
+	selectAllWhereID     = `SELECT id, url, del, userID, code, created FROM shortURL WHERE id = $1 AND code IS NULL`
+	selectAllWhereCode   = `SELECT id, url, del, userID, code, created FROM shortURL WHERE code = $1`
+	selectAllWhereUserID = `SELECT id, url, del, userID, code, created, clicks, deleted FROM shortURL WHERE userID = $1 ORDER BY id`
+	selectCodesIn        = `SELECT code FROM shortURL WHERE code = ANY($1)`
+	selectNumericTaken   = `SELECT id FROM shortURL WHERE code IS NULL AND id = ANY($1) AND NOT (id = ANY($2))`
+	selectShortExists    = `SELECT EXISTS(SELECT 1 FROM shortURL WHERE (code = $1 OR (code IS NULL AND id = $2)) AND NOT (id = ANY($3)))`
+
+	insertOnConflict = `INSERT INTO shortURL (url, userID, title, preview, redirect, password_hash, max_clicks, rules) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+							ON CONFLICT (url) WHERE NOT del DO NOTHING RETURNING id`
+	insertAliasOnConflict = `INSERT INTO shortURL (url, userID, code) VALUES ($1, $2, $3) ON CONFLICT (url) WHERE NOT del DO NOTHING RETURNING id`
+
+	insertValues                = `INSERT INTO shortURL (url, userID) VALUES `
+	onConflictReturningIDAndURL = ` ON CONFLICT (url) WHERE NOT del DO NOTHING RETURNING id, url, code`
+	selectIDAndURLWhereURLs     = `SELECT id, url, code FROM shortURL WHERE url = ANY($1) AND NOT del`
+	updateCodes                 = `UPDATE shortURL SET code = v.code FROM unnest($1::integer[], $2::varchar[]) AS v(id, code) WHERE shortURL.id = v.id`
+	// Условие на max_clicks проверяется под блокировкой строки, поэтому
+	// одновременные переходы не превышают ограничение.
+	updateClicksWhereShort = `UPDATE shortURL SET clicks = clicks + 1 WHERE (code = $1 OR (code IS NULL AND id = $2))
+								AND (max_clicks = 0 OR clicks < max_clicks) RETURNING clicks`
+	selectShortExistsAny = `SELECT EXISTS(SELECT 1 FROM shortURL WHERE code = $1 OR (code IS NULL AND id = $2))`
+
+	selectOwnerWhereShortForUpdate = `SELECT id, url, del, userID FROM shortURL WHERE code = $1 OR (code IS NULL AND id = $2) FOR UPDATE`
+	selectOwnerWhereShort          = `SELECT id, url, del, userID FROM shortURL WHERE code = $1 OR (code IS NULL AND id = $2)`
+	insertHistory                  = `INSERT INTO shortURL_history (link_id, url) VALUES ($1, $2)`
+	updateURLWhereID               = `UPDATE shortURL SET url = $2 WHERE id = $1`
+	selectHistoryWhereLinkID       = `SELECT url, replaced FROM shortURL_history WHERE link_id = $1 ORDER BY id`
+	selectLinkWhereShort           = `SELECT id, url, del, userID, code, created, clicks, deleted, title, preview, redirect, password_hash, max_clicks, rules FROM shortURL WHERE code = $1 OR (code IS NULL AND id = $2)`
+	selectSettingsWhereID          = `SELECT title, preview, redirect, password_hash, max_clicks, rules FROM shortURL WHERE id = $1`
+	updateSettingsWhereID          = `UPDATE shortURL SET title = $2, preview = $3, redirect = $4, password_hash = $5, max_clicks = $6, rules = $7 WHERE id = $1`
+
+	selectPage = `SELECT id, url, del, userID, code, created, clicks FROM shortURL WHERE `
+	// hostPattern выделяет хост из ссылки вида scheme://[user@]host[:port]/...
+	hostPattern                  = `^[A-Za-z][A-Za-z0-9+.-]*://(?:[^@/?#]*@)?([^:/?#]+)`
+	updateDelWhereShortAndUserID = `UPDATE shortURL SET del = $4, deleted = now() WHERE (code = $1 OR (code IS NULL AND id = $2)) AND userID = $3 AND NOT del`
+	updateDelWhereID             = `UPDATE shortURL SET del = true, deleted = now() WHERE id = $1`
+
+	selectTrash = `SELECT id, url, code, created, clicks, deleted FROM shortURL WHERE userID = $1 AND del AND deleted >= $2 ORDER BY deleted DESC`
+	// Ссылка, адрес которой занят новой ссылкой, не восстанавливается.
+	updateUndel = `UPDATE shortURL SET del = false, deleted = NULL WHERE (code = $1 OR (code IS NULL AND id = $2)) AND userID = $3 AND del AND deleted >= $4
+					AND NOT EXISTS (SELECT 1 FROM shortURL live WHERE live.url = shortURL.url AND NOT live.del)`
+	deletePurged = `DELETE FROM shortURL WHERE del AND deleted < $1`
+
+	selectExport        = `SELECT id, url, del, userID, code, created, clicks, deleted, title, preview, redirect, password_hash, max_clicks, rules FROM shortURL WHERE id > $1 ORDER BY id LIMIT $2`
+	selectExportHistory = `SELECT link_id, url, replaced FROM shortURL_history WHERE link_id = ANY($1) ORDER BY id`
+	selectLastID        = `SELECT CASE WHEN is_called THEN last_value ELSE last_value - 1 END FROM shorturl_id_seq`
+	upsertImport        = `INSERT INTO shortURL (id, url, del, userID, code, created, clicks, deleted, title, preview, redirect, password_hash, max_clicks, rules)
+						VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+						ON CONFLICT (id) DO UPDATE SET url = EXCLUDED.url, del = EXCLUDED.del, userID = EXCLUDED.userID,
+						code = EXCLUDED.code, created = EXCLUDED.created, clicks = EXCLUDED.clicks, deleted = EXCLUDED.deleted,
+						title = EXCLUDED.title, preview = EXCLUDED.preview, redirect = EXCLUDED.redirect, password_hash = EXCLUDED.password_hash,
+						max_clicks = EXCLUDED.max_clicks, rules = EXCLUDED.rules`
+	deleteHistoryWhereLinkID = `DELETE FROM shortURL_history WHERE link_id = $1`
+	insertHistoryAt          = `INSERT INTO shortURL_history (link_id, url, replaced) VALUES ($1, $2, $3)`
+	reserveID                = `SELECT setval('shorturl_id_seq', GREATEST($1, (SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM shorturl_id_seq)))`
 )
 
 func (c *InDB) StartDataBase() (*sql.DB, error) {
@@ -55,6 +133,12 @@ func (c *InDB) StartDataBase() (*sql.DB, error) {
 		return nil, err
 	}
 
+	for _, migration := range migrations {
+		if _, err = db.Exec(migration); err != nil {
+			return nil, err
+		}
+	}
+
 	err = db.QueryRow(selectMaxID).Scan(&mod.S.ID)
 
 	if err != nil {
@@ -81,42 +165,284 @@ func (c *InDB) PingDB(cc context.Context) error {
 	return nil
 }
 
-func (c *InDB) Add(addURL, user string) (string, error) {
+func (c *InDB) Close() error {
+	return c.DB.Close()
+}
+
+// querier - общие методы *sql.DB и *sql.Tx.
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Query(query string, args ...any) (*sql.Rows, error)
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// setMaxID запоминает ID последнего элемента, id - ID строки в таблице.
+func setMaxID(id int) {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	if id-1 > mod.S.ID {
+		mod.S.ID = id - 1
+	}
+}
+
+func maxID() int {
+	mod.S.RLock()
+	defer mod.S.RUnlock()
+
+	return mod.S.ID
+}
+
+// shortID возвращает короткий код строки таблицы.
+func shortID(id int, code sql.NullString) string {
+	if code.Valid {
+		return code.String
+	}
+
+	return strconv.FormatInt(int64(id-1), 36)
+}
+
+func (c *InDB) generator() codegen.CodeGenerator {
+	if c.Generator == nil {
+		return codegen.CounterGenerator{}
+	}
+
+	return c.Generator
+}
+
+// assignCodes назначает коды новым строкам ids и возвращает их. urls - ссылки
+// новых строк. Первые варианты кодов проверяются одним запросом, коды,
+// совпадающие с base36 ID, не хранятся явно.
+func (c *InDB) assignCodes(q querier, ids []int, urls map[int]string) (map[int]string, error) {
+	gen := c.generator()
+	codes := make(map[int]string, len(ids))
+	newIDs := make([]int64, 0, len(ids))
+	list := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		code, err := gen.Generate(id-1, urls[id], 0)
+		if err != nil {
+			return nil, err
+		}
+
+		codes[id] = code
+		newIDs = append(newIDs, int64(id))
+		list = append(list, code)
+	}
+
+	if len(ids) == 0 {
+		return codes, nil
+	}
+
+	taken, err := takenCodes(q, list, newIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	assigned := make(map[string]bool, len(ids))
+	var updIDs []int64
+	var updCodes []string
+
+	for _, id := range ids {
+		code := codes[id]
+		if taken[code] || assigned[code] {
+			code, err = c.freeCode(q, id, urls[id], newIDs, assigned)
+			if err != nil {
+				return nil, err
+			}
+			codes[id] = code
+		}
+
+		assigned[code] = true
+		if code != shortID(id, sql.NullString{}) {
+			updIDs = append(updIDs, int64(id))
+			updCodes = append(updCodes, code)
+		}
+	}
+
+	if len(updIDs) > 0 {
+		if _, err = q.Exec(updateCodes, pq.Array(updIDs), pq.Array(updCodes)); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// takenCodes возвращает коды из codes, уже занятые строками, кроме новых строк newIDs.
+func takenCodes(q querier, codes []string, newIDs []int64) (map[string]bool, error) {
+	taken := make(map[string]bool)
+
+	rows, err := q.Query(selectCodesIn, pq.Array(codes))
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var code string
+		if err = rows.Scan(&code); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		taken[code] = true
+	}
+	_ = rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int64][]string)
+	var nums []int64
+	for _, code := range codes {
+		if id := rowID(code); id > 0 {
+			byID[int64(id)] = append(byID[int64(id)], code)
+			nums = append(nums, int64(id))
+		}
+	}
+
+	if len(nums) == 0 {
+		return taken, nil
+	}
+
+	rows, err = q.Query(selectNumericTaken, pq.Array(nums), pq.Array(newIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		for _, code := range byID[id] {
+			taken[code] = true
+		}
+	}
+	_ = rows.Close()
+
+	return taken, rows.Err()
+}
+
+// freeCode подбирает свободный код для строки id, начиная со второй попытки.
+// assigned - коды, уже выданные новым строкам, но еще не записанные.
+func (c *InDB) freeCode(q querier, id int, url string, newIDs []int64, assigned map[string]bool) (string, error) {
+	gen := c.generator()
+	for attempt := 1; attempt < codegen.MaxAttempts; attempt++ {
+		code, err := gen.Generate(id-1, url, attempt)
+		if err != nil {
+			return "", err
+		}
+
+		if assigned[code] {
+			continue
+		}
+
+		var taken bool
+		if err = q.QueryRow(selectShortExists, code, rowID(code), pq.Array(newIDs)).Scan(&taken); err != nil {
+			return "", err
+		}
+
+		if !taken {
+			return code, nil
+		}
+	}
+
+	return "", codegen.ErrCodesExhausted
+}
+
+func (c *InDB) Add(addURL, user string, s mod.Settings) (string, error) {
 	var shortURL mod.Event
+	var code sql.NullString
+
+	rules, err := mod.EncodeRules(s.Rules)
+	if err != nil {
+		return "", err
+	}
 
-	err := c.DB.QueryRow(insertOnConflict, addURL, user).Scan(&shortURL.ID)
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	err = tx.QueryRow(insertOnConflict, addURL, user, s.Title, s.Preview, s.Redirect, s.PasswordHash, s.MaxClicks, rules).Scan(&shortURL.ID)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			return "", err
 		}
 
-		err = c.DB.QueryRow(selectIDWhereURL, addURL).Scan(&shortURL.ID, &shortURL.Del)
+		err = tx.QueryRow(selectIDWhereURL, addURL).Scan(&shortURL.ID, &code)
 		if err != nil {
 			return "", err
 		}
-	} else {
-		mod.S.ID = shortURL.ID - 2
+
+		return shortID(shortURL.ID, code), mod.ErrURLConflict
 	}
 
-	sID := strconv.FormatInt(int64(shortURL.ID-1), 36)
+	codes, err := c.assignCodes(tx, []int{shortURL.ID}, map[int]string{shortURL.ID: addURL})
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
 
-	if shortURL.ID-1 <= mod.S.ID && !shortURL.Del {
-		return sID, mod.ErrURLConflict
-	} else if shortURL.Del {
-		_, err = c.DB.Exec(updateDelAndUserIDWhereID, shortURL.ID, false, user)
+	setMaxID(shortURL.ID)
+
+	return codes[shortURL.ID], nil
+}
+
+func (c *InDB) AddAlias(addURL, alias, user string) (string, error) {
+	if !mod.ValidAlias(alias) {
+		return "", mod.ErrInvalidAlias
+	}
+
+	_, _, err := c.Get(alias)
+	if err == nil {
+		return "", mod.ErrAliasConflict
+	} else if !errors.Is(err, mod.ErrStorageIsNil) {
+		return "", err
+	}
+
+	var id int
+	err = c.DB.QueryRow(insertAliasOnConflict, addURL, user, alias).Scan(&id)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return "", mod.ErrAliasConflict
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+
+		var code sql.NullString
+		err = c.DB.QueryRow(selectIDWhereURL, addURL).Scan(&id, &code)
 		if err != nil {
 			return "", err
 		}
-		return sID, nil
+
+		return shortID(id, code), mod.ErrURLConflict
 	}
 
-	mod.S.ID = shortURL.ID - 1
+	setMaxID(id)
 
-	return sID, nil
+	return alias, nil
 }
 
+// batchChunkSize - количество строк в одном INSERT при пакетном добавлении.
+const batchChunkSize = 1000
+
+// BatchAdd добавляет ссылки одной транзакцией. Для уже сокращенных адресов
+// возвращаются коды существующих ссылок и mod.BatchConflictError.
 func (c *InDB) BatchAdd(urls []string, user string) ([]string, error) {
-	var ids []string
+	ids := make([]string, 0, len(urls))
+	var exists []int
 
 	tx, err := c.DB.Begin()
 	if err != nil {
@@ -126,52 +452,162 @@ func (c *InDB) BatchAdd(urls []string, user string) ([]string, error) {
 		_ = tx.Rollback()
 	}()
 
-	insertStmt, err := c.DB.Prepare(insertOnConflict)
-	if err != nil {
+	for start := 0; start < len(urls); start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > len(urls) {
+			end = len(urls)
+		}
+
+		chunkIDs, chunkExists, err := c.batchInsert(tx, urls[start:end], user)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, chunkIDs...)
+		for _, i := range chunkExists {
+			exists = append(exists, start+i)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
 
-	txStmt := tx.Stmt(insertStmt)
+	return ids, mod.BatchConflict(exists)
+}
 
-	for _, u := range urls {
+// batchInsert добавляет ссылки одним многострочным INSERT и возвращает
+// короткие id в порядке входных ссылок, включая уже существующие, и индексы
+// адресов, которые не были добавлены этим INSERT.
+func (c *InDB) batchInsert(tx *sql.Tx, urls []string, user string) ([]string, []int, error) {
+	var query strings.Builder
+	args := make([]any, 0, len(urls)*2)
+
+	query.WriteString(insertValues)
+	for i, u := range urls {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString(fmt.Sprintf("($%d, $%d)", 2*i+1, 2*i+2))
+		args = append(args, u, user)
+	}
+	query.WriteString(onConflictReturningIDAndURL)
+
+	found := make(map[string]string, len(urls))
+	var inserted []int
+	insertedURL := make(map[int]string)
+
+	rows, err := tx.Query(query.String(), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for rows.Next() {
 		var id int
-		err = txStmt.QueryRow(u, user).Scan(&id)
+		var u string
+		var code sql.NullString
+		if err = rows.Scan(&id, &u, &code); err != nil {
+			_ = rows.Close()
+			return nil, nil, err
+		}
+
+		inserted = append(inserted, id)
+		insertedURL[id] = u
+		setMaxID(id)
+	}
+	_ = rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	codes, err := c.assignCodes(tx, inserted, insertedURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for id, code := range codes {
+		found[insertedURL[id]] = code
+	}
+
+	var missing []string
+	for _, u := range urls {
+		if _, ok := found[u]; !ok {
+			missing = append(missing, u)
+		}
+	}
+
+	if len(missing) > 0 {
+		rows, err = tx.Query(selectIDAndURLWhereURLs, pq.Array(missing))
 		if err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return nil, err
-			}
+			return nil, nil, err
+		}
 
-			err = c.DB.QueryRow(selectIDWhereURL, u).Scan(&id)
-			if err != nil {
-				return nil, err
+		for rows.Next() {
+			var id int
+			var u string
+			var code sql.NullString
+			if err = rows.Scan(&id, &u, &code); err != nil {
+				_ = rows.Close()
+				return nil, nil, err
 			}
+
+			found[u] = shortID(id, code)
 		}
+		_ = rows.Close()
 
-		sID := strconv.FormatInt(int64(id-1), 36)
+		if err = rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ids := make([]string, len(urls))
+	var exists []int
+	created := make(map[string]bool, len(insertedURL))
+	for _, u := range insertedURL {
+		created[u] = true
+	}
 
-		if id > mod.S.ID {
-			mod.S.ID = id - 1
+	for i, u := range urls {
+		id, ok := found[u]
+		if !ok {
+			return nil, nil, mod.ErrStorageIsNil
 		}
 
-		ids = append(ids, sID)
+		ids[i] = id
+
+		// Новой считается только первая запись адреса в пакете.
+		if created[u] {
+			delete(created, u)
+		} else {
+			exists = append(exists, i)
+		}
 	}
 
-	return ids, tx.Commit()
+	return ids, exists, nil
 }
 
 func (c *InDB) Get(str string) (string, bool, error) {
-	id, err := strconv.ParseInt(str, 36, 64)
-	if err != nil {
+	var dbItem mod.Event
+	var code sql.NullString
+
+	err := c.DB.QueryRow(selectAllWhereCode, str).Scan(&dbItem.ID, &dbItem.URL, &dbItem.Del, &dbItem.UserID, &code, &dbItem.Created)
+	if err == nil {
+		return dbItem.URL, dbItem.Del, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
 		return "", false, err
 	}
 
-	if int(id) > mod.S.ID {
+	id, err := strconv.ParseInt(str, 36, 64)
+	if err != nil {
 		return "", false, mod.ErrStorageIsNil
 	}
 
-	var dbItem mod.Event
+	if int(id) > maxID() {
+		return "", false, mod.ErrStorageIsNil
+	}
 
-	err = c.DB.QueryRow(selectAllWhereID, id+1).Scan(&dbItem.ID, &dbItem.URL, &dbItem.Del, &dbItem.UserID)
+	err = c.DB.QueryRow(selectAllWhereID, id+1).Scan(&dbItem.ID, &dbItem.URL, &dbItem.Del, &dbItem.UserID, &code, &dbItem.Created)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return "", false, mod.ErrStorageIsNil
@@ -190,10 +626,15 @@ func (c *InDB) GetAll(user string) ([]mod.URLs, error) {
 
 		return nil, err
 	}
+	defer func() {
+		_ = rows.Close()
+	}()
 
 	for rows.Next() {
 		var dbItem mod.Event
-		err = rows.Scan(&dbItem.ID, &dbItem.URL, &dbItem.Del, &dbItem.UserID)
+		var code sql.NullString
+		var deleted sql.NullTime
+		err = rows.Scan(&dbItem.ID, &dbItem.URL, &dbItem.Del, &dbItem.UserID, &code, &dbItem.Created, &dbItem.Clicks, &deleted)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return nil, mod.ErrStorageIsNil
@@ -201,21 +642,368 @@ func (c *InDB) GetAll(user string) ([]mod.URLs, error) {
 			return nil, err
 		}
 
-		if !dbItem.Del {
-			id := strconv.FormatInt(int64(dbItem.ID-1), 36)
+		UserURLs = append(UserURLs, mod.URLs{
+			ShortURL:    "http://" + c.ServerAddress + c.BaseURL + shortID(dbItem.ID, code),
+			OriginalURL: dbItem.URL,
+			Created:     dbItem.Created,
+			Deleted:     dbItem.Del,
+			Clicks:      dbItem.Clicks,
+			DeletedAt:   deleted.Time,
+		})
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return UserURLs, nil
+}
+
+// buildFind строит запрос выборки страницы ссылок пользователя.
+func buildFind(user string, q mod.Query) (string, []any) {
+	args := []any{user}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := []string{"userID = $1", "NOT del"}
+
+	if q.Contains != "" {
+		where = append(where, "strpos(lower(url), lower("+arg(q.Contains)+")) > 0")
+	}
+
+	if q.Host != "" {
+		where = append(where, "lower(substring(url from '"+hostPattern+"')) = lower("+arg(q.Host)+")")
+	}
+
+	if !q.CreatedFrom.IsZero() {
+		where = append(where, "created >= "+arg(q.CreatedFrom))
+	}
+
+	if !q.CreatedTo.IsZero() {
+		where = append(where, "created < "+arg(q.CreatedTo))
+	}
+
+	col, dir, cmp := "created", "ASC", ">"
+	if q.Sort == mod.SortClicks {
+		col = "clicks"
+	}
+	if q.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	if q.After != nil {
+		var key any = q.After.Key
+		if col == "created" {
+			key = time.Unix(0, q.After.Key)
+		}
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", col, cmp, arg(key), arg(q.After.ID)))
+	}
+
+	query := selectPage + strings.Join(where, " AND ") + fmt.Sprintf(" ORDER BY %s %s, id %s", col, dir, dir)
+	if q.Limit > 0 {
+		query += " LIMIT " + arg(q.Limit+1)
+	}
+
+	return query, args
+}
+
+func (c *InDB) Find(user string, q mod.Query) ([]mod.URLs, *mod.Cursor, error) {
+	query, args := buildFind(user, q)
+
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var UserURLs []mod.URLs
+	var next *mod.Cursor
+	var last mod.Event
+
+	for rows.Next() {
+		var dbItem mod.Event
+		var code sql.NullString
+		err = rows.Scan(&dbItem.ID, &dbItem.URL, &dbItem.Del, &dbItem.UserID, &code, &dbItem.Created, &dbItem.Clicks)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if q.Limit > 0 && len(UserURLs) == q.Limit {
+			next = &mod.Cursor{Key: q.SortKey(last.Clicks, last.Created), ID: last.ID}
+			break
+		}
+
+		last = dbItem
+		UserURLs = append(UserURLs, mod.URLs{
+			ShortURL:    "http://" + c.ServerAddress + c.BaseURL + shortID(dbItem.ID, code),
+			OriginalURL: dbItem.URL,
+			Created:     dbItem.Created,
+			Clicks:      dbItem.Clicks,
+		})
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return UserURLs, next, nil
+}
+
+// rowID возвращает ID строки таблицы для base36 кода. Код, не являющийся
+// base36 числом, ищется только по колонке code.
+func rowID(str string) int64 {
+	id, err := strconv.ParseInt(str, 36, 64)
+	if err != nil {
+		return -1
+	}
+
+	return id + 1
+}
+
+// owned ищет неудаленную ссылку пользователя по короткому коду.
+func owned(q querier, query, str, user string) (mod.Event, error) {
+	var e mod.Event
+
+	err := q.QueryRow(query, str, rowID(str)).Scan(&e.ID, &e.URL, &e.Del, &e.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return e, mod.ErrStorageIsNil
+		}
+		return e, err
+	}
+
+	if e.Del {
+		return e, mod.ErrStorageIsNil
+	}
+
+	if e.UserID != user {
+		return e, mod.ErrForbidden
+	}
+
+	return e, nil
+}
+
+func (c *InDB) Update(str, url, user string) error {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	e, err := owned(tx, selectOwnerWhereShortForUpdate, str, user)
+	if err != nil {
+		return err
+	}
+
+	if e.URL == url {
+		return nil
+	}
+
+	if _, err = tx.Exec(insertHistory, e.ID, e.URL); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(updateURLWhereID, e.ID, url); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return mod.ErrURLConflict
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Link возвращает ссылку по короткому коду вместе с ее параметрами, без истории.
+func (c *InDB) Link(str string) (mod.Event, error) {
+	var e mod.Event
+	var code sql.NullString
+	var deleted sql.NullTime
+	var rules string
+
+	err := c.DB.QueryRow(selectLinkWhereShort, str, rowID(str)).Scan(&e.ID, &e.URL, &e.Del, &e.UserID, &code,
+		&e.Created, &e.Clicks, &deleted, &e.Title, &e.Preview, &e.Redirect, &e.PasswordHash, &e.MaxClicks, &rules)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return mod.Event{}, mod.ErrStorageIsNil
+		}
+		return mod.Event{}, err
+	}
+
+	if e.Rules, err = mod.DecodeRules(rules); err != nil {
+		return mod.Event{}, err
+	}
+
+	e.ID--
+	e.Code = code.String
+	e.DelAt = deleted.Time
+
+	return e, nil
+}
+
+// Configure читает параметры под блокировкой строки ссылки, поэтому
+// одновременные изменения не теряются.
+func (c *InDB) Configure(str string, edit func(*mod.Settings) error, user string) error {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	e, err := owned(tx, selectOwnerWhereShortForUpdate, str, user)
+	if err != nil {
+		return err
+	}
+
+	var s mod.Settings
+	var rules string
+
+	err = tx.QueryRow(selectSettingsWhereID, e.ID).Scan(&s.Title, &s.Preview, &s.Redirect, &s.PasswordHash, &s.MaxClicks, &rules)
+	if err != nil {
+		return err
+	}
+
+	if s.Rules, err = mod.DecodeRules(rules); err != nil {
+		return err
+	}
+
+	if err = edit(&s); err != nil {
+		return err
+	}
+
+	if rules, err = mod.EncodeRules(s.Rules); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(updateSettingsWhereID, e.ID, s.Title, s.Preview, s.Redirect, s.PasswordHash, s.MaxClicks, rules); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (c *InDB) History(str, user string) ([]mod.Version, error) {
+	e, err := owned(c.DB, selectOwnerWhereShort, str, user)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := c.DB.Query(selectHistoryWhereLinkID, e.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var history []mod.Version
+	for rows.Next() {
+		var v mod.Version
+		if err = rows.Scan(&v.URL, &v.Replaced); err != nil {
+			return nil, err
+		}
+		history = append(history, v)
+	}
+
+	return history, rows.Err()
+}
+
+func (c *InDB) Trash(user string, since time.Time) ([]mod.URLs, error) {
+	rows, err := c.DB.Query(selectTrash, user, since)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
 
-			UserURLs = append(UserURLs, mod.URLs{
-				ShortURL:    "http://" + c.ServerAddress + c.BaseURL + id,
-				OriginalURL: dbItem.URL,
-			})
+	var UserURLs []mod.URLs
+	for rows.Next() {
+		var dbItem mod.Event
+		var code sql.NullString
+		err = rows.Scan(&dbItem.ID, &dbItem.URL, &code, &dbItem.Created, &dbItem.Clicks, &dbItem.DelAt)
+		if err != nil {
+			return nil, err
 		}
+
+		UserURLs = append(UserURLs, mod.URLs{
+			ShortURL:    "http://" + c.ServerAddress + c.BaseURL + shortID(dbItem.ID, code),
+			OriginalURL: dbItem.URL,
+			Created:     dbItem.Created,
+			Deleted:     true,
+			Clicks:      dbItem.Clicks,
+			DeletedAt:   dbItem.DelAt,
+		})
 	}
 
-	if rows.Err() != nil {
+	return UserURLs, rows.Err()
+}
+
+func (c *InDB) Restore(ids []string, user string, since time.Time) ([]string, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
 
-	return UserURLs, nil
+	var restored []string
+	for _, sid := range ids {
+		res, err := tx.Exec(updateUndel, sid, rowID(sid), user, since)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+
+		if n > 0 {
+			restored = append(restored, sid)
+		}
+	}
+
+	return restored, tx.Commit()
+}
+
+func (c *InDB) Purge(before time.Time) (int, error) {
+	res, err := c.DB.Exec(deletePurged, before)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (c *InDB) Click(str string) error {
+	var clicks int
+
+	err := c.DB.QueryRow(updateClicksWhereShort, str, rowID(str)).Scan(&clicks)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var exists bool
+	if err = c.DB.QueryRow(selectShortExistsAny, str, rowID(str)).Scan(&exists); err != nil {
+		return err
+	}
+
+	if !exists {
+		return mod.ErrStorageIsNil
+	}
+
+	return mod.ErrExhausted
 }
 
 func (c *InDB) BatchUpdate(ids []string, user string) {
@@ -264,7 +1052,7 @@ func (c *InDB) worker(input chan string, user string) {
 			_ = tx.Rollback()
 		}()
 
-		updateStmt, err := c.DB.Prepare(updateDelWhereIDAndUserID)
+		updateStmt, err := c.DB.Prepare(updateDelWhereShortAndUserID)
 		if err != nil {
 			log.Print("prepare err: ", err)
 			return
@@ -279,17 +1067,213 @@ func (c *InDB) worker(input chan string, user string) {
 		}()
 
 		for sid := range input {
-			id, err := strconv.ParseInt(sid, 36, 64)
-			if err != nil {
-				log.Print(err)
-			}
-
 			log.Printf("delete: %s, user: %s, id: %s", "try", user, sid)
 
-			_, err = txStmt.Exec(id+1, user, true)
+			_, err := txStmt.Exec(sid, rowID(sid), user, true)
 			if err != nil {
 				log.Print(err)
 			}
 		}
 	}()
 }
+
+// Delete удаляет ссылки пользователя одной транзакцией и возвращает результат
+// для каждого кода.
+func (c *InDB) Delete(ids []string, user string) (map[string]string, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	res := make(map[string]string, len(ids))
+	for _, sid := range ids {
+		if _, ok := res[sid]; ok {
+			continue
+		}
+
+		var e mod.Event
+		err = tx.QueryRow(selectOwnerWhereShortForUpdate, sid, rowID(sid)).Scan(&e.ID, &e.URL, &e.Del, &e.UserID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		res[sid] = mod.DelStatus(e, err == nil, user)
+		log.Printf("delete: %5s, user: %s, id: %s, url: %s", strconv.FormatBool(res[sid] == mod.DelDeleted), user, sid, e.URL)
+		if res[sid] != mod.DelDeleted {
+			continue
+		}
+
+		if _, err = tx.Exec(updateDelWhereID, e.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Export возвращает до limit ссылок с ID больше after в порядке ID.
+func (c *InDB) Export(after, limit int) ([]mod.Event, error) {
+	rows, err := c.DB.Query(selectExport, after+1, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []mod.Event
+	index := make(map[int]int)
+	var ids []int64
+
+	for rows.Next() {
+		var e mod.Event
+		var code sql.NullString
+		var deleted sql.NullTime
+		var rules string
+		if err = rows.Scan(&e.ID, &e.URL, &e.Del, &e.UserID, &code, &e.Created, &e.Clicks, &deleted, &e.Title, &e.Preview, &e.Redirect, &e.PasswordHash, &e.MaxClicks, &rules); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+
+		if e.Rules, err = mod.DecodeRules(rules); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+
+		index[e.ID] = len(events)
+		ids = append(ids, int64(e.ID))
+
+		e.ID--
+		e.Code = code.String
+		e.DelAt = deleted.Time
+		events = append(events, e)
+	}
+	_ = rows.Close()
+
+	if err = rows.Err(); err != nil || len(ids) == 0 {
+		return events, err
+	}
+
+	rows, err = c.DB.Query(selectExportHistory, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var id int
+		var v mod.Version
+		if err = rows.Scan(&id, &v.URL, &v.Replaced); err != nil {
+			return nil, err
+		}
+
+		e := &events[index[id]]
+		e.History = append(e.History, v)
+	}
+
+	return events, rows.Err()
+}
+
+// LastID возвращает наибольший выданный ID.
+func (c *InDB) LastID() (int, error) {
+	var id int
+	if err := c.DB.QueryRow(selectLastID).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	return id - 1, nil
+}
+
+// Import сохраняет ссылки с их ID и кодами одной транзакцией. Ссылки с теми
+// же ID перезаписываются.
+func (c *InDB) Import(events []mod.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	last := -1
+	for _, e := range events {
+		code := sql.NullString{String: e.Code, Valid: e.Code != ""}
+		deleted := sql.NullTime{Time: e.DelAt, Valid: e.Del}
+		if e.Del && e.DelAt.IsZero() {
+			deleted.Time = time.Now()
+		}
+
+		// Postgres округляет время до микросекунд, обрезаем его заранее, чтобы
+		// время совпадало с исходным при сверке.
+		deleted.Time = deleted.Time.Truncate(time.Microsecond)
+		created := e.Created.Truncate(time.Microsecond)
+
+		rules, err := mod.EncodeRules(e.Rules)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(upsertImport, e.ID+1, e.URL, e.Del, e.UserID, code, created, e.Clicks, deleted, e.Title, e.Preview, e.Redirect, e.PasswordHash, e.MaxClicks, rules)
+		if err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+				if strings.Contains(pqErr.Constraint, "code") {
+					return fmt.Errorf("import %d: %w", e.ID, mod.ErrAliasConflict)
+				}
+				return fmt.Errorf("import %d: %w", e.ID, mod.ErrURLConflict)
+			}
+			return err
+		}
+
+		if _, err = tx.Exec(deleteHistoryWhereLinkID, e.ID+1); err != nil {
+			return err
+		}
+
+		for _, v := range e.History {
+			if _, err = tx.Exec(insertHistoryAt, e.ID+1, v.URL, v.Replaced.Truncate(time.Microsecond)); err != nil {
+				return err
+			}
+		}
+
+		if e.ID > last {
+			last = e.ID
+		}
+	}
+
+	if _, err = tx.Exec(reserveID, last+1); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	setMaxID(last + 1)
+
+	return nil
+}
+
+// Reserve гарантирует, что новые ссылки получат ID больше id.
+func (c *InDB) Reserve(id int) error {
+	if id < 0 {
+		return nil
+	}
+
+	if _, err := c.DB.Exec(reserveID, id+1); err != nil {
+		return err
+	}
+
+	setMaxID(id + 1)
+
+	return nil
+}
@@ -1,20 +1,20 @@
 package infile
 
 import (
-	"context"
 	"encoding/json"
-	"errors"
-	"log"
 	"os"
-	"strconv"
 
+	m "main/internal/app/storage/inmemory"
 	mod "main/internal/app/storage/model"
 )
 
+// InFile хранит ссылки в памяти и записывает каждое изменение в файл.
+// При запуске состояние восстанавливается из файла, последняя запись
+// ссылки имеет приоритет.
 type InFile struct {
-	ServerAddress   string
-	BaseURL         string
+	m.InMemory
 	FileStoragePath string
+	producer        *producer
 }
 
 type producer struct {
@@ -70,10 +70,6 @@ func (c *Consumer) Close() error {
 	return c.file.Close()
 }
 
-func (c *InFile) PingDB(_ context.Context) error {
-	return errors.New("db is disabled")
-}
-
 func (c *InFile) StartFileStorage() error {
 	consumer, err := newConsumer(c.FileStoragePath)
 	if err != nil {
@@ -84,7 +80,9 @@ func (c *InFile) StartFileStorage() error {
 		_ = consumer.Close()
 	}()
 
-	maxID := -1
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
 	for i := 0; ; i++ {
 		readEvent, err := consumer.ReadEvent()
 		if readEvent == nil {
@@ -93,140 +91,65 @@ func (c *InFile) StartFileStorage() error {
 			return err
 		}
 
-		maxID = readEvent.ID
-	}
-
-	if maxID != -1 {
-		mod.S.ID = maxID
+		m.Load(*readEvent)
 	}
 
-	return nil
-}
-
-func (c *InFile) Add(url, user string) (string, error) {
-	mod.S.ID++
-
-	id := strconv.FormatInt(int64(mod.S.ID), 36)
-
-	producer, err := newProducer(c.FileStoragePath)
+	c.producer, err = newProducer(c.FileStoragePath)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer func() {
-		_ = producer.Close()
-	}()
 
-	err = producer.WriteEvent(mod.Event{
-		ID:     mod.S.ID,
-		URL:    url,
-		UserID: user,
-	})
-	if err != nil {
-		return "", err
+	c.OnChange = func(e mod.Event) error {
+		return c.producer.WriteEvent(e)
 	}
+	c.OnPurge = c.compact
 
-	return id, nil
+	return nil
 }
 
-func (c *InFile) BatchAdd(urls []string, user string) ([]string, error) {
-	mod.S.ID++
-
-	var ids []string
+// Close закрывает файл хранилища.
+func (c *InFile) Close() error {
+	mod.S.Lock()
+	defer mod.S.Unlock()
 
-	producer, err := newProducer(c.FileStoragePath)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		_ = producer.Close()
-	}()
-
-	for i := 0; i < len(urls); i++ {
-		id := strconv.FormatInt(int64(mod.S.ID), 36)
-		err = producer.WriteEvent(mod.Event{
-			ID:     mod.S.ID,
-			URL:    urls[i],
-			UserID: user,
-		})
-		if err != nil {
-			return nil, err
-		}
-
-		ids = append(ids, id)
-
-		if i < len(urls)-1 {
-			mod.S.ID++
-		}
-	}
-
-	return ids, nil
+	return c.producer.Close()
 }
 
-func (c *InFile) Get(str string) (string, bool, error) {
-	id, err := strconv.ParseInt(str, 36, 64)
-	if err != nil {
-		return "", false, err
-	}
-
-	if int(id) > mod.S.ID {
-		return "", false, mod.ErrStorageIsNil
-	}
+// compact перезаписывает файл текущим состоянием хранилища, чтобы
+// окончательно удаленные ссылки не оставались на диске. Вызывается под
+// блокировкой хранилища.
+func (c *InFile) compact() error {
+	tmp := c.FileStoragePath + ".tmp"
 
-	consumer, err := newConsumer(c.FileStoragePath)
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
 	if err != nil {
-		return "", false, err
+		return err
 	}
-	defer func() {
-		_ = consumer.Close()
-	}()
 
-	for i := 0; ; i++ {
-		readEvent, err := consumer.ReadEvent()
-		if readEvent == nil {
-			break
-		} else if err != nil {
-			return "", false, err
-		}
+	p := &producer{file: file, encoder: json.NewEncoder(file)}
 
-		eid := strconv.FormatInt(int64(readEvent.ID), 36)
-		if eid == str {
-			return readEvent.URL, false, nil
+	for _, e := range m.Events() {
+		if err = p.WriteEvent(e); err != nil {
+			_ = p.Close()
+			return err
 		}
 	}
 
-	return "", false, mod.ErrStorageIsNil
-}
-
-func (c *InFile) GetAll(user string) ([]mod.URLs, error) {
-	var UserURLs []mod.URLs
-	consumer, err := newConsumer(c.FileStoragePath)
-	if err != nil {
-		return UserURLs, err
+	if err = file.Sync(); err != nil {
+		_ = p.Close()
+		return err
 	}
-	defer func() {
-		_ = consumer.Close()
-	}()
 
-	for i := 0; ; i++ {
-		readEvent, err := consumer.ReadEvent()
-		if readEvent == nil {
-			break
-		} else if err != nil {
-			return UserURLs, err
-		}
+	if err = p.Close(); err != nil {
+		return err
+	}
 
-		if readEvent.UserID == user {
-			id := strconv.FormatInt(int64(readEvent.ID), 36)
-			UserURLs = append(UserURLs, mod.URLs{
-				ShortURL:    "http://" + c.ServerAddress + c.BaseURL + id,
-				OriginalURL: readEvent.URL,
-			})
-		}
+	if err = os.Rename(tmp, c.FileStoragePath); err != nil {
+		return err
 	}
 
-	return UserURLs, nil
-}
+	_ = c.producer.Close()
 
-func (c *InFile) BatchUpdate(_ []string, _ string) {
-	log.Print("method not allowed")
+	c.producer, err = newProducer(c.FileStoragePath)
+	return err
 }
@@ -0,0 +1,274 @@
+package inmemory
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	mod "main/internal/app/storage/model"
+)
+
+// Durable хранит ссылки в памяти и сохраняет их на диск: каждое изменение
+// дописывается в журнал, а периодически все ссылки записываются в снимок и
+// журнал начинается заново. При запуске загружается снимок и журнал после
+// него, поэтому время восстановления ограничено интервалом снимков.
+//
+// Журналы нумеруются. Снимок хранит номер журнала, который его продолжает:
+// новый журнал создается до замены снимка, а старый удаляется после, поэтому
+// сбой на любом шаге оставляет согласованную пару снимка и журнала.
+type Durable struct {
+	InMemory
+	SnapshotPath string
+	// Interval - период снимков. 0 отключает периодические снимки, снимок
+	// тогда делается только при удалении ссылок и закрытии.
+	Interval time.Duration
+
+	wal    *os.File
+	walGen int
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type snapshotHeader struct {
+	WAL int `json:"wal"`
+}
+
+// StartDurable загружает снимок и журнал и запускает периодические снимки.
+// Вызывается до начала работы с хранилищем.
+func (c *Durable) StartDurable() error {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	gen, err := c.loadSnapshot()
+	if err != nil {
+		return err
+	}
+
+	if err = c.replayWAL(gen); err != nil {
+		return err
+	}
+	c.walGen = gen
+
+	c.OnChange = func(e mod.Event) error {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		_, err = c.wal.Write(append(b, '\n'))
+		return err
+	}
+	// Окончательное удаление не попадает в журнал, поэтому после него
+	// делается снимок.
+	c.OnPurge = c.snapshot
+
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.run()
+
+	return nil
+}
+
+func (c *Durable) walPath(gen int) string {
+	return c.SnapshotPath + ".wal." + strconv.Itoa(gen)
+}
+
+// loadSnapshot загружает снимок и возвращает номер журнала после него.
+func (c *Durable) loadSnapshot() (int, error) {
+	file, err := os.Open(c.SnapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+
+	var header snapshotHeader
+	if err = dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("read snapshot %s: %w", c.SnapshotPath, err)
+	}
+
+	for {
+		var e mod.Event
+		if err = dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("read snapshot %s: %w", c.SnapshotPath, err)
+		}
+
+		Load(e)
+	}
+
+	return header.WAL, nil
+}
+
+// replayWAL применяет журнал gen и открывает его для записи. Оборванная при
+// сбое последняя запись отбрасывается.
+func (c *Durable) replayWAL(gen int) error {
+	file, err := os.OpenFile(c.walPath(gen), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(file)
+
+	var n int
+	var offset int64
+	for {
+		var e mod.Event
+		if err = dec.Decode(&e); err != nil {
+			if err != io.EOF {
+				log.Printf("durable: wal %s: dropping torn record at offset %d: %s", file.Name(), offset, err)
+			}
+			break
+		}
+
+		Load(e)
+		offset = dec.InputOffset()
+		n++
+	}
+
+	if err = file.Truncate(offset); err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	c.wal = file
+	log.Printf("durable: loaded %d links and %d wal records", len(mod.S.URLs), n)
+
+	return nil
+}
+
+func (c *Durable) run() {
+	defer close(c.done)
+
+	if c.Interval <= 0 {
+		<-c.stop
+		return
+	}
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.Snapshot(); err != nil {
+				log.Print("durable: snapshot err: ", err)
+			}
+		}
+	}
+}
+
+// Snapshot записывает все ссылки в снимок и начинает новый журнал.
+func (c *Durable) Snapshot() error {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	return c.snapshot()
+}
+
+// snapshot вызывается под блокировкой хранилища.
+func (c *Durable) snapshot() error {
+	gen := c.walGen + 1
+
+	wal, err := os.OpenFile(c.walPath(gen), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err = c.writeSnapshot(gen); err != nil {
+		_ = wal.Close()
+		_ = os.Remove(wal.Name())
+		return err
+	}
+
+	_ = c.wal.Close()
+	_ = os.Remove(c.walPath(c.walGen))
+
+	c.wal, c.walGen = wal, gen
+
+	return nil
+}
+
+// writeSnapshot атомарно заменяет снимок: пишет его во временный файл и
+// переименовывает.
+func (c *Durable) writeSnapshot(gen int) error {
+	tmp := c.SnapshotPath + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+
+	err = enc.Encode(snapshotHeader{WAL: gen})
+	for _, e := range Events() {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(e)
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, c.SnapshotPath); err != nil {
+		return err
+	}
+
+	// Синхронизируем каталог, чтобы переименование пережило сбой питания.
+	if dir, err := os.Open(filepath.Dir(c.SnapshotPath)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+
+	return nil
+}
+
+// Close останавливает периодические снимки, делает последний снимок и
+// закрывает журнал.
+func (c *Durable) Close() error {
+	close(c.stop)
+	<-c.done
+
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	err := c.snapshot()
+	if cerr := c.wal.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -1,91 +1,515 @@
 package inmemory
 
 import (
-	"context"
-	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"strconv"
+	"time"
 
+	"main/internal/app/storage/codegen"
 	mod "main/internal/app/storage/model"
 )
 
 type InMemory struct {
 	ServerAddress string
 	BaseURL       string
+	// Generator выдает коды новых ссылок. Если nil, используется
+	// codegen.CounterGenerator.
+	Generator codegen.CodeGenerator
+	// OnChange вызывается под блокировкой перед каждым изменением ссылки.
+	// Ошибка отменяет изменение.
+	OnChange func(mod.Event) error
+	// OnPurge вызывается под блокировкой после окончательного удаления ссылок.
+	OnPurge func() error
 }
 
-func (c *InMemory) PingDB(_ context.Context) error {
-	return errors.New("db is disabled")
+// Load добавляет ссылку в хранилище без вызова OnChange, используется при
+// восстановлении состояния.
+func Load(e mod.Event) {
+	if old, ok := mod.S.URLs[e.ID]; ok {
+		unindex(old)
+	}
+
+	if e.Purged {
+		delete(mod.S.URLs, e.ID)
+
+		if e.ID > mod.S.ID {
+			mod.S.ID = e.ID
+		}
+		return
+	}
+
+	// Ссылки, удаленные до появления DelAt, хранятся в корзине с момента загрузки.
+	if e.Del && e.DelAt.IsZero() {
+		e.DelAt = time.Now()
+	}
+
+	// Удаленная ссылка не занимает адрес действующей ссылки.
+	if other, ok := byURL(e.URL); !e.Del || !ok || other.ID == e.ID {
+		mod.S.Links[e.URL] = e.ID
+	}
+
+	mod.S.URLs[e.ID] = e
+	if e.Code != "" {
+		mod.S.Codes[e.Code] = e.ID
+	}
+
+	if e.ID > mod.S.ID {
+		mod.S.ID = e.ID
+	}
 }
 
-func (c *InMemory) Add(url, user string) (string, error) {
-	mod.S.ID++
+// unindex удаляет код и адрес ссылки из индексов, если они указывают на нее.
+func unindex(e mod.Event) {
+	if id, ok := mod.S.Codes[e.Code]; ok && id == e.ID {
+		delete(mod.S.Codes, e.Code)
+	}
 
-	id := strconv.FormatInt(int64(mod.S.ID), 36)
-	mod.S.URLs[mod.S.ID] = mod.Event{
-		ID:     mod.S.ID,
-		URL:    url,
-		Del:    false,
-		UserID: user,
+	if id, ok := mod.S.Links[e.URL]; ok && id == e.ID {
+		delete(mod.S.Links, e.URL)
+	}
+}
+
+// byURL ищет действующую ссылку по адресу. Адрес удаленной ссылки можно
+// сократить заново, при этом создается новая ссылка.
+func byURL(url string) (mod.Event, bool) {
+	id, ok := mod.S.Links[url]
+	if !ok {
+		return mod.Event{}, false
 	}
 
-	return id, nil
+	e, ok := mod.S.URLs[id]
+	return e, ok && !e.Del
 }
 
-func (c *InMemory) BatchAdd(urls []string, user string) ([]string, error) {
+// Events возвращает все ссылки в порядке ID и отметку о последнем ID, если его
+// ссылка удалена окончательно, чтобы ID не выдавался повторно. Вызывается под
+// блокировкой.
+func Events() []mod.Event {
+	ids := make([]int, 0, len(mod.S.URLs))
+	for id := range mod.S.URLs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	events := make([]mod.Event, 0, len(ids)+1)
+	for _, id := range ids {
+		events = append(events, mod.S.URLs[id])
+	}
+
+	if _, ok := mod.S.URLs[mod.S.ID]; !ok && mod.S.ID >= 0 {
+		events = append(events, mod.Event{ID: mod.S.ID, Purged: true})
+	}
+
+	return events
+}
+
+func (c *InMemory) save(e mod.Event) error {
+	if c.OnChange != nil {
+		if err := c.OnChange(e); err != nil {
+			return err
+		}
+	}
+
+	Load(e)
+
+	return nil
+}
+
+// lookup ищет ссылку по короткому коду. Явно заданные коды имеют приоритет
+// над base36 ID.
+func lookup(str string) (mod.Event, bool) {
+	if id, ok := mod.S.Codes[str]; ok {
+		return mod.S.URLs[id], true
+	}
+
+	id, err := strconv.ParseInt(str, 36, 64)
+	if err != nil || int(id) > mod.S.ID {
+		return mod.Event{}, false
+	}
+
+	e, ok := mod.S.URLs[int(id)]
+	if !ok || e.Code != "" {
+		return mod.Event{}, false
+	}
+
+	return e, true
+}
+
+func (c *InMemory) generator() codegen.CodeGenerator {
+	if c.Generator == nil {
+		return codegen.CounterGenerator{}
+	}
+
+	return c.Generator
+}
+
+// newEvent создает ссылку со свободным кодом. Если генератор выдал код
+// действующей ссылки на тот же URL, возвращается она и exists = true.
+func (c *InMemory) newEvent(url, user string) (mod.Event, bool, error) {
+	e := mod.Event{
+		ID:      mod.S.ID + 1,
+		URL:     url,
+		Del:     false,
+		UserID:  user,
+		Created: time.Now(),
+	}
+
+	gen := c.generator()
+	for attempt := 0; attempt < codegen.MaxAttempts; attempt++ {
+		code, err := gen.Generate(e.ID, url, attempt)
+		if err != nil {
+			return e, false, err
+		}
+
+		old, ok := lookup(code)
+		if !ok {
+			// Код, совпадающий с base36 ID, не хранится явно.
+			if code != e.ShortID() {
+				e.Code = code
+			}
+			mod.S.ID = e.ID
+
+			return e, false, nil
+		}
+
+		if old.URL == url && !old.Del {
+			return old, true, nil
+		}
+	}
+
+	return e, false, codegen.ErrCodesExhausted
+}
+
+func (c *InMemory) Add(url, user string, s mod.Settings) (string, error) {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	if e, ok := byURL(url); ok {
+		return e.ShortID(), mod.ErrURLConflict
+	}
+
+	e, exists, err := c.newEvent(url, user)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return e.ShortID(), mod.ErrURLConflict
+	}
+
+	e.Settings = s
+	if err = c.save(e); err != nil {
+		return "", err
+	}
+
+	return e.ShortID(), nil
+}
+
+func (c *InMemory) AddAlias(url, alias, user string) (string, error) {
+	if !mod.ValidAlias(alias) {
+		return "", mod.ErrInvalidAlias
+	}
+
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	if _, ok := lookup(alias); ok {
+		return "", mod.ErrAliasConflict
+	}
+
+	if e, ok := byURL(url); ok {
+		return e.ShortID(), mod.ErrURLConflict
+	}
+
 	mod.S.ID++
+	e := mod.Event{
+		ID:      mod.S.ID,
+		Code:    alias,
+		URL:     url,
+		UserID:  user,
+		Created: time.Now(),
+	}
+	if err := c.save(e); err != nil {
+		return "", err
+	}
+
+	return alias, nil
+}
+
+// BatchAdd добавляет ссылки и возвращает их коды в порядке адресов. Для уже
+// сокращенных адресов возвращаются коды существующих ссылок и
+// mod.BatchConflictError.
+func (c *InMemory) BatchAdd(urls []string, user string) ([]string, error) {
+	mod.S.Lock()
+	defer mod.S.Unlock()
 
 	var ids []string
+	var exists []int
 
 	for i := 0; i < len(urls); i++ {
-		id := strconv.FormatInt(int64(mod.S.ID), 36)
-		mod.S.URLs[mod.S.ID] = mod.Event{
-			ID:     mod.S.ID,
-			URL:    urls[i],
-			Del:    false,
-			UserID: user,
+		// Повторы адреса, в том числе внутри пакета, получают один код.
+		if e, ok := byURL(urls[i]); ok {
+			ids = append(ids, e.ShortID())
+			exists = append(exists, i)
+			continue
 		}
 
-		ids = append(ids, id)
+		e, found, err := c.newEvent(urls[i], user)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			ids = append(ids, e.ShortID())
+			exists = append(exists, i)
+			continue
+		}
 
-		if i < len(urls)-1 {
-			mod.S.ID++
+		if err = c.save(e); err != nil {
+			return nil, err
 		}
+
+		ids = append(ids, e.ShortID())
 	}
 
-	return ids, nil
+	return ids, mod.BatchConflict(exists)
 }
 
 func (c *InMemory) Get(str string) (string, bool, error) {
-	id, err := strconv.ParseInt(str, 36, 64)
-	if err != nil {
-		return "", false, err
-	}
+	mod.S.RLock()
+	defer mod.S.RUnlock()
 
-	if int(id) > mod.S.ID {
+	e, ok := lookup(str)
+	if !ok {
 		return "", false, mod.ErrStorageIsNil
 	}
 
-	if !mod.S.URLs[int(id)].Del {
-		return mod.S.URLs[int(id)].URL, false, nil
+	if !e.Del {
+		return e.URL, false, nil
 	}
 
 	return "", true, nil
 }
 
-func (c *InMemory) GetAll(user string) ([]mod.URLs, error) {
+func (c *InMemory) toURLs(events []mod.Event) []mod.URLs {
 	var UserURLs []mod.URLs
+	for _, i := range events {
+		UserURLs = append(UserURLs, mod.URLs{
+			ShortURL:    "http://" + c.ServerAddress + c.BaseURL + i.ShortID(),
+			OriginalURL: i.URL,
+			Created:     i.Created,
+			Deleted:     i.Del,
+			Clicks:      i.Clicks,
+			DeletedAt:   i.DelAt,
+		})
+	}
+
+	return UserURLs
+}
+
+func (c *InMemory) GetAll(user string) ([]mod.URLs, error) {
+	mod.S.RLock()
+	defer mod.S.RUnlock()
+
+	var events []mod.Event
+	for _, i := range mod.S.URLs {
+		if i.UserID == user {
+			events = append(events, i)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+
+	return c.toURLs(events), nil
+}
+
+func (c *InMemory) Find(user string, q mod.Query) ([]mod.URLs, *mod.Cursor, error) {
+	mod.S.RLock()
+	defer mod.S.RUnlock()
+
+	var events []mod.Event
 	for _, i := range mod.S.URLs {
 		if i.UserID == user && !i.Del {
-			id := strconv.FormatInt(int64(i.ID), 36)
-			UserURLs = append(UserURLs, mod.URLs{
-				ShortURL:    "http://" + c.ServerAddress + c.BaseURL + id,
-				OriginalURL: i.URL,
-			})
+			events = append(events, i)
 		}
 	}
 
-	return UserURLs, nil
+	page, next := mod.Page(events, q)
+
+	return c.toURLs(page), next, nil
+}
+
+func (c *InMemory) Click(str string) error {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	e, ok := lookup(str)
+	if !ok {
+		return mod.ErrStorageIsNil
+	}
+
+	// Проверка и увеличение счетчика идут под одной блокировкой, поэтому
+	// одновременные переходы не превышают ограничение.
+	if e.Exhausted() {
+		return mod.ErrExhausted
+	}
+
+	e.Clicks++
+
+	return c.save(e)
+}
+
+// owned ищет неудаленную ссылку пользователя по короткому коду.
+func owned(str, user string) (mod.Event, error) {
+	e, ok := lookup(str)
+	if !ok || e.Del {
+		return mod.Event{}, mod.ErrStorageIsNil
+	}
+
+	if e.UserID != user {
+		return mod.Event{}, mod.ErrForbidden
+	}
+
+	return e, nil
+}
+
+func (c *InMemory) Update(str, url, user string) error {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	e, err := owned(str, user)
+	if err != nil {
+		return err
+	}
+
+	if e.URL == url {
+		return nil
+	}
+
+	if other, ok := byURL(url); ok && other.ID != e.ID {
+		return mod.ErrURLConflict
+	}
+
+	history := make([]mod.Version, 0, len(e.History)+1)
+	e.History = append(append(history, e.History...), mod.Version{URL: e.URL, Replaced: time.Now()})
+	e.URL = url
+
+	return c.save(e)
+}
+
+// Link возвращает ссылку по короткому коду вместе с ее параметрами, без истории.
+func (c *InMemory) Link(str string) (mod.Event, error) {
+	mod.S.RLock()
+	defer mod.S.RUnlock()
+
+	e, ok := lookup(str)
+	if !ok {
+		return mod.Event{}, mod.ErrStorageIsNil
+	}
+
+	e.History = nil
+
+	return e, nil
+}
+
+func (c *InMemory) Configure(str string, edit func(*mod.Settings) error, user string) error {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	e, err := owned(str, user)
+	if err != nil {
+		return err
+	}
+
+	if err = edit(&e.Settings); err != nil {
+		return err
+	}
+
+	return c.save(e)
+}
+
+func (c *InMemory) History(str, user string) ([]mod.Version, error) {
+	mod.S.RLock()
+	defer mod.S.RUnlock()
+
+	e, err := owned(str, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]mod.Version(nil), e.History...), nil
+}
+
+func (c *InMemory) Trash(user string, since time.Time) ([]mod.URLs, error) {
+	mod.S.RLock()
+	defer mod.S.RUnlock()
+
+	var events []mod.Event
+	for _, i := range mod.S.URLs {
+		if i.UserID == user && i.Del && !i.DelAt.Before(since) {
+			events = append(events, i)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].DelAt.After(events[j].DelAt)
+	})
+
+	return c.toURLs(events), nil
+}
+
+func (c *InMemory) Restore(ids []string, user string, since time.Time) ([]string, error) {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	var restored []string
+	for _, sid := range ids {
+		e, ok := lookup(sid)
+		if !ok || e.UserID != user || !e.Del || e.DelAt.Before(since) {
+			continue
+		}
+
+		// Адрес уже занят новой ссылкой.
+		if _, taken := byURL(e.URL); taken {
+			continue
+		}
+
+		e.Del = false
+		e.DelAt = time.Time{}
+		if err := c.save(e); err != nil {
+			return restored, err
+		}
+
+		restored = append(restored, sid)
+	}
+
+	return restored, nil
+}
+
+func (c *InMemory) Purge(before time.Time) (int, error) {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	var n int
+	for id, e := range mod.S.URLs {
+		if !e.Del || !e.DelAt.Before(before) {
+			continue
+		}
+
+		delete(mod.S.URLs, id)
+		unindex(e)
+		n++
+	}
+
+	if n > 0 && c.OnPurge != nil {
+		if err := c.OnPurge(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
 }
 
 const workersCount = 5
@@ -103,7 +527,7 @@ func (c *InMemory) BatchUpdate(ids []string, user string) {
 
 	fanOutChs := fanOut(inputCh, workersCount)
 	for _, fanOutCh := range fanOutChs {
-		newWorker(fanOutCh, user)
+		c.newWorker(fanOutCh, user)
 	}
 }
 
@@ -139,31 +563,133 @@ func fanOut(inputCh chan string, n int) []chan string {
 	return chs
 }
 
-func newWorker(input chan string, user string) {
+func (c *InMemory) newWorker(input chan string, user string) {
 	go func() {
 		defer func() {
 			if x := recover(); x != nil {
-				newWorker(input, user)
+				c.newWorker(input, user)
 				log.Printf("run time panic: %v", x)
 			}
 		}()
 
 		for sid := range input {
-			id, err := strconv.ParseInt(sid, 36, 64)
-			if err != nil {
-				log.Print(err)
-			}
+			c.delete(sid, user)
+		}
+	}()
+}
+
+func (c *InMemory) delete(sid, user string) {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	if _, err := c.deleteOne(sid, user); err != nil {
+		log.Print("delete err: ", err)
+	}
+}
+
+// deleteOne удаляет ссылку пользователя и возвращает результат удаления.
+// Вызывается под блокировкой.
+func (c *InMemory) deleteOne(sid, user string) (string, error) {
+	e, ok := lookup(sid)
+	status := mod.DelStatus(e, ok, user)
+	log.Printf("delete: %5s, user: %s, id: %s, url: %s", strconv.FormatBool(status == mod.DelDeleted), user, sid, e.URL)
+	if status != mod.DelDeleted {
+		return status, nil
+	}
+
+	e.Del = true
+	e.DelAt = time.Now()
+
+	return status, c.save(e)
+}
+
+// Delete удаляет ссылки пользователя сразу и возвращает результат для каждого кода.
+func (c *InMemory) Delete(ids []string, user string) (map[string]string, error) {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	res := make(map[string]string, len(ids))
+	for _, sid := range ids {
+		if _, ok := res[sid]; ok {
+			continue
+		}
+
+		status, err := c.deleteOne(sid, user)
+		if err != nil {
+			return res, err
+		}
+
+		res[sid] = status
+	}
 
-			ok := mod.S.URLs[int(id)].UserID == user && !mod.S.URLs[int(id)].Del
-			log.Printf("delete: %5s, user: %s, id: %s, url: %s", strconv.FormatBool(ok), user, sid, mod.S.URLs[int(id)].URL)
-			if ok {
-				mod.S.URLs[int(id)] = mod.Event{
-					ID:     int(id),
-					URL:    mod.S.URLs[int(id)].URL,
-					Del:    true,
-					UserID: user,
-				}
+	return res, nil
+}
+
+// Export возвращает до limit ссылок с ID больше after в порядке ID.
+func (c *InMemory) Export(after, limit int) ([]mod.Event, error) {
+	mod.S.RLock()
+	defer mod.S.RUnlock()
+
+	ids := make([]int, 0, len(mod.S.URLs))
+	for id := range mod.S.URLs {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	events := make([]mod.Event, 0, len(ids))
+	for _, id := range ids {
+		events = append(events, mod.S.URLs[id])
+	}
+
+	return events, nil
+}
+
+// LastID возвращает наибольший выданный ID.
+func (c *InMemory) LastID() (int, error) {
+	mod.S.RLock()
+	defer mod.S.RUnlock()
+
+	return mod.S.ID, nil
+}
+
+// Import сохраняет ссылки с их ID и кодами. Ссылки с теми же ID перезаписываются.
+func (c *InMemory) Import(events []mod.Event) error {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	for _, e := range events {
+		if e.Code != "" {
+			if id, ok := mod.S.Codes[e.Code]; ok && id != e.ID {
+				return fmt.Errorf("import %d: %w", e.ID, mod.ErrAliasConflict)
 			}
 		}
-	}()
+
+		if other, ok := byURL(e.URL); ok && other.ID != e.ID && !e.Del && !e.Purged {
+			return fmt.Errorf("import %d: %w", e.ID, mod.ErrURLConflict)
+		}
+
+		if err := c.save(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reserve гарантирует, что новые ссылки получат ID больше id.
+func (c *InMemory) Reserve(id int) error {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	if id <= mod.S.ID {
+		return nil
+	}
+
+	return c.save(mod.Event{ID: id, Purged: true})
 }
@@ -0,0 +1,1156 @@
+package inredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"main/internal/app/storage/codegen"
+	mod "main/internal/app/storage/model"
+)
+
+// Ключи в Redis:
+//
+//	{shortener}:id           - счетчик ID ссылок (INCR)
+//	{shortener}:link:{id}    - хеш ссылки: url, user, code, del, created, clicks, deleted,
+//	                           title, preview, redirect, password, max_clicks, rules
+//	{shortener}:code:{code}  - ID ссылки с явно заданным кодом
+//	{shortener}:url:{url}    - ID ссылки по адресу, адреса действующих ссылок уникальны
+//	{shortener}:user:{user}  - множество ID ссылок пользователя
+//	{shortener}:history:{id} - прежние адреса ссылки: "время адрес"
+//	{shortener}:trash        - удаленные ссылки, score - время удаления в мс
+//
+// Скрипты получают в KEYS все ключи, известные до запуска, а ключи, найденные
+// по другим ключам (ссылка по коду, прежний адрес), собирают сами. Хеш-тег
+// кладет все ключи в один слот, но Redis Cluster и прокси, которые
+// маршрутизируют скрипты по KEYS, не поддерживаются.
+const prefix = "{shortener}:"
+
+const (
+	idKey    = prefix + "id"
+	trashKey = prefix + "trash"
+)
+
+// key возвращает ключ вида prefix + kind + ":" + name.
+func key(kind, name string) string {
+	return prefix + kind + ":" + name
+}
+
+type InRedis struct {
+	ServerAddress string
+	BaseURL       string
+	RedisAddr     string
+	Client        *redis.Client
+	// Generator выдает коды новых ссылок. Если nil, используется
+	// codegen.CounterGenerator.
+	Generator codegen.CodeGenerator
+}
+
+// lib - общие функции Lua скриптов. Код ссылки передается в ARGV парой код,
+// base36 ID, а в KEYS - ключом кода и, если ID не пуст, ключом ссылки с этим
+// ID (см. codeKeys).
+const lib = `
+local P = '` + prefix + `'
+
+local function resolve(codeKey, numKey, num)
+	local id = redis.call('GET', codeKey)
+	if id then
+		return id
+	end
+	if numKey and redis.call('HGET', numKey, 'code') == '' then
+		return num
+	end
+	return false
+end
+
+-- codeAt ищет ссылку с кодом ARGV[i], ARGV[i + 1] по ключам, начиная с
+-- KEYS[k], и возвращает ее ID и номер следующего ключа.
+local function codeAt(i, k)
+	if ARGV[i + 1] == '' then
+		return resolve(KEYS[k], nil, ''), k + 1
+	end
+	return resolve(KEYS[k], KEYS[k + 1], ARGV[i + 1]), k + 2
+end
+
+local function create(id, urlKey, userKey, url, user, code, created)
+	redis.call('HSET', P .. 'link:' .. id, 'url', url, 'user', user, 'code', code,
+		'del', '0', 'created', created, 'clicks', '0')
+	redis.call('SET', urlKey, id)
+	redis.call('SADD', userKey, id)
+end
+
+local function live(urlKey)
+	local id = redis.call('GET', urlKey)
+	if id and redis.call('HGET', P .. 'link:' .. id, 'del') ~= '1' then
+		return id
+	end
+	return false
+end
+
+local function nextID(idKey)
+	return tostring(redis.call('INCR', idKey) - 1)
+end
+`
+
+var (
+	// probeScript возвращает значение счетчика ID KEYS[1] и для каждого ключа
+	// адреса KEYS[2:] '1', если адрес занят действующей ссылкой, иначе '0'.
+	probeScript = redis.NewScript(lib + `
+local res = {redis.call('GET', KEYS[1]) or '0'}
+for i = 2, #KEYS do
+	table.insert(res, live(KEYS[i]) and '1' or '0')
+end
+return res
+`)
+
+	// addScript добавляет ссылки пользователя ARGV[1], созданные в ARGV[2], с
+	// параметрами ARGV[3:8]. ARGV[9] - значение счетчика ID, по которому
+	// рассчитаны коды. Далее для каждого адреса: адрес, число вариантов кода n
+	// и n троек код, base36 ID, '1' для явно хранимого кода; n = 0 - адрес уже
+	// сокращен. Код выбирается до записи, поэтому ссылка создается сразу с
+	// кодом. Если счетчик или адреса изменились после расчета, возвращает
+	// {'retry'}, если свободного кода нет - {'exhausted'}, иначе тройки id,
+	// code, status. KEYS: счетчик ID, множество пользователя, далее для
+	// каждого адреса его ключ и ключи вариантов кода.
+	addScript = redis.NewScript(lib + `
+if (redis.call('GET', KEYS[1]) or '0') ~= ARGV[9] then
+	return {'retry'}
+end
+local plan, seen, taken = {}, {}, {}
+local i, k = 10, 3
+while i <= #ARGV do
+	local url, n = ARGV[i], tonumber(ARGV[i + 1])
+	local item = {url = url, urlKey = KEYS[k]}
+	k = k + 1
+	if n == 0 then
+		if not seen[url] and not live(item.urlKey) then
+			return {'retry'}
+		end
+	else
+		if seen[url] or live(item.urlKey) then
+			return {'retry'}
+		end
+		for j = 0, n - 1 do
+			local c, codeKey = i + 2 + 3 * j, KEYS[k]
+			local id
+			id, k = codeAt(c, k)
+			if not item.code and not taken[ARGV[c]] and not id then
+				item.code, item.codeKey, item.explicit = ARGV[c], codeKey, ARGV[c + 2] == '1'
+			end
+		end
+		if not item.code then
+			return {'exhausted'}
+		end
+		taken[item.code] = true
+		seen[url] = true
+	end
+	table.insert(plan, item)
+	i = i + 2 + 3 * n
+end
+local res = {}
+for _, item in ipairs(plan) do
+	if item.code then
+		local id = nextID(KEYS[1])
+		local code = item.explicit and item.code or ''
+		create(id, item.urlKey, KEYS[2], item.url, ARGV[1], code, ARGV[2])
+		redis.call('HSET', P .. 'link:' .. id, 'title', ARGV[3], 'preview', ARGV[4], 'redirect', ARGV[5],
+			'password', ARGV[6], 'max_clicks', ARGV[7], 'rules', ARGV[8])
+		if code ~= '' then
+			redis.call('SET', item.codeKey, id)
+		end
+		table.insert(res, id)
+		table.insert(res, code)
+		table.insert(res, 'new')
+	else
+		local id = live(item.urlKey)
+		table.insert(res, id)
+		table.insert(res, redis.call('HGET', P .. 'link:' .. id, 'code'))
+		table.insert(res, 'exists')
+	end
+end
+return res
+`)
+
+	// aliasScript добавляет ссылку ARGV[3] пользователя ARGV[4] с кодом ARGV[1].
+	// KEYS: счетчик ID, ключ адреса, множество пользователя, ключи кода.
+	aliasScript = redis.NewScript(lib + `
+if codeAt(1, 4) then
+	return {'', '', 'alias'}
+end
+local id = live(KEYS[2])
+if id then
+	return {id, redis.call('HGET', P .. 'link:' .. id, 'code'), 'url'}
+end
+id = nextID(KEYS[1])
+create(id, KEYS[2], KEYS[3], ARGV[3], ARGV[4], ARGV[1], ARGV[5])
+redis.call('SET', KEYS[4], id)
+return {id, ARGV[1], 'new'}
+`)
+
+	getScript = redis.NewScript(lib + `
+local id = codeAt(1, 1)
+if not id then
+	return false
+end
+return redis.call('HMGET', P .. 'link:' .. id, 'url', 'del')
+`)
+
+	// linkScript возвращает ID ссылки и поля ее хеша.
+	linkScript = redis.NewScript(lib + `
+local id = codeAt(1, 1)
+if not id then
+	return false
+end
+local res = redis.call('HGETALL', P .. 'link:' .. id)
+table.insert(res, 1, id)
+return res
+`)
+
+	// configureScript задает параметры ARGV[10:15] ссылки ARGV[1] пользователя
+	// ARGV[3], если ее параметры все еще равны прочитанным ARGV[4:9], иначе
+	// возвращает 'retry'.
+	configureScript = redis.NewScript(lib + `
+local id = codeAt(1, 1)
+if not id then
+	return 'missing'
+end
+local link = P .. 'link:' .. id
+if redis.call('HGET', link, 'del') == '1' then
+	return 'missing'
+end
+if redis.call('HGET', link, 'user') ~= ARGV[3] then
+	return 'forbidden'
+end
+local fields = {'title', 'preview', 'redirect', 'password', 'max_clicks', 'rules'}
+for i, f in ipairs(fields) do
+	if (redis.call('HGET', link, f) or '') ~= ARGV[3 + i] then
+		return 'retry'
+	end
+end
+for i, f in ipairs(fields) do
+	redis.call('HSET', link, f, ARGV[9 + i])
+end
+return 'ok'
+`)
+
+	// clickScript учитывает переход по ссылке, если переходы не исчерпаны.
+	clickScript = redis.NewScript(lib + `
+local id = codeAt(1, 1)
+if not id then
+	return 'missing'
+end
+local link = P .. 'link:' .. id
+local max = tonumber(redis.call('HGET', link, 'max_clicks') or '0') or 0
+if max > 0 and tonumber(redis.call('HGET', link, 'clicks') or '0') >= max then
+	return 'exhausted'
+end
+redis.call('HINCRBY', link, 'clicks', 1)
+return 'ok'
+`)
+
+	// updateScript меняет адрес ссылки ARGV[1] пользователя ARGV[3] на ARGV[4].
+	// KEYS: ключ нового адреса, ключи кода.
+	updateScript = redis.NewScript(lib + `
+local id = codeAt(1, 2)
+if not id then
+	return 'missing'
+end
+local link = P .. 'link:' .. id
+if redis.call('HGET', link, 'del') == '1' then
+	return 'missing'
+end
+if redis.call('HGET', link, 'user') ~= ARGV[3] then
+	return 'forbidden'
+end
+local old = redis.call('HGET', link, 'url')
+if old == ARGV[4] then
+	return 'ok'
+end
+local other = live(KEYS[1])
+if other and other ~= id then
+	return 'conflict'
+end
+redis.call('RPUSH', P .. 'history:' .. id, ARGV[5] .. ' ' .. old)
+redis.call('DEL', P .. 'url:' .. old)
+redis.call('SET', KEYS[1], id)
+redis.call('HSET', link, 'url', ARGV[4])
+return 'ok'
+`)
+
+	// historyScript возвращает статус и прежние адреса ссылки ARGV[1] пользователя ARGV[3].
+	historyScript = redis.NewScript(lib + `
+local id = codeAt(1, 1)
+if not id then
+	return {'missing'}
+end
+local link = P .. 'link:' .. id
+if redis.call('HGET', link, 'del') == '1' then
+	return {'missing'}
+end
+if redis.call('HGET', link, 'user') ~= ARGV[3] then
+	return {'forbidden'}
+end
+local res = redis.call('LRANGE', P .. 'history:' .. id, 0, -1)
+table.insert(res, 1, 'ok')
+return res
+`)
+
+	// deleteScript удаляет ссылки пользователя ARGV[1] и возвращает результат
+	// удаления каждой.
+	// ARGV[2], ARGV[3] - время удаления в нс и мс, далее пары код, base36 ID.
+	// KEYS: корзина, далее ключи кодов.
+	deleteScript = redis.NewScript(lib + `
+local res = {}
+local k = 2
+for i = 4, #ARGV, 2 do
+	local id
+	id, k = codeAt(i, k)
+	local status = 'not_found'
+	if id then
+		local link = P .. 'link:' .. id
+		if redis.call('HGET', link, 'user') ~= ARGV[1] then
+			status = 'forbidden'
+		elseif redis.call('HGET', link, 'del') == '1' then
+			status = 'already_deleted'
+		else
+			redis.call('HSET', link, 'del', '1', 'deleted', ARGV[2])
+			redis.call('ZADD', KEYS[1], ARGV[3], id)
+			status = 'deleted'
+		end
+	end
+	table.insert(res, status)
+end
+return res
+`)
+
+	// restoreScript восстанавливает ссылки пользователя ARGV[1], удаленные не
+	// раньше ARGV[2] мс, и возвращает их коды. Далее пары код, base36 ID.
+	// Ссылка, адрес которой занят новой ссылкой, не восстанавливается.
+	// KEYS: корзина, далее ключи кодов.
+	restoreScript = redis.NewScript(lib + `
+local res = {}
+local k = 2
+for i = 3, #ARGV, 2 do
+	local id
+	id, k = codeAt(i, k)
+	if id then
+		local link = P .. 'link:' .. id
+		local deleted = redis.call('ZSCORE', KEYS[1], id)
+		local url = redis.call('HGET', link, 'url')
+		if redis.call('HGET', link, 'user') == ARGV[1] and redis.call('HGET', link, 'del') == '1'
+			and deleted and tonumber(deleted) >= tonumber(ARGV[2]) and not live(P .. 'url:' .. url) then
+			redis.call('SET', P .. 'url:' .. url, id)
+			redis.call('HSET', link, 'del', '0')
+			redis.call('HDEL', link, 'deleted')
+			redis.call('ZREM', KEYS[1], id)
+			table.insert(res, ARGV[i])
+		end
+	end
+end
+return res
+`)
+
+	// importScript сохраняет ссылку ARGV[1] с полями ARGV[2:15] и историей
+	// ARGV[16:], заменяя индексы прежней версии ссылки. KEYS: счетчик ID,
+	// ссылка, история, адрес, множество пользователя, корзина и, если код
+	// задан, ключ кода.
+	importScript = redis.NewScript(lib + `
+local id = ARGV[1]
+local link, history, urlKey, userKey, trash, codeKey = KEYS[2], KEYS[3], KEYS[4], KEYS[5], KEYS[6], KEYS[7]
+local url, user, code, del, created, clicks, deleted, deletedMs = ARGV[2], ARGV[3], ARGV[4], ARGV[5], ARGV[6], ARGV[7], ARGV[8], ARGV[9]
+local title, preview, redirect, password, maxClicks, rules = ARGV[10], ARGV[11], ARGV[12], ARGV[13], ARGV[14], ARGV[15]
+if code ~= '' then
+	local other = redis.call('GET', codeKey)
+	if other and other ~= id then
+		return 'alias'
+	end
+end
+local other = live(urlKey)
+if other == id then
+	other = false
+end
+if other and del ~= '1' then
+	return 'url'
+end
+local old = redis.call('HMGET', link, 'url', 'user', 'code')
+if old[1] and redis.call('GET', P .. 'url:' .. old[1]) == id then
+	redis.call('DEL', P .. 'url:' .. old[1])
+end
+if old[2] then
+	redis.call('SREM', P .. 'user:' .. old[2], id)
+end
+if old[3] and old[3] ~= '' and redis.call('GET', P .. 'code:' .. old[3]) == id then
+	redis.call('DEL', P .. 'code:' .. old[3])
+end
+redis.call('DEL', link, history)
+redis.call('ZREM', trash, id)
+create(id, urlKey, userKey, url, user, code, created)
+if other then
+	redis.call('SET', urlKey, other)
+end
+redis.call('HSET', link, 'clicks', clicks, 'title', title, 'preview', preview, 'redirect', redirect,
+	'password', password, 'max_clicks', maxClicks, 'rules', rules)
+if code ~= '' then
+	redis.call('SET', codeKey, id)
+end
+if del == '1' then
+	redis.call('HSET', link, 'del', '1', 'deleted', deleted)
+	redis.call('ZADD', trash, deletedMs, id)
+end
+for i = 16, #ARGV do
+	redis.call('RPUSH', history, ARGV[i])
+end
+local last = tonumber(redis.call('GET', KEYS[1]) or '0')
+if last < tonumber(id) + 1 then
+	redis.call('SET', KEYS[1], tonumber(id) + 1)
+end
+return 'ok'
+`)
+
+	// reserveScript поднимает счетчик ID KEYS[1] до ARGV[1].
+	reserveScript = redis.NewScript(`
+local last = tonumber(redis.call('GET', KEYS[1]) or '0')
+if last < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+	// purgeScript окончательно удаляет ссылки из корзины KEYS[1], удаленные
+	// раньше ARGV[1] мс.
+	purgeScript = redis.NewScript(lib + `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1])
+for _, id in ipairs(ids) do
+	local link = P .. 'link:' .. id
+	local fields = redis.call('HMGET', link, 'url', 'user', 'code')
+	if fields[1] and redis.call('GET', P .. 'url:' .. fields[1]) == id then
+		redis.call('DEL', P .. 'url:' .. fields[1])
+	end
+	if fields[3] and fields[3] ~= '' then
+		redis.call('DEL', P .. 'code:' .. fields[3])
+	end
+	if fields[2] then
+		redis.call('SREM', P .. 'user:' .. fields[2], id)
+	end
+	redis.call('DEL', link, P .. 'history:' .. id)
+	redis.call('ZREM', KEYS[1], id)
+end
+return #ids
+`)
+)
+
+func (c *InRedis) StartRedis() (*redis.Client, error) {
+	client := redis.NewClient(&redis.Options{Addr: c.RedisAddr})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (c *InRedis) PingDB(ctx context.Context) error {
+	return c.Client.Ping(ctx).Err()
+}
+
+func (c *InRedis) Close() error {
+	return c.Client.Close()
+}
+
+func (c *InRedis) generator() codegen.CodeGenerator {
+	if c.Generator == nil {
+		return codegen.CounterGenerator{}
+	}
+
+	return c.Generator
+}
+
+// num возвращает код как base36 ID или "", если код не является base36 числом.
+func num(str string) string {
+	id, err := strconv.ParseInt(str, 36, 64)
+	if err != nil || id < 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(id, 10)
+}
+
+// codeArgs возвращает пары код, base36 ID для скриптов.
+func codeArgs(ids []string) []any {
+	args := make([]any, 0, len(ids)*2)
+	for _, sid := range ids {
+		args = append(args, sid, num(sid))
+	}
+
+	return args
+}
+
+// codeKeys возвращает ключи, по которым скрипты ищут ссылки с кодами ids:
+// для каждого кода ключ явного кода и, если код - base36 число, ключ ссылки с
+// этим ID.
+func codeKeys(ids ...string) []string {
+	keys := make([]string, 0, len(ids)*2)
+	for _, sid := range ids {
+		keys = append(keys, key("code", sid))
+		if n := num(sid); n != "" {
+			keys = append(keys, key("link", n))
+		}
+	}
+
+	return keys
+}
+
+func shortID(id, code string) string {
+	if code != "" {
+		return code
+	}
+
+	n, _ := strconv.Atoi(id)
+
+	return strconv.FormatInt(int64(n), 36)
+}
+
+func nanos(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// maxAddAttempts - сколько раз повторяется добавление, если одновременный
+// запрос изменил счетчик ID или адреса.
+const maxAddAttempts = 20
+
+var errAddContention = errors.New("too many concurrent additions")
+
+// candidates возвращает варианты кода ссылки id в порядке попыток тройками
+// код, base36 ID, '1' для явно хранимого кода и ключи этих кодов.
+func (c *InRedis) candidates(id int, url string) ([]any, []string, error) {
+	gen := c.generator()
+
+	var args []any
+	var keys []string
+	for attempt := 0; attempt < codegen.MaxAttempts; attempt++ {
+		code, err := gen.Generate(id, url, attempt)
+		if errors.Is(err, codegen.ErrCodesExhausted) {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		// Код, совпадающий с base36 ID, не хранится явно.
+		explicit := "0"
+		if code != shortID(strconv.Itoa(id), "") {
+			explicit = "1"
+		}
+
+		args = append(args, code, num(code), explicit)
+		keys = append(keys, codeKeys(code)...)
+	}
+
+	if len(args) == 0 {
+		return nil, nil, codegen.ErrCodesExhausted
+	}
+
+	return args, keys, nil
+}
+
+// add добавляет ссылки urls с параметрами s и возвращает тройки id, code,
+// status. Коды рассчитываются по текущему счетчику ID, а назначаются тем же
+// скриптом, который создает ссылки.
+func (c *InRedis) add(ctx context.Context, urls []string, user string, s mod.Settings) ([]string, error) {
+	rules, err := mod.EncodeRules(s.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	probeKeys := make([]string, 0, len(urls)+1)
+	probeKeys = append(probeKeys, idKey)
+	for _, u := range urls {
+		probeKeys = append(probeKeys, key("url", u))
+	}
+
+	for attempt := 0; attempt < maxAddAttempts; attempt++ {
+		probe, err := probeScript.Run(ctx, c.Client, probeKeys).StringSlice()
+		if err != nil {
+			return nil, err
+		}
+
+		next, err := strconv.Atoi(probe[0])
+		if err != nil {
+			return nil, err
+		}
+
+		args := []any{user, nanos(time.Now()), s.Title, flag(s.Preview), s.Redirect, s.PasswordHash, s.MaxClicks, rules, probe[0]}
+		keys := []string{idKey, key("user", user)}
+		seen := make(map[string]bool, len(urls))
+		for i, u := range urls {
+			keys = append(keys, key("url", u))
+			if probe[i+1] == "1" || seen[u] {
+				args = append(args, u, 0)
+				continue
+			}
+			seen[u] = true
+
+			codes, candidateKeys, err := c.candidates(next, u)
+			if err != nil {
+				return nil, err
+			}
+			next++
+
+			args = append(append(args, u, len(codes)/3), codes...)
+			keys = append(keys, candidateKeys...)
+		}
+
+		res, err := addScript.Run(ctx, c.Client, keys, args...).StringSlice()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case len(res) == 1 && res[0] == "retry":
+			continue
+		case len(res) == 1 && res[0] == "exhausted":
+			return nil, codegen.ErrCodesExhausted
+		}
+
+		return res, nil
+	}
+
+	return nil, errAddContention
+}
+
+func (c *InRedis) Add(url, user string, s mod.Settings) (string, error) {
+	res, err := c.add(context.Background(), []string{url}, user, s)
+	if err != nil {
+		return "", err
+	}
+
+	id, code, status := res[0], res[1], res[2]
+	if status == "exists" {
+		return shortID(id, code), mod.ErrURLConflict
+	}
+
+	return shortID(id, code), nil
+}
+
+func (c *InRedis) AddAlias(url, alias, user string) (string, error) {
+	if !mod.ValidAlias(alias) {
+		return "", mod.ErrInvalidAlias
+	}
+
+	keys := append([]string{idKey, key("url", url), key("user", user)}, codeKeys(alias)...)
+	res, err := aliasScript.Run(context.Background(), c.Client, keys, alias, num(alias), url, user, nanos(time.Now())).StringSlice()
+	if err != nil {
+		return "", err
+	}
+
+	switch res[2] {
+	case "alias":
+		return "", mod.ErrAliasConflict
+	case "url":
+		return shortID(res[0], res[1]), mod.ErrURLConflict
+	}
+
+	return alias, nil
+}
+
+// BatchAdd добавляет ссылки одним скриптом. Для уже сокращенных адресов
+// возвращаются коды существующих ссылок и mod.BatchConflictError.
+func (c *InRedis) BatchAdd(urls []string, user string) ([]string, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	res, err := c.add(context.Background(), urls, user, mod.Settings{})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(urls))
+	var exists []int
+	for i := range urls {
+		id, code, status := res[3*i], res[3*i+1], res[3*i+2]
+		if status != "new" {
+			exists = append(exists, i)
+		}
+
+		ids = append(ids, shortID(id, code))
+	}
+
+	return ids, mod.BatchConflict(exists)
+}
+
+func (c *InRedis) Get(str string) (string, bool, error) {
+	res, err := getScript.Run(context.Background(), c.Client, codeKeys(str), str, num(str)).Slice()
+	if errors.Is(err, redis.Nil) {
+		return "", false, mod.ErrStorageIsNil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	url, _ := res[0].(string)
+	del, _ := res[1].(string)
+	if del == "1" {
+		return "", true, nil
+	}
+
+	return url, false, nil
+}
+
+// events возвращает все ссылки пользователя, отсортированные по ID.
+func (c *InRedis) events(user string) ([]mod.Event, error) {
+	ctx := context.Background()
+
+	ids, err := c.Client.SMembers(ctx, key("user", user)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := c.Client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, key("link", id))
+	}
+
+	if len(ids) > 0 {
+		if _, err = pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	events := make([]mod.Event, 0, len(ids))
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+
+		events = append(events, toEvent(ids[i], fields))
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+
+	return events, nil
+}
+
+func toEvent(id string, fields map[string]string) mod.Event {
+	e := mod.Event{
+		Code:   fields["code"],
+		URL:    fields["url"],
+		Del:    fields["del"] == "1",
+		UserID: fields["user"],
+		Settings: mod.Settings{
+			Title:        fields["title"],
+			Preview:      fields["preview"] == "1",
+			PasswordHash: fields["password"],
+		},
+	}
+
+	e.ID, _ = strconv.Atoi(id)
+	e.Clicks, _ = strconv.Atoi(fields["clicks"])
+	e.Redirect, _ = strconv.Atoi(fields["redirect"])
+	e.MaxClicks, _ = strconv.Atoi(fields["max_clicks"])
+	e.Rules, _ = mod.DecodeRules(fields["rules"])
+
+	if n, err := strconv.ParseInt(fields["created"], 10, 64); err == nil {
+		e.Created = time.Unix(0, n)
+	}
+
+	if n, err := strconv.ParseInt(fields["deleted"], 10, 64); err == nil {
+		e.DelAt = time.Unix(0, n)
+	}
+
+	return e
+}
+
+func (c *InRedis) toURLs(events []mod.Event) []mod.URLs {
+	var UserURLs []mod.URLs
+	for _, i := range events {
+		UserURLs = append(UserURLs, mod.URLs{
+			ShortURL:    "http://" + c.ServerAddress + c.BaseURL + i.ShortID(),
+			OriginalURL: i.URL,
+			Created:     i.Created,
+			Deleted:     i.Del,
+			Clicks:      i.Clicks,
+			DeletedAt:   i.DelAt,
+		})
+	}
+
+	return UserURLs
+}
+
+func (c *InRedis) GetAll(user string) ([]mod.URLs, error) {
+	events, err := c.events(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.toURLs(events), nil
+}
+
+func (c *InRedis) Find(user string, q mod.Query) ([]mod.URLs, *mod.Cursor, error) {
+	all, err := c.events(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var events []mod.Event
+	for _, i := range all {
+		if !i.Del {
+			events = append(events, i)
+		}
+	}
+
+	page, next := mod.Page(events, q)
+
+	return c.toURLs(page), next, nil
+}
+
+// flag возвращает значение логического поля хеша.
+func flag(b bool) string {
+	if b {
+		return "1"
+	}
+
+	return "0"
+}
+
+// Link возвращает ссылку по короткому коду вместе с ее параметрами, без истории.
+func (c *InRedis) Link(str string) (mod.Event, error) {
+	id, fields, err := c.link(str)
+	if err != nil {
+		return mod.Event{}, err
+	}
+
+	return toEvent(id, fields), nil
+}
+
+// link возвращает ID ссылки по короткому коду и поля ее хеша.
+func (c *InRedis) link(str string) (string, map[string]string, error) {
+	res, err := linkScript.Run(context.Background(), c.Client, codeKeys(str), str, num(str)).StringSlice()
+	if errors.Is(err, redis.Nil) {
+		return "", nil, mod.ErrStorageIsNil
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	fields := make(map[string]string, len(res)/2)
+	for i := 1; i+1 < len(res); i += 2 {
+		fields[res[i]] = res[i+1]
+	}
+
+	return res[0], fields, nil
+}
+
+// maxConfigureAttempts - сколько раз параметры перечитываются, если
+// одновременный запрос изменил их после чтения.
+const maxConfigureAttempts = 20
+
+var errConfigureContention = errors.New("too many concurrent settings changes")
+
+// Configure сохраняет параметры, только если они не изменились после
+// чтения, иначе читает их и вызывает edit заново.
+func (c *InRedis) Configure(str string, edit func(*mod.Settings) error, user string) error {
+	for attempt := 0; attempt < maxConfigureAttempts; attempt++ {
+		id, fields, err := c.link(str)
+		if err != nil {
+			return err
+		}
+
+		e := toEvent(id, fields)
+		switch {
+		case e.Del:
+			return mod.ErrStorageIsNil
+		case e.UserID != user:
+			return mod.ErrForbidden
+		}
+
+		if err = edit(&e.Settings); err != nil {
+			return err
+		}
+
+		rules, err := mod.EncodeRules(e.Rules)
+		if err != nil {
+			return err
+		}
+
+		status, err := configureScript.Run(context.Background(), c.Client, codeKeys(str), str, num(str), user,
+			fields["title"], fields["preview"], fields["redirect"], fields["password"], fields["max_clicks"], fields["rules"],
+			e.Title, flag(e.Preview), e.Redirect, e.PasswordHash, e.MaxClicks, rules).Text()
+		if err != nil {
+			return err
+		}
+
+		if status != "retry" {
+			return statusErr(status)
+		}
+	}
+
+	return errConfigureContention
+}
+
+func (c *InRedis) Click(str string) error {
+	status, err := clickScript.Run(context.Background(), c.Client, codeKeys(str), str, num(str)).Text()
+	if err != nil {
+		return err
+	}
+
+	return statusErr(status)
+}
+
+func statusErr(status string) error {
+	switch status {
+	case "missing":
+		return mod.ErrStorageIsNil
+	case "forbidden":
+		return mod.ErrForbidden
+	case "conflict":
+		return mod.ErrURLConflict
+	case "exhausted":
+		return mod.ErrExhausted
+	}
+
+	return nil
+}
+
+func (c *InRedis) Update(str, url, user string) error {
+	keys := append([]string{key("url", url)}, codeKeys(str)...)
+	status, err := updateScript.Run(context.Background(), c.Client, keys,
+		str, num(str), user, url, time.Now().Format(time.RFC3339Nano)).Text()
+	if err != nil {
+		return err
+	}
+
+	return statusErr(status)
+}
+
+func (c *InRedis) History(str, user string) ([]mod.Version, error) {
+	res, err := historyScript.Run(context.Background(), c.Client, codeKeys(str), str, num(str), user).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = statusErr(res[0]); err != nil {
+		return nil, err
+	}
+
+	return parseHistory(res[1:])
+}
+
+// parseHistory разбирает записи истории вида "время адрес".
+func parseHistory(items []string) ([]mod.Version, error) {
+	var history []mod.Version
+	for _, item := range items {
+		replaced, url, _ := strings.Cut(item, " ")
+
+		v := mod.Version{URL: url}
+		var err error
+		if v.Replaced, err = time.Parse(time.RFC3339Nano, replaced); err != nil {
+			return nil, err
+		}
+
+		history = append(history, v)
+	}
+
+	return history, nil
+}
+
+func (c *InRedis) Trash(user string, since time.Time) ([]mod.URLs, error) {
+	all, err := c.events(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []mod.Event
+	for _, i := range all {
+		if i.Del && !i.DelAt.Before(since) {
+			events = append(events, i)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].DelAt.After(events[j].DelAt)
+	})
+
+	return c.toURLs(events), nil
+}
+
+func (c *InRedis) Restore(ids []string, user string, since time.Time) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := append([]any{user, since.UnixMilli()}, codeArgs(ids)...)
+
+	keys := append([]string{trashKey}, codeKeys(ids...)...)
+
+	return restoreScript.Run(context.Background(), c.Client, keys, args...).StringSlice()
+}
+
+func (c *InRedis) Purge(before time.Time) (int, error) {
+	return purgeScript.Run(context.Background(), c.Client, []string{trashKey}, before.UnixMilli()).Int()
+}
+
+// BatchUpdate удаляет ссылки одним скриптом в фоне.
+func (c *InRedis) BatchUpdate(ids []string, user string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	go func() {
+		res, err := c.Delete(ids, user)
+		if err != nil {
+			log.Print("delete err: ", err)
+			return
+		}
+
+		log.Printf("delete: user: %s, ids: %v, result: %v", user, ids, res)
+	}()
+}
+
+// Delete удаляет ссылки пользователя одним скриптом и возвращает результат для
+// каждого кода.
+func (c *InRedis) Delete(ids []string, user string) (map[string]string, error) {
+	res := make(map[string]string, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+
+	now := time.Now()
+	args := append([]any{user, nanos(now), now.UnixMilli()}, codeArgs(ids)...)
+
+	keys := append([]string{trashKey}, codeKeys(ids...)...)
+
+	statuses, err := deleteScript.Run(context.Background(), c.Client, keys, args...).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, sid := range ids {
+		// Повтор кода не перекрывает результат первого удаления.
+		if _, ok := res[sid]; !ok {
+			res[sid] = statuses[i]
+		}
+	}
+
+	return res, nil
+}
+
+// Export возвращает до limit ссылок с ID больше after в порядке ID.
+func (c *InRedis) Export(after, limit int) ([]mod.Event, error) {
+	ctx := context.Background()
+
+	last, err := c.LastID()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []mod.Event
+	for from := after + 1; from <= last && len(events) < limit; from += limit {
+		pipe := c.Client.Pipeline()
+		links := make([]*redis.MapStringStringCmd, 0, limit)
+		history := make([]*redis.StringSliceCmd, 0, limit)
+		for id := from; id < from+limit && id <= last; id++ {
+			links = append(links, pipe.HGetAll(ctx, key("link", strconv.Itoa(id))))
+			history = append(history, pipe.LRange(ctx, key("history", strconv.Itoa(id)), 0, -1))
+		}
+
+		if _, err = pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+
+		for i, cmd := range links {
+			if len(cmd.Val()) == 0 {
+				continue
+			}
+
+			e := toEvent(strconv.Itoa(from+i), cmd.Val())
+			if e.History, err = parseHistory(history[i].Val()); err != nil {
+				return nil, err
+			}
+
+			events = append(events, e)
+			if len(events) == limit {
+				break
+			}
+		}
+	}
+
+	return events, nil
+}
+
+// LastID возвращает наибольший выданный ID.
+func (c *InRedis) LastID() (int, error) {
+	n, err := c.Client.Get(context.Background(), idKey).Int()
+	if errors.Is(err, redis.Nil) {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return n - 1, nil
+}
+
+// Import сохраняет ссылки с их ID и кодами. Ссылки с теми же ID перезаписываются.
+func (c *InRedis) Import(events []mod.Event) error {
+	ctx := context.Background()
+
+	for _, e := range events {
+		del, deleted, deletedMs := "0", "", int64(0)
+		if e.Del {
+			if e.DelAt.IsZero() {
+				e.DelAt = time.Now()
+			}
+			del, deleted, deletedMs = "1", nanos(e.DelAt), e.DelAt.UnixMilli()
+		}
+
+		rules, err := mod.EncodeRules(e.Rules)
+		if err != nil {
+			return err
+		}
+
+		args := []any{e.ID, e.URL, e.UserID, e.Code, del, nanos(e.Created), e.Clicks, deleted, deletedMs, e.Title, flag(e.Preview), e.Redirect, e.PasswordHash, e.MaxClicks, rules}
+		for _, v := range e.History {
+			args = append(args, v.Replaced.Format(time.RFC3339Nano)+" "+v.URL)
+		}
+
+		id := strconv.Itoa(e.ID)
+		keys := []string{idKey, key("link", id), key("history", id), key("url", e.URL), key("user", e.UserID), trashKey}
+		if e.Code != "" {
+			keys = append(keys, key("code", e.Code))
+		}
+
+		status, err := importScript.Run(ctx, c.Client, keys, args...).Text()
+		if err != nil {
+			return err
+		}
+
+		switch status {
+		case "alias":
+			return fmt.Errorf("import %d: %w", e.ID, mod.ErrAliasConflict)
+		case "url":
+			return fmt.Errorf("import %d: %w", e.ID, mod.ErrURLConflict)
+		}
+	}
+
+	return nil
+}
+
+// Reserve гарантирует, что новые ссылки получат ID больше id.
+func (c *InRedis) Reserve(id int) error {
+	return reserveScript.Run(context.Background(), c.Client, []string{idKey}, id+1).Err()
+}
@@ -1,25 +1,197 @@
 package model
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
 
 var S struct {
-	URLs map[int]Event // Используется, если File не прописан
-	ID   int           // Это ID последнего элемента в хранилище
+	sync.RWMutex
+	URLs  map[int]Event  // Используется, если File не прописан
+	Codes map[string]int // Короткие коды ссылок, заданные явно (псевдонимы)
+	Links map[string]int // ID ссылок по адресу, адрес может быть сокращен только один раз
+	ID    int            // Это ID последнего элемента в хранилище
 }
 
 type Event struct {
-	ID     int    `json:"id"`
-	URL    string `json:"url"`
-	Del    bool   `json:"del"`
-	UserID string `json:"user_id"`
+	ID      int       `json:"id"`
+	Code    string    `json:"code,omitempty"`
+	URL     string    `json:"url"`
+	Del     bool      `json:"del"`
+	UserID  string    `json:"user_id"`
+	Created time.Time `json:"created"`
+	Clicks  int       `json:"clicks,omitempty"`
+	History []Version `json:"history,omitempty"`
+	DelAt   time.Time `json:"del_at"`
+	Purged  bool      `json:"purged,omitempty"` // ссылка удалена окончательно, сохранен только ID
+	Settings
+}
+
+// Settings - параметры ссылки, заданные ее владельцем.
+type Settings struct {
+	Title   string `json:"title,omitempty"`   // заголовок на странице предпросмотра
+	Preview bool   `json:"preview,omitempty"` // переход только через страницу предпросмотра
+	// Redirect - код ответа при переходе, 0 - код по умолчанию из конфигурации.
+	Redirect int `json:"redirect,omitempty"`
+	// PasswordHash - bcrypt хеш пароля ссылки, пустой - ссылка без пароля.
+	PasswordHash string `json:"password_hash,omitempty"`
+	// MaxClicks - число переходов, после которого ссылка перестает работать,
+	// 0 - без ограничения.
+	MaxClicks int `json:"max_clicks,omitempty"`
+	// Rules - правила выбора адреса перехода, проверяются по порядку.
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// Rule - правило переадресации: если запрос подходит под все заданные
+// условия, ссылка ведет на URL. В условии со списком достаточно совпадения
+// с одним значением, правило без условий срабатывает всегда.
+type Rule struct {
+	ID        int        `json:"id"`
+	URL       string     `json:"url"`
+	Platforms []string   `json:"platforms,omitempty"` // платформы по User-Agent: ios, android, windows, macos, linux
+	Languages []string   `json:"languages,omitempty"` // языки из Accept-Language: en или en-US
+	Countries []string   `json:"countries,omitempty"` // коды стран ISO 3166-1 по базе GeoIP
+	From      *time.Time `json:"from,omitempty"`      // начало действия правила
+	Until     *time.Time `json:"until,omitempty"`     // конец действия правила
+}
+
+// EncodeRules возвращает правила в JSON для хранилищ, которые хранят
+// параметры по полям. Пустые правила кодируются пустой строкой.
+func EncodeRules(rules []Rule) (string, error) {
+	if len(rules) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(rules)
+
+	return string(b), err
+}
+
+// DecodeRules разбирает правила, закодированные EncodeRules.
+func DecodeRules(s string) ([]Rule, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return nil, fmt.Errorf("decode rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+// Exhausted сообщает, исчерпаны ли переходы по ссылке.
+func (e Event) Exhausted() bool {
+	return e.MaxClicks > 0 && e.Clicks >= e.MaxClicks
+}
+
+// ValidRedirect сообщает, можно ли переадресовывать по ссылке с кодом status.
+func ValidRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+// Version - предыдущая ссылка, на которую вел короткий код, и время ее замены.
+type Version struct {
+	URL      string    `json:"url"`
+	Replaced time.Time `json:"replaced_at"`
+}
+
+// ShortID возвращает короткий код ссылки: явно заданный код или ID в base36.
+func (e Event) ShortID() string {
+	if e.Code != "" {
+		return e.Code
+	}
+
+	return strconv.FormatInt(int64(e.ID), 36)
 }
 
 type URLs struct {
-	ShortURL    string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	Created     time.Time `json:"-"`
+	Deleted     bool      `json:"-"`
+	Clicks      int       `json:"-"`
+	DeletedAt   time.Time `json:"-"`
 }
 
 var (
-	ErrURLConflict  = errors.New("url conflict")
-	ErrStorageIsNil = errors.New("the storage is empty or the element is missing")
+	ErrURLConflict   = errors.New("url conflict")
+	ErrAliasConflict = errors.New("alias conflict")
+	ErrInvalidAlias  = errors.New("invalid alias")
+	ErrForbidden     = errors.New("the element belongs to another user")
+	ErrStorageIsNil  = errors.New("the storage is empty or the element is missing")
+	ErrExhausted     = errors.New("the link click limit is exhausted")
 )
+
+// Результаты удаления ссылки.
+const (
+	DelDeleted        = "deleted"
+	DelNotFound       = "not_found"
+	DelForbidden      = "forbidden"
+	DelAlreadyDeleted = "already_deleted"
+)
+
+// DelStatus возвращает результат удаления ссылки e пользователем user.
+// found - ссылка найдена.
+func DelStatus(e Event, found bool, user string) string {
+	switch {
+	case !found:
+		return DelNotFound
+	case e.UserID != user:
+		return DelForbidden
+	case e.Del:
+		return DelAlreadyDeleted
+	default:
+		return DelDeleted
+	}
+}
+
+// BatchConflictError возвращается из BatchAdd вместе с кодами всех ссылок, если
+// часть адресов уже была сокращена.
+type BatchConflictError struct {
+	// Exists - индексы уже сокращенных адресов в пакете, включая повторы
+	// адреса внутри пакета.
+	Exists []int
+}
+
+func (e *BatchConflictError) Error() string {
+	return fmt.Sprintf("url conflict: %d of the batch urls already shortened", len(e.Exists))
+}
+
+func (e *BatchConflictError) Unwrap() error {
+	return ErrURLConflict
+}
+
+// BatchConflict возвращает BatchConflictError или nil, если exists пуст.
+func BatchConflict(exists []int) error {
+	if len(exists) == 0 {
+		return nil
+	}
+
+	return &BatchConflictError{Exists: exists}
+}
+
+// Псевдоним не может начинаться с "0": такие коды зарезервированы для ссылок,
+// чей base36 код уже занят псевдонимом.
+var aliasRe = regexp.MustCompile(`^[A-Za-z1-9_-][A-Za-z0-9_-]{0,63}$`)
+
+func ValidAlias(alias string) bool {
+	return aliasRe.MatchString(alias)
+}
+
+// ShiftedCode возвращает код для ссылки, чей base36 код уже занят псевдонимом.
+func ShiftedCode(code string) string {
+	return "0" + code
+}
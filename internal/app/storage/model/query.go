@@ -0,0 +1,143 @@
+package model
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SortCreated = "created"
+	SortClicks  = "clicks"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Query - параметры выборки ссылок пользователя.
+type Query struct {
+	Limit       int // 0 - без ограничения
+	After       *Cursor
+	Contains    string
+	Host        string
+	CreatedFrom time.Time // включительно
+	CreatedTo   time.Time // не включительно
+	Sort        string
+	Desc        bool
+}
+
+// Cursor указывает на последнюю ссылку предыдущей страницы: значение поля
+// сортировки и ID ссылки в хранилище.
+type Cursor struct {
+	Key int64
+	ID  int
+}
+
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.Key, c.ID)))
+}
+
+// Before проверяет, что ссылка с полем сортировки key и ID id идет после курсора.
+func (c Cursor) Before(key int64, id int, desc bool) bool {
+	if key == c.Key {
+		if desc {
+			return id < c.ID
+		}
+		return id > c.ID
+	}
+
+	if desc {
+		return key < c.Key
+	}
+	return key > c.Key
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if _, err = fmt.Sscanf(string(b), "%d:%d", &c.Key, &c.ID); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// SortKey возвращает значение поля сортировки ссылки.
+func (q Query) SortKey(clicks int, created time.Time) int64 {
+	if q.Sort == SortClicks {
+		return int64(clicks)
+	}
+
+	return created.UnixNano()
+}
+
+// Match проверяет, подходит ли ссылка под фильтры запроса.
+func (q Query) Match(e Event) bool {
+	if q.Contains != "" && !strings.Contains(strings.ToLower(e.URL), strings.ToLower(q.Contains)) {
+		return false
+	}
+
+	if q.Host != "" {
+		u, err := url.Parse(e.URL)
+		if err != nil || !strings.EqualFold(u.Hostname(), q.Host) {
+			return false
+		}
+	}
+
+	if !q.CreatedFrom.IsZero() && e.Created.Before(q.CreatedFrom) {
+		return false
+	}
+
+	if !q.CreatedTo.IsZero() && !e.Created.Before(q.CreatedTo) {
+		return false
+	}
+
+	return true
+}
+
+// Page фильтрует, сортирует и ограничивает ссылки согласно запросу.
+// Возвращает страницу и курсор следующей страницы, если она есть.
+func Page(events []Event, q Query) ([]Event, *Cursor) {
+	var matched []Event
+	for _, e := range events {
+		if q.Match(e) {
+			matched = append(matched, e)
+		}
+	}
+
+	less := func(a, b Event) bool {
+		ka, kb := q.SortKey(a.Clicks, a.Created), q.SortKey(b.Clicks, b.Created)
+		if ka != kb {
+			return ka < kb
+		}
+		return a.ID < b.ID
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if q.Desc {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+
+	if q.After != nil {
+		start := sort.Search(len(matched), func(i int) bool {
+			return q.After.Before(q.SortKey(matched[i].Clicks, matched[i].Created), matched[i].ID, q.Desc)
+		})
+		matched = matched[start:]
+	}
+
+	if q.Limit > 0 && len(matched) > q.Limit {
+		last := matched[q.Limit-1]
+		return matched[:q.Limit], &Cursor{Key: q.SortKey(last.Clicks, last.Created), ID: last.ID}
+	}
+
+	return matched, nil
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"main/internal/app/config"
+	"main/internal/app/storage/codegen"
+	b "main/internal/app/storage/inbolt"
+	d "main/internal/app/storage/indb"
+	f "main/internal/app/storage/infile"
+	m "main/internal/app/storage/inmemory"
+	r "main/internal/app/storage/inredis"
+	mod "main/internal/app/storage/model"
+)
+
+// Имена встроенных хранилищ для config.StorageBackend.
+const (
+	Memory   = "memory"
+	File     = "file"
+	Postgres = "postgres"
+	Redis    = "redis"
+	Embedded = "embedded"
+)
+
+// Factory создает хранилище по конфигурации.
+type Factory func(conf config.Config, generator codegen.CodeGenerator) (Storage, error)
+
+var factories = make(map[string]Factory)
+
+// Register добавляет фабрику хранилища с именем name.
+func Register(name string, factory Factory) {
+	if _, ok := factories[name]; ok {
+		panic("storage: backend registered twice: " + name)
+	}
+
+	factories[name] = factory
+}
+
+// Backends возвращает имена зарегистрированных хранилищ.
+func Backends() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Backend возвращает имя хранилища из конфигурации. Если оно не задано,
+// хранилище выбирается по заданным адресам, как до появления STORAGE_BACKEND.
+func Backend(conf config.Config) string {
+	switch {
+	case conf.StorageBackend != "":
+		return conf.StorageBackend
+	case conf.DataBaseDSN != "":
+		return Postgres
+	case conf.RedisAddr != "":
+		return Redis
+	case conf.FileStoragePath != "":
+		return File
+	default:
+		return Memory
+	}
+}
+
+// Open создает хранилище, выбранное в конфигурации.
+func Open(conf config.Config) (Storage, error) {
+	name := Backend(conf)
+
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q, available: %s", name, strings.Join(Backends(), ", "))
+	}
+
+	generator, err := codegen.New(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return factory(conf, generator)
+}
+
+// Shared сообщает, хранит ли хранилище name ссылки в общем состоянии
+// процесса (mod.S). В процессе может быть открыто только одно такое хранилище.
+func Shared(name string) bool {
+	return name == Memory || name == File
+}
+
+// resetShared очищает общее состояние перед открытием хранилища в памяти.
+func resetShared() {
+	mod.S.Lock()
+	defer mod.S.Unlock()
+
+	mod.S.ID = -1
+	mod.S.URLs = make(map[int]mod.Event)
+	mod.S.Codes = make(map[string]int)
+	mod.S.Links = make(map[string]int)
+}
+
+func init() {
+	Register(Memory, func(conf config.Config, generator codegen.CodeGenerator) (Storage, error) {
+		resetShared()
+
+		memory := m.InMemory{
+			ServerAddress: conf.ServerAddress,
+			BaseURL:       conf.BaseURL,
+			Generator:     generator,
+		}
+
+		if conf.MemorySnapshotPath == "" {
+			return &memory, nil
+		}
+
+		var c = &m.Durable{
+			InMemory:     memory,
+			SnapshotPath: conf.MemorySnapshotPath,
+			Interval:     conf.SnapshotInterval,
+		}
+
+		if err := c.StartDurable(); err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	})
+
+	Register(File, func(conf config.Config, generator codegen.CodeGenerator) (Storage, error) {
+		if conf.FileStoragePath == "" {
+			return nil, fmt.Errorf("file storage requires FILE_STORAGE_PATH")
+		}
+
+		resetShared()
+
+		var c = &f.InFile{
+			InMemory: m.InMemory{
+				ServerAddress: conf.ServerAddress,
+				BaseURL:       conf.BaseURL,
+				Generator:     generator,
+			},
+			FileStoragePath: conf.FileStoragePath,
+		}
+
+		if err := c.StartFileStorage(); err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	})
+
+	Register(Postgres, func(conf config.Config, generator codegen.CodeGenerator) (Storage, error) {
+		if conf.DataBaseDSN == "" {
+			return nil, fmt.Errorf("postgres storage requires DATABASE_DSN")
+		}
+
+		var c = &d.InDB{
+			ServerAddress: conf.ServerAddress,
+			BaseURL:       conf.BaseURL,
+			DataBaseDSN:   conf.DataBaseDSN,
+			Generator:     generator,
+		}
+
+		db, err := c.StartDataBase()
+		if err != nil {
+			return nil, err
+		}
+		c.DB = db
+
+		return c, nil
+	})
+
+	Register(Redis, func(conf config.Config, generator codegen.CodeGenerator) (Storage, error) {
+		if conf.RedisAddr == "" {
+			return nil, fmt.Errorf("redis storage requires REDIS_ADDR")
+		}
+
+		var c = &r.InRedis{
+			ServerAddress: conf.ServerAddress,
+			BaseURL:       conf.BaseURL,
+			RedisAddr:     conf.RedisAddr,
+			Generator:     generator,
+		}
+
+		client, err := c.StartRedis()
+		if err != nil {
+			return nil, err
+		}
+		c.Client = client
+
+		return c, nil
+	})
+
+	Register(Embedded, func(conf config.Config, generator codegen.CodeGenerator) (Storage, error) {
+		if conf.EmbeddedPath == "" {
+			return nil, fmt.Errorf("embedded storage requires EMBEDDED_PATH")
+		}
+
+		var c = &b.InBolt{
+			ServerAddress: conf.ServerAddress,
+			BaseURL:       conf.BaseURL,
+			EmbeddedPath:  conf.EmbeddedPath,
+			Generator:     generator,
+		}
+
+		db, err := c.StartEmbedded()
+		if err != nil {
+			return nil, err
+		}
+		c.DB = db
+
+		return c, nil
+	})
+}
@@ -2,63 +2,127 @@ package storage
 
 import (
 	"context"
+	"log"
+	"time"
 
 	_ "github.com/lib/pq"
-	"main/internal/app/config"
-	d "main/internal/app/storage/indb"
-	f "main/internal/app/storage/infile"
-	m "main/internal/app/storage/inmemory"
 	mod "main/internal/app/storage/model"
 )
 
 type Storage interface {
-	Add(url, user string) (string, error)
+	// Add добавляет ссылку с параметрами s. Для уже сокращенного адреса
+	// возвращает код существующей ссылки и mod.ErrURLConflict, параметры
+	// существующей ссылки не меняются.
+	Add(url, user string, s mod.Settings) (string, error)
+	AddAlias(url, alias, user string) (string, error)
 	BatchAdd(urls []string, user string) ([]string, error)
-	BatchUpdate(ids []string, user string)
+	Update(str, url, user string) error
+	History(str, user string) ([]mod.Version, error)
+	Trash(user string, since time.Time) ([]mod.URLs, error)
+	Restore(ids []string, user string, since time.Time) ([]string, error)
+	Purge(before time.Time) (int, error)
 	Get(str string) (string, bool, error)
 	GetAll(user string) ([]mod.URLs, error)
-	PingDB(cc context.Context) error
+	Find(user string, q mod.Query) ([]mod.URLs, *mod.Cursor, error)
+	Click(str string) error
+	// Link возвращает ссылку по короткому коду вместе с ее параметрами, без
+	// истории.
+	Link(str string) (mod.Event, error)
+	// Configure меняет параметры ссылки пользователя функцией edit. Чтение и
+	// запись параметров атомарны, ошибка edit отменяет изменение и
+	// возвращается. edit может вызываться повторно и не должна быть долгой.
+	Configure(str string, edit func(*mod.Settings) error, user string) error
 }
 
-func StartStorage(conf config.Config) (*m.InMemory, *f.InFile, *d.InDB, error) {
-	mod.S.ID = -1
+// Pinger - хранилище, доступность которого можно проверить.
+type Pinger interface {
+	PingDB(ctx context.Context) error
+}
 
-	if conf.DataBaseDSN != "" {
-		var c = &d.InDB{
-			ServerAddress: conf.ServerAddress,
-			BaseURL:       conf.BaseURL,
-			DataBaseDSN:   conf.DataBaseDSN,
-			DB:            nil,
-		}
+// Closer - хранилище, которое нужно закрыть при остановке сервиса.
+type Closer interface {
+	Close() error
+}
 
-		db, err := c.StartDataBase()
-		if err != nil {
-			return nil, nil, nil, err
+// Deleter - хранилище, поддерживающее удаление ссылок.
+type Deleter interface {
+	// BatchUpdate удаляет ссылки пользователя в фоне.
+	BatchUpdate(ids []string, user string)
+	// Delete удаляет ссылки пользователя сразу и возвращает результат для
+	// каждого кода: mod.DelDeleted, mod.DelNotFound, mod.DelForbidden или
+	// mod.DelAlreadyDeleted.
+	Delete(ids []string, user string) (map[string]string, error)
+}
+
+// CacheReporter - хранилище с кешем, считающее его попадания и промахи.
+type CacheReporter interface {
+	Stats() (hits, misses uint64)
+}
+
+// Exporter - хранилище, отдающее все ссылки с их ID и кодами.
+type Exporter interface {
+	// Export возвращает до limit ссылок с ID больше after в порядке ID.
+	Export(after, limit int) ([]mod.Event, error)
+	// LastID возвращает наибольший выданный ID.
+	LastID() (int, error)
+}
+
+// Importer - хранилище, принимающее ссылки с сохранением ID и кодов.
+type Importer interface {
+	// Import сохраняет ссылки, ссылки с теми же ID перезаписываются.
+	Import(events []mod.Event) error
+	// Reserve гарантирует, что новые ссылки получат ID больше id.
+	Reserve(id int) error
+}
+
+// As ищет у хранилища или у хранилищ под его декораторами возможность T.
+func As[T any](s Storage) (T, bool) {
+	for s != nil {
+		if t, ok := s.(T); ok {
+			return t, true
 		}
-		c.DB = db
-
-		return nil, nil, c, nil
-	} else if conf.FileStoragePath != "" {
-		var c = &f.InFile{
-			ServerAddress:   conf.ServerAddress,
-			BaseURL:         conf.BaseURL,
-			FileStoragePath: conf.FileStoragePath,
+
+		u, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			break
 		}
+		s = u.Unwrap()
+	}
 
-		err := c.StartFileStorage()
-		if err != nil {
-			return nil, nil, nil, err
+	var zero T
+	return zero, false
+}
+
+// Base возвращает хранилище под всеми декораторами, например под кешем.
+func Base(s Storage) Storage {
+	for {
+		u, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			return s
 		}
+		s = u.Unwrap()
+	}
+}
 
-		return nil, c, nil, nil
+// RunPurge раз в interval удаляет из хранилища ссылки, удаленные раньше, чем
+// retention назад.
+func RunPurge(s Storage, retention, interval time.Duration) {
+	if interval <= 0 {
+		return
 	}
 
-	mod.S.URLs = make(map[int]mod.Event)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	var c = &m.InMemory{
-		ServerAddress: conf.ServerAddress,
-		BaseURL:       conf.BaseURL,
-	}
+	for range ticker.C {
+		n, err := s.Purge(time.Now().Add(-retention))
+		if err != nil {
+			log.Print("purge err: ", err)
+			continue
+		}
 
-	return c, nil, nil, nil
+		if n > 0 {
+			log.Printf("purge: %d links", n)
+		}
+	}
 }
@@ -2,16 +2,28 @@ package storage
 
 import (
 	"log"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"main/internal/app/config"
+	"main/internal/app/storage/cache"
+	"main/internal/app/storage/codegen"
+	m "main/internal/app/storage/inmemory"
+	mod "main/internal/app/storage/model"
 )
 
 func TestAddAndGet(t *testing.T) {
 	conf := config.Conf
 
-	c, _, _, err := StartStorage(conf)
+	c, err := Open(conf)
 	if err != nil {
 		log.Print(err)
 	}
@@ -29,7 +41,7 @@ func TestAddAndGet(t *testing.T) {
 			wantErr: false,
 		}
 		t.Run(tt.name, func(t *testing.T) {
-			gotAdd, err := c.Add(tt.url, "")
+			gotAdd, err := c.Add(tt.url, "", mod.Settings{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Add() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -48,3 +60,795 @@ func TestAddAndGet(t *testing.T) {
 		})
 	}
 }
+
+func TestFileStorageReplay(t *testing.T) {
+	conf := config.Config{
+		ServerAddress:   "localhost:8080/",
+		FileStoragePath: filepath.Join(t.TempDir(), "storage.json"),
+	}
+
+	c, err := Open(conf)
+	require.NoError(t, err)
+
+	id, err := c.Add("https://ya.ru/1", "user", mod.Settings{})
+	require.NoError(t, err)
+
+	alias, err := c.AddAlias("https://ya.ru/2", "ya-2", "user")
+	require.NoError(t, err)
+	assert.Equal(t, "ya-2", alias)
+
+	_, err = c.AddAlias("https://ya.ru/3", "ya-2", "user")
+	assert.ErrorIs(t, err, mod.ErrAliasConflict)
+
+	_, err = c.AddAlias("https://ya.ru/3", "0bad", "user")
+	assert.ErrorIs(t, err, mod.ErrInvalidAlias)
+
+	c.(Deleter).BatchUpdate([]string{id}, "user")
+	assert.Eventually(t, func() bool {
+		_, del, _ := c.Get(id)
+		return del
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, c.(Closer).Close())
+	c, err = Open(conf)
+	require.NoError(t, err)
+
+	_, del, err := c.Get(id)
+	require.NoError(t, err)
+	assert.True(t, del)
+
+	url, del, err := c.Get("ya-2")
+	require.NoError(t, err)
+	assert.False(t, del)
+	assert.Equal(t, "https://ya.ru/2", url)
+
+	// Индекс адресов восстанавливается из файла.
+	again, err := c.AddAlias("https://ya.ru/2", "ya-3", "other")
+	assert.ErrorIs(t, err, mod.ErrURLConflict)
+	assert.Equal(t, "ya-2", again)
+
+	all, err := c.GetAll("user")
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.True(t, all[0].Deleted)
+	assert.False(t, all[0].Created.IsZero())
+	assert.Equal(t, "http://localhost:8080/ya-2", all[1].ShortURL)
+
+	require.NoError(t, c.(Closer).Close())
+}
+
+func TestAliasShadowsCounterCode(t *testing.T) {
+	c, err := Open(config.Config{})
+	require.NoError(t, err)
+
+	_, err = c.AddAlias("https://ya.ru/alias", "1", "")
+	require.NoError(t, err)
+
+	id, err := c.Add("https://ya.ru/counter", "", mod.Settings{})
+	require.NoError(t, err)
+	assert.Equal(t, mod.ShiftedCode("1"), id)
+
+	url, _, err := c.Get("1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/alias", url)
+
+	url, _, err = c.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/counter", url)
+}
+
+func TestFileStoragePurge(t *testing.T) {
+	conf := config.Config{FileStoragePath: filepath.Join(t.TempDir(), "storage.json")}
+
+	c, err := Open(conf)
+	require.NoError(t, err)
+
+	kept, err := c.Add("https://ya.ru/kept", "user", mod.Settings{})
+	require.NoError(t, err)
+
+	purged, err := c.Add("https://ya.ru/secret", "user", mod.Settings{})
+	require.NoError(t, err)
+
+	c.(Deleter).BatchUpdate([]string{purged}, "user")
+	require.Eventually(t, func() bool {
+		trash, err := c.Trash("user", time.Now().Add(-time.Hour))
+		return err == nil && len(trash) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	n, err := c.Purge(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = c.Purge(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	b, err := os.ReadFile(conf.FileStoragePath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "secret")
+
+	require.NoError(t, c.(Closer).Close())
+	c, err = Open(conf)
+	require.NoError(t, err)
+
+	_, _, err = c.Get(purged)
+	assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+
+	url, _, err := c.Get(kept)
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/kept", url)
+
+	id, err := c.Add("https://ya.ru/new", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.NotEqual(t, purged, id)
+
+	require.NoError(t, c.(Closer).Close())
+}
+
+func TestCodeGenerators(t *testing.T) {
+	for _, generator := range []string{codegen.Random, codegen.Obfuscated, codegen.Hash} {
+		t.Run(generator, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "storage.json")
+			legacy := `{"id":0,"url":"https://ya.ru/legacy","del":false,"user_id":"user"}` + "\n"
+			require.NoError(t, os.WriteFile(path, []byte(legacy), 0600))
+
+			conf := config.Config{
+				FileStoragePath: path,
+				CodeGenerator:   generator,
+				CodeLength:      8,
+				CodeKey:         "secret",
+			}
+
+			c, err := Open(conf)
+			require.NoError(t, err)
+
+			url, _, err := c.Get("0")
+			require.NoError(t, err)
+			assert.Equal(t, "https://ya.ru/legacy", url)
+
+			codes := make(map[string]bool)
+			for i := 0; i < 100; i++ {
+				code, err := c.Add("https://ya.ru/"+strconv.Itoa(i), "user", mod.Settings{})
+				require.NoError(t, err)
+				assert.False(t, codes[code], "duplicate code %s", code)
+				codes[code] = true
+
+				if generator != codegen.Obfuscated {
+					assert.Len(t, code, 8)
+				}
+
+				url, _, err = c.Get(code)
+				require.NoError(t, err)
+				assert.Equal(t, "https://ya.ru/"+strconv.Itoa(i), url)
+			}
+
+			_, _, err = c.Get(strconv.FormatInt(1, 36))
+			assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+
+			require.NoError(t, c.(Closer).Close())
+		})
+	}
+
+	_, err := Open(config.Config{CodeGenerator: codegen.Obfuscated})
+	assert.Error(t, err)
+
+	_, err = Open(config.Config{CodeGenerator: "sqids"})
+	assert.Error(t, err)
+}
+
+func TestObfuscatedCodesAreDeterministic(t *testing.T) {
+	a, err := codegen.NewObfuscated("key")
+	require.NoError(t, err)
+	b, err := codegen.NewObfuscated("other key")
+	require.NoError(t, err)
+
+	seen := make(map[string]bool)
+	for id := 0; id < 10000; id++ {
+		code, err := a.Generate(id, "", 0)
+		require.NoError(t, err)
+		assert.False(t, seen[code])
+		seen[code] = true
+
+		again, err := a.Generate(id, "", 0)
+		require.NoError(t, err)
+		assert.Equal(t, code, again)
+
+		retry, err := a.Generate(id, "", 1)
+		require.NoError(t, err)
+		assert.NotEqual(t, code, retry)
+
+		other, err := b.Generate(id, "", 0)
+		require.NoError(t, err)
+		assert.NotEqual(t, code, other)
+	}
+}
+
+func TestHashCodes(t *testing.T) {
+	conf := config.Config{CodeGenerator: codegen.Hash, CodeLength: 7, CodeNamespace: "ns"}
+
+	c, err := Open(conf)
+	require.NoError(t, err)
+
+	code, err := c.Add("https://ya.ru/page", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.Len(t, code, 7)
+
+	again, err := c.Add("https://ya.ru/page", "other", mod.Settings{})
+	assert.ErrorIs(t, err, mod.ErrURLConflict)
+	assert.Equal(t, code, again)
+
+	// Другая запись того же адреса - другая ссылка со своим кодом.
+	variant, err := c.Add("HTTPS://YA.RU:443/page#top", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.NotEqual(t, code, variant)
+
+	url, _, err := c.Get(variant)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTPS://YA.RU:443/page#top", url)
+
+	url, _, err = c.Get(code)
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/page", url)
+
+	ids, err := c.BatchAdd([]string{"https://ya.ru/page", "https://ya.ru/other"}, "user")
+	var conflict *mod.BatchConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, []int{0}, conflict.Exists)
+	assert.Equal(t, code, ids[0])
+
+	// Другой экземпляр выдает тот же код.
+	c, err = Open(conf)
+	require.NoError(t, err)
+
+	other, err := c.Add("https://ya.ru/page", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.Equal(t, code, other)
+
+	// Занятый код удлиняется.
+	c, err = Open(conf)
+	require.NoError(t, err)
+
+	_, err = c.AddAlias("https://ya.ru/alias", code, "user")
+	require.NoError(t, err)
+
+	longer, err := c.Add("https://ya.ru/page", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.Len(t, longer, 8)
+	assert.Equal(t, code, longer[:7])
+
+	url, _, err = c.Get(longer)
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/page", url)
+
+	conf.CodeNamespace = "other"
+	c, err = Open(conf)
+	require.NoError(t, err)
+
+	other, err = c.Add("https://ya.ru/page", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.NotEqual(t, code, other)
+}
+
+func TestCachedGet(t *testing.T) {
+	server := miniredis.RunT(t)
+	remote, err := cache.NewRedis(server.Addr())
+	require.NoError(t, err)
+	defer remote.Close()
+
+	for name, backend := range map[string]cache.Cache{"lru": cache.NewLRU(100), "redis": remote} {
+		t.Run(name, func(t *testing.T) {
+			s, err := Open(config.Config{})
+			require.NoError(t, err)
+			c := NewCached(s, backend, time.Minute, time.Minute)
+
+			id, err := c.Add("https://ya.ru/cached", "user", mod.Settings{})
+			require.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				url, del, err := c.Get(id)
+				require.NoError(t, err)
+				assert.Equal(t, "https://ya.ru/cached", url)
+				assert.False(t, del)
+			}
+
+			hits, misses := c.(*cachedDeleter).Stats()
+			assert.Equal(t, uint64(2), hits)
+			assert.Equal(t, uint64(1), misses)
+
+			// Промах кешируется и сбрасывается при создании ссылки с этим кодом.
+			_, _, err = c.Get("alias")
+			assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+			_, _, err = c.Get("alias")
+			assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+			hits, _ = c.(*cachedDeleter).Stats()
+			assert.Equal(t, uint64(3), hits)
+
+			_, err = c.AddAlias("https://ya.ru/alias", "alias", "user")
+			require.NoError(t, err)
+			url, _, err := c.Get("alias")
+			require.NoError(t, err)
+			assert.Equal(t, "https://ya.ru/alias", url)
+
+			require.NoError(t, c.Update(id, "https://ya.ru/edited", "user"))
+			url, _, err = c.Get(id)
+			require.NoError(t, err)
+			assert.Equal(t, "https://ya.ru/edited", url)
+
+			// Параметры ссылки кешируются вместе с адресом.
+			require.NoError(t, c.Configure(id, set(mod.Settings{Title: "Cached", Preview: true}), "user"))
+			link, err := c.Link(id)
+			require.NoError(t, err)
+			assert.Equal(t, "https://ya.ru/edited", link.URL)
+			assert.Equal(t, mod.Settings{Title: "Cached", Preview: true}, link.Settings)
+			hits, _ = c.(*cachedDeleter).Stats()
+			link, err = c.Link(id)
+			require.NoError(t, err)
+			assert.True(t, link.Preview)
+			next, _ := c.(*cachedDeleter).Stats()
+			assert.Equal(t, hits+1, next)
+
+			// Фоновое удаление сбрасывает кеш по завершении, а не по таймеру:
+			// прочитанная до удаления запись не держится в кеше.
+			_, _, err = c.Get(id)
+			require.NoError(t, err)
+			c.(Deleter).BatchUpdate([]string{id}, "user")
+			require.Eventually(t, func() bool {
+				_, del, err := s.Get(id)
+				return err == nil && del
+			}, time.Second, 10*time.Millisecond)
+			require.Eventually(t, func() bool {
+				_, del, err := c.Get(id)
+				return err == nil && del
+			}, 100*time.Millisecond, 10*time.Millisecond)
+
+			restored, err := c.Restore([]string{id}, "user", time.Time{})
+			require.NoError(t, err)
+			assert.Equal(t, []string{id}, restored)
+			_, del, err := c.Get(id)
+			require.NoError(t, err)
+			assert.False(t, del)
+
+			// Синхронное удаление сразу видно через кеш.
+			res, err := c.(Deleter).Delete([]string{id}, "user")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{id: mod.DelDeleted}, res)
+			_, del, err = c.Get(id)
+			require.NoError(t, err)
+			assert.True(t, del)
+		})
+	}
+}
+
+// stalledLink - Storage, первое чтение ссылки которого отдает прочитанное
+// только после resume.
+type stalledLink struct {
+	Storage
+	once   sync.Once
+	read   chan struct{}
+	resume chan struct{}
+}
+
+func (s *stalledLink) Link(str string) (mod.Event, error) {
+	link, err := s.Storage.Link(str)
+	s.once.Do(func() {
+		close(s.read)
+		<-s.resume
+	})
+
+	return link, err
+}
+
+func TestCachedGetRacesConfigure(t *testing.T) {
+	s, err := Open(config.Config{})
+	require.NoError(t, err)
+
+	id, err := s.Add("https://ya.ru/secret", "user", mod.Settings{})
+	require.NoError(t, err)
+
+	stalled := &stalledLink{Storage: s, read: make(chan struct{}), resume: make(chan struct{})}
+	c := NewCached(stalled, cache.NewLRU(10), time.Minute, time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, err := c.Get(id)
+		assert.NoError(t, err)
+	}()
+
+	// Ссылка без пароля прочитана до изменения, а в кеш попадает после.
+	<-stalled.read
+	require.NoError(t, c.Configure(id, set(mod.Settings{PasswordHash: "hash"}), "user"))
+	close(stalled.resume)
+	<-done
+
+	link, err := c.Link(id)
+	require.NoError(t, err)
+	assert.Equal(t, "hash", link.PasswordHash)
+}
+
+func TestCacheLimits(t *testing.T) {
+	lru := cache.NewLRU(2)
+	require.NoError(t, lru.Set("a", cache.Entry{URL: "a"}, time.Minute))
+	require.NoError(t, lru.Set("b", cache.Entry{URL: "b"}, time.Minute))
+	_, ok, _ := lru.Get("a")
+	assert.True(t, ok)
+	require.NoError(t, lru.Set("c", cache.Entry{URL: "c"}, time.Minute))
+
+	_, ok, _ = lru.Get("b")
+	assert.False(t, ok)
+	_, ok, _ = lru.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, lru.Len())
+
+	require.NoError(t, lru.Set("short", cache.Entry{URL: "short"}, time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	_, ok, _ = lru.Get("short")
+	assert.False(t, ok)
+
+	server := miniredis.RunT(t)
+	remote, err := cache.NewRedis(server.Addr())
+	require.NoError(t, err)
+	defer remote.Close()
+
+	require.NoError(t, remote.Set("a", cache.Entry{Missing: true}, time.Second))
+	e, ok, err := remote.Get("a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, e.Missing)
+
+	server.FastForward(2 * time.Second)
+	_, ok, err = remote.Get("a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, remote.Set("b", cache.Entry{URL: "b"}, time.Minute))
+	require.NoError(t, remote.Flush())
+	_, ok, err = remote.Get("b")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestRedisStorage(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	c, err := Open(config.Config{RedisAddr: server.Addr(), ServerAddress: "localhost:8080/"})
+	require.NoError(t, err)
+
+	id, err := c.Add("https://ya.ru/0", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.Equal(t, "0", id)
+
+	again, err := c.Add("https://ya.ru/0", "other", mod.Settings{})
+	assert.ErrorIs(t, err, mod.ErrURLConflict)
+	assert.Equal(t, id, again)
+
+	// Псевдоним занимает base36 код следующей ссылки.
+	alias, err := c.AddAlias("https://ya.ru/alias", "2", "user")
+	require.NoError(t, err)
+	assert.Equal(t, "2", alias)
+
+	_, err = c.AddAlias("https://ya.ru/other", "2", "user")
+	assert.ErrorIs(t, err, mod.ErrAliasConflict)
+	_, err = c.AddAlias("https://ya.ru/other", "0", "user")
+	assert.ErrorIs(t, err, mod.ErrInvalidAlias)
+
+	ids, err := c.BatchAdd([]string{"https://ya.ru/2", "https://ya.ru/0", "https://ya.ru/3"}, "user")
+	var conflict *mod.BatchConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, []int{1}, conflict.Exists)
+	assert.Equal(t, []string{mod.ShiftedCode("2"), "0", "3"}, ids)
+
+	for code, want := range map[string]string{"0": "https://ya.ru/0", "2": "https://ya.ru/alias", ids[0]: "https://ya.ru/2"} {
+		url, del, err := c.Get(code)
+		require.NoError(t, err)
+		assert.False(t, del)
+		assert.Equal(t, want, url)
+	}
+
+	_, _, err = c.Get("zz")
+	assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+
+	require.NoError(t, c.Click("0"))
+	require.NoError(t, c.Click("0"))
+	assert.ErrorIs(t, c.Click("zz"), mod.ErrStorageIsNil)
+
+	assert.ErrorIs(t, c.Update("0", "https://ya.ru/edited", "other"), mod.ErrForbidden)
+	assert.ErrorIs(t, c.Update("0", "https://ya.ru/alias", "user"), mod.ErrURLConflict)
+	require.NoError(t, c.Update("0", "https://ya.ru/edited", "user"))
+
+	history, err := c.History("0", "user")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "https://ya.ru/0", history[0].URL)
+
+	// Освободившийся адрес можно сократить заново.
+	_, err = c.Add("https://ya.ru/0", "user", mod.Settings{})
+	require.NoError(t, err)
+
+	urls, next, err := c.Find("user", mod.Query{Limit: 2, Sort: mod.SortClicks, Desc: true})
+	require.NoError(t, err)
+	require.Len(t, urls, 2)
+	assert.NotNil(t, next)
+	assert.Equal(t, "http://localhost:8080/0", urls[0].ShortURL)
+	assert.Equal(t, 2, urls[0].Clicks)
+
+	c.(Deleter).BatchUpdate([]string{"0", "2", "zz"}, "user")
+	require.Eventually(t, func() bool {
+		_, del, err := c.Get("0")
+		return err == nil && del
+	}, time.Second, 10*time.Millisecond)
+
+	trash, err := c.Trash("user", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Len(t, trash, 2)
+
+	restored, err := c.Restore([]string{"2", "zz"}, "user", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, restored)
+
+	all, err := c.GetAll("user")
+	require.NoError(t, err)
+	assert.Len(t, all, 5)
+
+	n, err := c.Purge(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, _, err = c.Get("0")
+	assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+
+	// ID не переиспользуются после удаления.
+	id, err = c.Add("https://ya.ru/edited", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.Equal(t, "5", id)
+
+	// Одновременные добавления получают разные коды, и каждая ссылка
+	// создается сразу со своим кодом.
+	codes := make([]string, 20)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			code, err := c.Add("https://ya.ru/concurrent/"+strconv.Itoa(i), "user", mod.Settings{})
+			assert.NoError(t, err)
+			codes[i] = code
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		assert.False(t, seen[code], code)
+		seen[code] = true
+
+		url, _, err := c.Get(code)
+		require.NoError(t, err)
+		assert.Equal(t, "https://ya.ru/concurrent/"+strconv.Itoa(i), url)
+	}
+
+	// Хеш-тег кладет все ключи хранилища в один слот.
+	for _, key := range server.Keys() {
+		assert.True(t, strings.HasPrefix(key, "{shortener}:"), key)
+	}
+
+	_, err = Open(config.Config{RedisAddr: "127.0.0.1:1"})
+	assert.Error(t, err)
+}
+
+func TestEmbeddedStorage(t *testing.T) {
+	conf := config.Config{
+		StorageBackend: Embedded,
+		EmbeddedPath:   filepath.Join(t.TempDir(), "shortener.db"),
+		ServerAddress:  "localhost:8080/",
+	}
+
+	c, err := Open(conf)
+	require.NoError(t, err)
+
+	id, err := c.Add("https://ya.ru/0", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.Equal(t, "0", id)
+
+	again, err := c.Add("https://ya.ru/0", "other", mod.Settings{})
+	assert.ErrorIs(t, err, mod.ErrURLConflict)
+	assert.Equal(t, id, again)
+
+	_, err = c.AddAlias("https://ya.ru/alias", "2", "user")
+	require.NoError(t, err)
+	_, err = c.AddAlias("https://ya.ru/other", "2", "user")
+	assert.ErrorIs(t, err, mod.ErrAliasConflict)
+
+	ids, err := c.BatchAdd([]string{"https://ya.ru/2", "https://ya.ru/0", "https://ya.ru/3"}, "user")
+	var conflict *mod.BatchConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, []int{1}, conflict.Exists)
+	assert.Equal(t, []string{mod.ShiftedCode("2"), "0", "3"}, ids)
+
+	require.NoError(t, c.Click("0"))
+	require.NoError(t, c.Update("0", "https://ya.ru/edited", "user"))
+	assert.ErrorIs(t, c.Update("0", "https://ya.ru/alias", "user"), mod.ErrURLConflict)
+	assert.ErrorIs(t, c.Update("0", "https://ya.ru/x", "other"), mod.ErrForbidden)
+
+	history, err := c.History("0", "user")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "https://ya.ru/0", history[0].URL)
+
+	urls, _, err := c.Find("user", mod.Query{Limit: 1, Sort: mod.SortClicks, Desc: true})
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+	assert.Equal(t, "http://localhost:8080/0", urls[0].ShortURL)
+	assert.Equal(t, 1, urls[0].Clicks)
+
+	c.(Deleter).BatchUpdate([]string{"0", "2"}, "user")
+	require.Eventually(t, func() bool {
+		_, del, err := c.Get("2")
+		return err == nil && del
+	}, time.Second, 10*time.Millisecond)
+
+	restored, err := c.Restore([]string{"2"}, "user", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, restored)
+
+	n, err := c.Purge(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, _, err = c.Get("0")
+	assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+
+	// Данные сохраняются между запусками.
+	require.NoError(t, c.(Closer).Close())
+	c, err = Open(conf)
+	require.NoError(t, err)
+
+	url, _, err := c.Get("2")
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/alias", url)
+
+	id, err = c.Add("https://ya.ru/edited", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.Equal(t, "4", id)
+	require.NoError(t, c.(Closer).Close())
+
+	_, err = Open(config.Config{StorageBackend: "sqlite"})
+	assert.Error(t, err)
+}
+
+func TestRegistry(t *testing.T) {
+	assert.Equal(t, []string{Embedded, File, Memory, Postgres, Redis}, Backends())
+
+	path := filepath.Join(t.TempDir(), "storage.json")
+	assert.Equal(t, Memory, Backend(config.Config{}))
+	assert.Equal(t, File, Backend(config.Config{FileStoragePath: path}))
+	assert.Equal(t, Postgres, Backend(config.Config{DataBaseDSN: "dsn", FileStoragePath: path}))
+	assert.Equal(t, Memory, Backend(config.Config{StorageBackend: Memory, FileStoragePath: path}))
+
+	_, err := Open(config.Config{StorageBackend: "mysql"})
+	assert.ErrorContains(t, err, "available: embedded, file, memory, postgres, redis")
+
+	_, err = Open(config.Config{StorageBackend: Redis})
+	assert.Error(t, err)
+
+	s, err := Open(config.Config{})
+	require.NoError(t, err)
+
+	_, ok := As[Pinger](s)
+	assert.False(t, ok)
+	_, ok = As[Closer](s)
+	assert.False(t, ok)
+
+	cached := NewCached(s, cache.NewLRU(10), time.Minute, 0)
+	_, ok = As[Deleter](cached)
+	assert.True(t, ok)
+	_, ok = As[Pinger](cached)
+	assert.False(t, ok)
+
+	s, err = Open(config.Config{StorageBackend: File, FileStoragePath: path})
+	require.NoError(t, err)
+
+	closer, ok := As[Closer](NewCached(s, cache.NewLRU(10), time.Minute, 0))
+	require.True(t, ok)
+	assert.NoError(t, closer.Close())
+}
+
+func TestDurableMemory(t *testing.T) {
+	dir := t.TempDir()
+	conf := config.Config{
+		StorageBackend:     Memory,
+		ServerAddress:      "localhost:8080/",
+		MemorySnapshotPath: filepath.Join(dir, "memory.snapshot"),
+	}
+
+	c, err := Open(conf)
+	require.NoError(t, err)
+
+	_, err = c.BatchAdd([]string{"https://ya.ru/0", "https://ya.ru/1", "https://ya.ru/2"}, "user")
+	require.NoError(t, err)
+	_, err = c.AddAlias("https://ya.ru/alias", "alias", "user")
+	require.NoError(t, err)
+	require.NoError(t, c.Update("0", "https://ya.ru/edited", "user"))
+
+	// Без снимка ссылки восстанавливаются из журнала, как после сбоя.
+	conf.MemorySnapshotPath = crash(t, c, conf.MemorySnapshotPath)
+	c, err = Open(conf)
+	require.NoError(t, err)
+
+	url, _, err := c.Get("0")
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/edited", url)
+
+	require.NoError(t, c.(*m.Durable).Snapshot())
+
+	c.(Deleter).BatchUpdate([]string{"2"}, "user")
+	assert.Eventually(t, func() bool {
+		_, del, _ := c.Get("2")
+		return del
+	}, time.Second, 10*time.Millisecond)
+
+	n, err := c.Purge(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = c.Add("https://ya.ru/4", "user", mod.Settings{})
+	require.NoError(t, err)
+
+	conf.MemorySnapshotPath = crash(t, c, conf.MemorySnapshotPath)
+	wals, err := filepath.Glob(conf.MemorySnapshotPath + ".wal.*")
+	require.NoError(t, err)
+	require.Len(t, wals, 1)
+
+	// Оборванная при сбое запись журнала отбрасывается.
+	wal, err := os.OpenFile(wals[0], os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = wal.WriteString(`{"id":5,"url":"https://ya`)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	c, err = Open(conf)
+	require.NoError(t, err)
+
+	_, _, err = c.Get("2")
+	assert.ErrorIs(t, err, mod.ErrStorageIsNil)
+
+	url, _, err = c.Get("alias")
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/alias", url)
+
+	id, err := c.Add("https://ya.ru/5", "user", mod.Settings{})
+	require.NoError(t, err)
+	assert.Equal(t, "5", id)
+
+	require.NoError(t, c.(Closer).Close())
+
+	c, err = Open(conf)
+	require.NoError(t, err)
+
+	all, err := c.GetAll("user")
+	require.NoError(t, err)
+	assert.Len(t, all, 5)
+	require.NoError(t, c.(Closer).Close())
+}
+
+// crash копирует файлы хранилища со снимком path в новый каталог, как их
+// оставил бы сбой, и закрывает хранилище c. Возвращает путь снимка в копии.
+func crash(t *testing.T, c Storage, path string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	files, err := filepath.Glob(path + "*")
+	require.NoError(t, err)
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, filepath.Base(file)), b, 0600))
+	}
+
+	require.NoError(t, c.(Closer).Close())
+
+	return filepath.Join(dir, filepath.Base(path))
+}